@@ -6,12 +6,16 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/elastic/hey-apm/es"
 	"github.com/elastic/hey-apm/models"
+	"github.com/elastic/hey-apm/output"
+	"github.com/elastic/hey-apm/storage"
+	"github.com/elastic/hey-apm/tlsconfig"
 	"github.com/elastic/hey-apm/worker"
 )
 
@@ -27,9 +31,20 @@ const (
 // Regression checks accept an error margin and are not aware of apm-server versions, only URLs.
 // apm-server must be started independently with -E apm-server.expvar.enabled=true
 func Run(ctx context.Context, input models.Input) error {
-	conn, err := es.NewConnection(input.ElasticsearchUrl, input.ElasticsearchAuth)
+	store, err := storage.New(input)
 	if err != nil {
-		return errors.Wrap(err, "Elasticsearch not reachable, won't be able to index a report")
+		return errors.Wrap(err, "report storage not available, won't be able to index a report")
+	}
+	if store == nil {
+		return errors.New("no report storage configured, set either -es-url or -report-path")
+	}
+	tlsConfig, err := tlsconfig.New(input)
+	if err != nil {
+		return err
+	}
+	conn, err := es.NewConnection(es.APMConfig(input, tlsConfig))
+	if err != nil {
+		return errors.Wrap(err, "Elasticsearch used by APM Server not known or reachable")
 	}
 
 	log.Printf("Deleting previous APM event documents...")
@@ -44,14 +59,25 @@ func Run(ctx context.Context, input models.Input) error {
 	}
 
 	tests := defineTests(input)
-	reports, err := tests.run(ctx)
+	reports, results, err := tests.run(ctx)
 	if err != nil {
 		return err
 	}
-	if err := verifyReports(reports, conn, input.RegressionMargin, input.RegressionDays); err != nil {
+	if err := output.Save(input, reports, results); err != nil {
 		return err
 	}
-	return nil
+	outcomes, err := verifyReports(reports, store, input.RegressionMargin, input.RegressionDays, input.RegressionBranch)
+	if input.JUnitFile != "" {
+		if err := writeFile(input.JUnitFile, outcomes, writeJUnit); err != nil {
+			return err
+		}
+	}
+	if input.MarkdownFile != "" {
+		if err := writeFile(input.MarkdownFile, outcomes, writeMarkdown); err != nil {
+			return err
+		}
+	}
+	return err
 }
 
 func defineTests(input models.Input) tests {
@@ -77,31 +103,41 @@ func (t *tests) add(name string, input models.Input) {
 	*t = append(*t, test{name: name, input: input})
 }
 
-func (t *tests) run(ctx context.Context) ([]models.Report, error) {
+func (t *tests) run(ctx context.Context) ([]models.Report, []worker.Result, error) {
 	reports := make([]models.Report, len(*t))
+	results := make([]worker.Result, len(*t))
 	for i, test := range *t {
 		log.Printf("running benchmark %q", test.name)
-		report, err := worker.Run(ctx, test.input, test.name, nil /*stop*/)
+		control := worker.NewControl()
+		worker.RegisterMetrics(test.name, control)
+		stopProgress := worker.StartProgress(test.input, control)
+		report, result, err := worker.RunWithResult(ctx, test.input, test.name, control)
+		stopProgress()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if err := coolDown(ctx); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		reports[i] = report
+		reports[i], results[i] = report, result
 	}
-	return reports, nil
+	return reports, results, nil
 }
 
-func verifyReports(reports []models.Report, conn es.Connection, margin float64, days string) error {
+// verifyReports checks every report for regressions, and returns the outcome of each check
+// along with the last error found.
+func verifyReports(reports []models.Report, store storage.Storage, margin float64, days, branch string) ([]outcome, error) {
 	var lastErr error
-	for _, report := range reports {
-		if err := verify(conn, report, margin, days); err != nil {
+	outcomes := make([]outcome, len(reports))
+	for i, report := range reports {
+		err := verify(store, report, margin, days, branch)
+		if err != nil {
 			fmt.Println(err)
 			lastErr = err
 		}
+		outcomes[i] = outcome{report: report, err: err}
 	}
-	return lastErr
+	return outcomes, lastErr
 }
 
 // warmUp sends a moderate load to apm-server without saving a report.
@@ -131,22 +167,18 @@ func coolDown(ctx context.Context) error {
 
 // verify asserts there are no performance regressions for a given workload.
 //
-// compares the given report with saved reports with the same input indexed in the last specified days
-// returns an error if connection can't be established,
+// compares the given report with saved reports with the same input, test name and labels stored in the last
+// specified days, and from the given git branch if not empty
+// returns an error if saved reports can't be fetched,
 // or performance decreased by a margin larger than specified
-func verify(conn es.Connection, report models.Report, margin float64, days string) error {
+func verify(store storage.Storage, report models.Report, margin float64, days, branch string) error {
 	if report.EventsIndexed < 100 {
 		return fmt.Errorf("not enough events indexed: %d", report.EventsIndexed)
 	}
-
-	filters := []map[string]interface{}{{
-		"range": map[string]interface{}{
-			"@timestamp": map[string]interface{}{
-				"gte": fmt.Sprintf("now-%sd/d", days),
-				"lt":  "now",
-			},
-		},
-	}}
+	numDays, err := strconv.Atoi(days)
+	if err != nil {
+		return err
+	}
 
 	// Convert input to a JSON map, to filter on the previous results for matching inputs.
 	inputMap := make(map[string]interface{})
@@ -157,19 +189,15 @@ func verify(conn es.Connection, report models.Report, margin float64, days strin
 	if err := json.Unmarshal(encodedInput, &inputMap); err != nil {
 		return err
 	}
-	for k, v := range inputMap {
-		filters = append(filters, map[string]interface{}{
-			"match": map[string]interface{}{k: v},
-		})
+
+	if report.TestName != "" {
+		inputMap["test_name"] = report.TestName
+	}
+	if branch != "" {
+		inputMap["git_branch"] = branch
 	}
 
-	savedReports, fetchErr := es.FetchReports(conn, map[string]interface{}{
-		"query": map[string]interface{}{
-			"bool": map[string]interface{}{
-				"must": filters,
-			},
-		},
-	})
+	savedReports, fetchErr := store.FetchReports(storage.Query{Fields: inputMap, Labels: report.Labels, Days: numDays})
 	if fetchErr != nil {
 		return fetchErr
 	}
@@ -0,0 +1,76 @@
+package benchmark
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/hey-apm/es"
+	"github.com/elastic/hey-apm/fake"
+	"github.com/elastic/hey-apm/models"
+	"github.com/elastic/hey-apm/storage"
+)
+
+func TestVerify(t *testing.T) {
+	elasticsearch := fake.NewElasticsearch()
+	defer elasticsearch.Close()
+	conn, err := es.NewConnection(es.Config{URL: elasticsearch.URL})
+	require.NoError(t, err)
+	store, err := storage.NewElasticsearch(conn)
+	require.NoError(t, err)
+
+	input := models.Input{IsBenchmark: true, TransactionFrequency: time.Millisecond, Instances: 1}
+	otherInput := input
+	otherInput.Instances = 2
+	report := func(id string, input models.Input, performance uint64, age time.Duration, branch string, labels ...string) models.Report {
+		return models.Report{
+			Input:         input,
+			ReportId:      id,
+			Timestamp:     time.Now().Add(-age),
+			Metadata:      models.Metadata{TestName: "test", GitBranch: branch, Labels: labels},
+			Elapsed:       1,
+			EventsIndexed: performance,
+		}
+	}
+	for _, r := range []models.Report{
+		report("1", input, 1000, time.Minute, "master"),
+		report("2", input, 1200, time.Minute, "feature"),
+		report("3", otherInput, 5000, time.Minute, "master"),
+		report("4", input, 5000, 10*24*time.Hour, "master"),
+		report("5", input, 2200, time.Minute, "", "env=cloud"),
+	} {
+		require.NoError(t, store.IndexReport(r))
+	}
+
+	for _, tc := range []struct {
+		name       string
+		report     models.Report
+		days       string
+		branch     string
+		regression bool
+	}{
+		{name: "same performance", report: report("new", input, 1500, 0, ""), days: "7"},
+		{name: "within margin", report: report("new", input, 1400, 0, ""), days: "7"},
+		{name: "regression", report: report("new", input, 1000, 0, ""), days: "7", regression: true},
+		{name: "branch", report: report("new", input, 1000, 0, ""), days: "7", branch: "master"},
+		{name: "branch regression", report: report("new", input, 1000, 0, ""), days: "7", branch: "feature", regression: true},
+		{name: "older reports", report: report("new", input, 1500, 0, ""), days: "30", regression: true},
+		{name: "labels", report: report("new", input, 1500, 0, "", "env=cloud"), days: "7", regression: true},
+		{name: "other input", report: report("new", otherInput, 1500, 0, ""), days: "7", regression: true},
+		{name: "no previous reports", report: report("new", input, 1500, 0, "", "env=local"), days: "7"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verify(store, tc.report, 1.1, tc.days, tc.branch)
+			if tc.regression {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	err = verify(store, report("new", input, 10, 0, ""), 1.1, "7", "")
+	assert.EqualError(t, err, "not enough events indexed: 10")
+}
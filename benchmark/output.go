@@ -0,0 +1,121 @@
+package benchmark
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/elastic/hey-apm/models"
+)
+
+// outcome holds a benchmark report and the result of checking it for regressions.
+type outcome struct {
+	report models.Report
+	err    error
+}
+
+func writeFile(path string, outcomes []outcome, write func(io.Writer, []outcome) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f, outcomes); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes outcomes as a JUnit XML document, with one testcase per benchmark test.
+func writeJUnit(w io.Writer, outcomes []outcome) error {
+	suite := junitTestSuite{Name: "hey-apm benchmarks", Tests: len(outcomes)}
+	var elapsed float64
+	for _, o := range outcomes {
+		elapsed += o.report.Elapsed
+		if suite.Timestamp == "" && !o.report.Timestamp.IsZero() {
+			suite.Timestamp = o.report.Timestamp.Format("2006-01-02T15:04:05")
+		}
+		tc := junitTestCase{
+			Name:      o.report.TestName,
+			ClassName: "benchmark",
+			Time:      fmt.Sprintf("%.3f", o.report.Elapsed),
+			SystemOut: fmt.Sprintf("report id: %s\nevents indexed: %d\nevents indexed per second: %.2f\n",
+				o.report.ReportId, o.report.EventsIndexed, o.report.Performance()),
+		}
+		if o.err != nil {
+			suite.Failures++
+			tc.Failure = &junitFailure{Message: o.err.Error(), Type: "regression", Text: o.err.Error()}
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+	suite.Time = fmt.Sprintf("%.3f", elapsed)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeMarkdown writes outcomes as a Markdown table, suitable for commenting on pull requests.
+func writeMarkdown(w io.Writer, outcomes []outcome) error {
+	var failures int
+	var buf strings.Builder
+	buf.WriteString("| Test | Events indexed | Elapsed (s) | Events indexed/s | Result |\n")
+	buf.WriteString("|------|---------------:|------------:|-----------------:|--------|\n")
+	for _, o := range outcomes {
+		result := ":white_check_mark: pass"
+		if o.err != nil {
+			failures++
+			result = ":x: " + markdownEscape(o.err.Error())
+		}
+		fmt.Fprintf(&buf, "| %s | %d | %.1f | %.2f | %s |\n",
+			markdownEscape(o.report.TestName), o.report.EventsIndexed, o.report.Elapsed, o.report.Performance(), result)
+	}
+
+	if _, err := fmt.Fprintf(w, "## hey-apm benchmarks\n\n%d tests, %d failed\n\n", len(outcomes), failures); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+func markdownEscape(s string) string {
+	s = strings.ReplaceAll(s, "|", `\|`)
+	return strings.ReplaceAll(s, "\n", " ")
+}
@@ -0,0 +1,49 @@
+package benchmark
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/hey-apm/models"
+)
+
+func testOutcomes() []outcome {
+	return []outcome{
+		{report: models.Report{Metadata: models.Metadata{TestName: "transactions only"}, ReportId: "abc", Elapsed: 10, EventsIndexed: 1000}},
+		{report: models.Report{Metadata: models.Metadata{TestName: "errors | frames"}, ReportId: "def", Elapsed: 5, EventsIndexed: 50},
+			err: errors.New("not enough events indexed: 50")},
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeJUnit(&buf, testOutcomes()))
+
+	var suites junitTestSuites
+	require.NoError(t, xml.Unmarshal(buf.Bytes(), &suites))
+	require.Len(t, suites.Suites, 1)
+	suite := suites.Suites[0]
+	assert.Equal(t, 2, suite.Tests)
+	assert.Equal(t, 1, suite.Failures)
+	assert.Equal(t, "15.000", suite.Time)
+	require.Len(t, suite.TestCases, 2)
+	assert.Equal(t, "transactions only", suite.TestCases[0].Name)
+	assert.Nil(t, suite.TestCases[0].Failure)
+	require.NotNil(t, suite.TestCases[1].Failure)
+	assert.Equal(t, "not enough events indexed: 50", suite.TestCases[1].Failure.Message)
+}
+
+func TestWriteMarkdown(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeMarkdown(&buf, testOutcomes()))
+
+	out := buf.String()
+	assert.Contains(t, out, "2 tests, 1 failed")
+	assert.Contains(t, out, "| transactions only | 1000 | 10.0 | 100.00 | :white_check_mark: pass |")
+	assert.Contains(t, out, `| errors \| frames | 50 | 5.0 | 10.00 | :x: not enough events indexed: 50 |`)
+}
@@ -0,0 +1,161 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/hey-apm/models"
+	"github.com/elastic/hey-apm/worker"
+)
+
+const (
+	// registerTimeout is how long an agent keeps trying to reach the coordinator.
+	registerTimeout = time.Minute
+	// snapshotInterval is how often an agent sends its results while running.
+	snapshotInterval = time.Second
+)
+
+// Join registers with the coordinator at the given URL, generates the share of the workload
+// it is assigned on top of the given input, and sends its results back to the coordinator.
+//
+// Settings not encoded in JSON, such as credentials, are taken from the given input,
+// and so are the apm-server and Elasticsearch URLs that credentials are sent to.
+// Agents don't query apm-server status nor index reports, the coordinator does.
+func Join(ctx context.Context, coordinatorURL string, input models.Input) error {
+	c := &agentClient{url: strings.TrimSuffix(coordinatorURL, "/")}
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "unknown"
+	}
+
+	var reg registered
+	deadline := time.Now().Add(registerTimeout)
+	for {
+		err := c.do(ctx, http.MethodPost, "/agents", registration{Host: fmt.Sprintf("%s/%d", host, os.Getpid())}, &reg)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil || !time.Now().Before(deadline) {
+			return errors.Wrap(err, "error registering with coordinator")
+		}
+		log.Printf("coordinator not available, retrying: %s", err)
+		time.Sleep(time.Second)
+	}
+	log.Printf("registered as agent %d, waiting for all agents to join...", reg.ID)
+
+	var a assignment
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/agents/%d/assignment", reg.ID), nil, &a); err != nil {
+		return errors.Wrap(err, "error getting assignment from coordinator")
+	}
+	// Credentials are only sent to the URLs given to the agent, whatever the coordinator says
+	apmServerURL, elasticsearchURL := input.ApmServerUrl, input.ApmElasticsearchUrl
+	if err := json.Unmarshal(a.Input, &input); err != nil {
+		return errors.Wrap(err, "invalid assignment")
+	}
+	input.ApmServerUrl, input.ApmElasticsearchUrl = apmServerURL, elasticsearchURL
+	input.IsBenchmark = false
+	input.SkipIndexReport = true
+	// The coordinator waits for apm-servers to process events and counts those indexed, for all agents at once
+	input.SkipStatus = true
+	input.TestName = a.TestName
+	input.Labels = a.Labels
+
+	log.Printf("starting %d instances at %s", input.Instances, a.StartAt.Format(time.RFC3339Nano))
+	timer := time.NewTimer(time.Until(a.StartAt))
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return ctx.Err()
+	case <-timer.C:
+	}
+
+	control := worker.NewControl()
+	done := make(chan struct{})
+	snapshotsDone := make(chan struct{})
+	go func() {
+		defer close(snapshotsDone)
+		c.sendSnapshots(ctx, reg.ID, control, done)
+	}()
+	_, _, runErr := worker.RunInstances(ctx, input, control)
+	close(done)
+	<-snapshotsDone
+
+	report := finalReport{Results: control.Stats()}
+	if runErr != nil {
+		report.Error = runErr.Error()
+	}
+	// The run context might be cancelled by now, but results must still be sent.
+	if err := c.do(context.Background(), http.MethodPost, fmt.Sprintf("/agents/%d/report", reg.ID), report, nil); err != nil {
+		return errors.Wrap(err, "error sending results to coordinator")
+	}
+	return runErr
+}
+
+// sendSnapshots sends live results to the coordinator until done is closed,
+// and stops the workers when the coordinator says so.
+func (c *agentClient) sendSnapshots(ctx context.Context, id int, control *worker.Control, done <-chan struct{}) {
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		var resp snapshotResponse
+		if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/agents/%d/stats", id), snapshot{Results: control.Stats()}, &resp); err != nil {
+			log.Printf("error sending stats to coordinator: %s", err)
+			continue
+		}
+		if resp.Stop {
+			control.Stop()
+		}
+	}
+}
+
+type agentClient struct {
+	url    string
+	client http.Client
+}
+
+// do sends a request with an optional JSON body to the coordinator, and decodes any JSON response into out.
+func (c *agentClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, c.url+path, &body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("coordinator returned %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,88 @@
+// Package cluster generates load from several hey-apm processes at once.
+//
+// A coordinator waits for a number of agents to register, gives each of them a share
+// of the workload and a common start time, receives snapshots of their results while
+// they run, and creates a single report merging all of them.
+//
+// Agents and coordinator talk JSON over HTTP, with the following coordinator endpoints:
+//
+//	POST /agents                    registers an agent, and returns its id
+//	GET  /agents/{id}/assignment    waits for all agents to register, and returns the agent workload
+//	POST /agents/{id}/stats         receives a snapshot of the agent results while running
+//	POST /agents/{id}/report        receives the final agent results
+package cluster
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/elastic/hey-apm/models"
+	"github.com/elastic/hey-apm/worker"
+)
+
+// syncDelay is the time given to agents between receiving their assignment and starting.
+const syncDelay = 2 * time.Second
+
+type registration struct {
+	Host string `json:"host"`
+}
+
+type registered struct {
+	ID int `json:"id"`
+}
+
+type assignment struct {
+	// Input holds the JSON encoded workload, to be applied on top of the agent settings
+	Input    json.RawMessage `json:"input"`
+	TestName string          `json:"test_name,omitempty"`
+	Labels   []string        `json:"labels,omitempty"`
+	StartAt  time.Time       `json:"start_at"`
+}
+
+type snapshot struct {
+	Results []worker.Result `json:"results"`
+}
+
+type snapshotResponse struct {
+	// Stop is set once the coordinator wants the agent to stop gracefully
+	Stop bool `json:"stop"`
+}
+
+type finalReport struct {
+	Results []worker.Result `json:"results"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// share returns the part of the workload to be generated by the i-th of n agents.
+// input.Instances must be at least 1.
+//
+// Instances are spread across agents. When there are fewer instances than agents,
+// each agent runs a single instance generating proportionally fewer events.
+func share(input models.Input, i, n int) models.Input {
+	if input.Instances >= n {
+		instances := input.Instances / n
+		if i < input.Instances%n {
+			instances++
+		}
+		input.Instances = instances
+		return input
+	}
+	scale := float64(n) / float64(input.Instances)
+	input.Instances = 1
+	input.TransactionFrequency = time.Duration(float64(input.TransactionFrequency) * scale)
+	input.ErrorFrequency = time.Duration(float64(input.ErrorFrequency) * scale)
+	input.TransactionLimit = splitLimit(input.TransactionLimit, scale)
+	input.ErrorLimit = splitLimit(input.ErrorLimit, scale)
+	return input
+}
+
+// splitLimit divides a positive limit, leaving at least 1.
+func splitLimit(limit int, scale float64) int {
+	if limit <= 0 {
+		return limit
+	}
+	if split := int(float64(limit) / scale); split > 0 {
+		return split
+	}
+	return 1
+}
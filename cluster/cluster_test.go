@@ -0,0 +1,144 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/hey-apm/fake"
+	"github.com/elastic/hey-apm/models"
+)
+
+func TestShare(t *testing.T) {
+	input := models.Input{Instances: 3, TransactionFrequency: time.Millisecond, TransactionLimit: 100}
+	assert.Equal(t, 2, share(input, 0, 2).Instances)
+	assert.Equal(t, 1, share(input, 1, 2).Instances)
+	assert.Equal(t, time.Millisecond, share(input, 1, 2).TransactionFrequency)
+
+	input.Instances = 1
+	shared := share(input, 1, 4)
+	assert.Equal(t, 1, shared.Instances)
+	assert.Equal(t, 4*time.Millisecond, shared.TransactionFrequency)
+	assert.Equal(t, 25, shared.TransactionLimit)
+	assert.Equal(t, 0, shared.ErrorLimit)
+}
+
+func TestCoordinateAgents(t *testing.T) {
+	apmServer := fake.NewAPMServer(fake.APMServerConfig{})
+	defer apmServer.Close()
+
+	input := models.Input{
+		ApmServerUrl:         apmServer.URL,
+		ApmElasticsearchUrl:  apmServer.URL,
+		ServiceName:          "hey-cluster-test",
+		SkipIndexReport:      true,
+		RunTimeout:           500 * time.Millisecond,
+		FlushTimeout:         time.Second,
+		Instances:            3,
+		TransactionFrequency: 10 * time.Millisecond,
+		TransactionLimit:     math.MaxInt32,
+		SpanMinLimit:         1,
+		SpanMaxLimit:         1,
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Agents run in processes of their own, as they would on other hosts
+	var agents []*exec.Cmd
+	var outputs []*bytes.Buffer
+	for i := 0; i < 2; i++ {
+		var output bytes.Buffer
+		cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestAgentProcess$")
+		cmd.Env = append(os.Environ(),
+			agentCoordinatorEnv+"=http://"+ln.Addr().String(),
+			agentApmServerEnv+"="+apmServer.URL,
+		)
+		cmd.Stdout, cmd.Stderr = &output, &output
+		require.NoError(t, cmd.Start())
+		agents, outputs = append(agents, cmd), append(outputs, &output)
+	}
+	report, err := Coordinate(ctx, ln, 2, input)
+	require.NoError(t, err)
+	for i, cmd := range agents {
+		assert.NoError(t, cmd.Wait(), outputs[i].String())
+	}
+
+	assert.Equal(t, 3, report.Instances)
+	assert.NotZero(t, report.TransactionsSent)
+	assert.Equal(t, report.TransactionsSent, report.SpansSent)
+	assert.NotZero(t, report.Requests)
+	assert.Equal(t, apmServer.Stats().Accepted, report.EventsAccepted)
+}
+
+const (
+	agentCoordinatorEnv = "HEY_APM_TEST_COORDINATOR"
+	agentApmServerEnv   = "HEY_APM_TEST_APM_SERVER"
+)
+
+// TestAgentProcess joins a coordinator when run by TestCoordinateAgents in a process of its own.
+func TestAgentProcess(t *testing.T) {
+	coordinatorURL := os.Getenv(agentCoordinatorEnv)
+	if coordinatorURL == "" {
+		t.Skip("only run as an agent process")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	// Agents get their workload from the coordinator
+	require.NoError(t, Join(ctx, coordinatorURL, models.Input{ApmServerUrl: os.Getenv(agentApmServerEnv)}))
+}
+
+// Agents send their credentials to their own apm-server, not to the one of the coordinator.
+func TestJoinKeepsURLs(t *testing.T) {
+	apmServer := fake.NewAPMServer(fake.APMServerConfig{})
+	defer apmServer.Close()
+	var elsewhere int64
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&elsewhere, 1)
+	}))
+	defer other.Close()
+
+	var report finalReport
+	coordinator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/agents":
+			json.NewEncoder(w).Encode(registered{ID: 1})
+		case "/agents/1/assignment":
+			input, _ := json.Marshal(models.Input{
+				ApmServerUrl:         other.URL,
+				ApmElasticsearchUrl:  other.URL,
+				RunTimeout:           200 * time.Millisecond,
+				FlushTimeout:         time.Second,
+				Instances:            1,
+				TransactionFrequency: 10 * time.Millisecond,
+				TransactionLimit:     math.MaxInt32,
+			})
+			json.NewEncoder(w).Encode(assignment{Input: input, StartAt: time.Now()})
+		case "/agents/1/stats":
+			json.NewEncoder(w).Encode(snapshotResponse{})
+		case "/agents/1/report":
+			json.NewDecoder(r.Body).Decode(&report)
+		}
+	}))
+	defer coordinator.Close()
+
+	input := models.Input{ApmServerUrl: apmServer.URL, ApmServerSecret: "secret"}
+	require.NoError(t, Join(context.Background(), coordinator.URL, input))
+	assert.Zero(t, atomic.LoadInt64(&elsewhere))
+	require.Len(t, report.Results, 1)
+	assert.NotZero(t, apmServer.Stats().Accepted)
+}
@@ -0,0 +1,313 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/hey-apm/es"
+	"github.com/elastic/hey-apm/models"
+	"github.com/elastic/hey-apm/server"
+	"github.com/elastic/hey-apm/tlsconfig"
+	"github.com/elastic/hey-apm/worker"
+)
+
+// reportGrace is how long the coordinator waits for final results after agents are expected
+// to be done, which includes waiting for apm-server to process their events.
+const reportGrace = 6 * time.Minute
+
+type coordinator struct {
+	input  models.Input
+	agents []*agent
+
+	mu          sync.Mutex
+	registeredC chan struct{} // closed once every agent registered
+	assignedC   chan struct{} // closed once every agent can start
+	reportedC   chan struct{} // closed once every agent reported
+	startAt     time.Time
+	stopAgents  bool
+}
+
+type agent struct {
+	host     string
+	input    models.Input
+	snapshot []worker.Result
+	final    *finalReport
+}
+
+// Coordinate serves agents on the given listener until the given number of them registered,
+// has them generate the workload defined by the input together, and returns a report merging
+// their results. The report is indexed unless input.SkipIndexReport is set.
+//
+// If the context is cancelled, agents are asked to stop gracefully and report their results.
+func Coordinate(ctx context.Context, ln net.Listener, agents int, input models.Input) (models.Report, error) {
+	if agents < 1 {
+		return models.Report{}, errors.New("at least 1 agent required")
+	}
+	if input.Instances < 1 {
+		input.Instances = 1
+	}
+	c := &coordinator{
+		input:       input,
+		registeredC: make(chan struct{}),
+		assignedC:   make(chan struct{}),
+		reportedC:   make(chan struct{}),
+	}
+	for i := 0; i < agents; i++ {
+		c.agents = append(c.agents, &agent{input: share(input, i, agents)})
+	}
+
+	srv := &http.Server{Handler: c}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	logger := log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lshortfile)
+	logger.Printf("waiting for %d agents to join on %s", agents, ln.Addr())
+	select {
+	case <-ctx.Done():
+		return models.Report{}, ctx.Err()
+	case <-c.registeredC:
+	}
+
+	tlsConfig, err := tlsconfig.New(input)
+	if err != nil {
+		return models.Report{}, err
+	}
+	testNode, err := es.NewConnection(es.APMConfig(input, tlsConfig))
+	if err != nil {
+		return models.Report{}, errors.Wrap(err, "Elasticsearch used by APM Server not known or reachable")
+	}
+	apmClients := server.NewClients(input.ApmServerUrls(), input.ApmServerSecret, input.APIKey, tlsConfig)
+	initialStatus := server.GetStatus(logger, apmClients, testNode)
+
+	c.mu.Lock()
+	c.startAt = time.Now().Add(syncDelay)
+	close(c.assignedC)
+	c.mu.Unlock()
+	logger.Printf("all agents joined, starting at %s", c.startAt.Format(time.RFC3339Nano))
+
+	if err := c.waitReports(ctx, logger); err != nil {
+		return models.Report{}, err
+	}
+
+	var results []worker.Result
+	var failures []string
+	for i, a := range c.agents {
+		results = append(results, a.final.Results...)
+		if a.final.Error != "" {
+			failures = append(failures, fmt.Sprintf("agent %d (%s): %s", i, a.host, a.final.Error))
+		}
+	}
+	if len(failures) > 0 {
+		return models.Report{}, errors.New(strings.Join(failures, "; "))
+	}
+	result := worker.MergeResults(results...)
+	fmt.Println(result)
+
+	finalStatus := worker.QuiescedStatus(logger, input, testNode)
+	report := worker.NewReport(input, input.TestName, result, initialStatus, finalStatus)
+	if input.SkipIndexReport {
+		return report, nil
+	}
+	var telemetry []models.Sample
+	for i, r := range results {
+		for _, sample := range r.Telemetry {
+			sample.Instance = i
+			telemetry = append(telemetry, sample)
+		}
+	}
+	return report, worker.StoreReport(logger, input, report, telemetry)
+}
+
+// waitReports waits for every agent to send its final results.
+func (c *coordinator) waitReports(ctx context.Context, logger *log.Logger) error {
+	var deadlineC <-chan time.Time
+	if c.input.RunTimeout > 0 {
+		expected := time.Until(c.startAt) + c.input.RunTimeout + c.input.FlushTimeout +
+			time.Duration(c.input.DelayMillis)*time.Millisecond
+		deadline := time.NewTimer(expected + reportGrace)
+		defer deadline.Stop()
+		deadlineC = deadline.C
+	}
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.reportedC:
+			return nil
+		case <-deadlineC:
+			return c.missingReports()
+		case <-ctx.Done():
+			logger.Printf("stopping agents...")
+			c.mu.Lock()
+			c.stopAgents = true
+			c.mu.Unlock()
+			grace := time.NewTimer(c.input.FlushTimeout + reportGrace)
+			defer grace.Stop()
+			select {
+			case <-c.reportedC:
+				return nil
+			case <-grace.C:
+				return c.missingReports()
+			}
+		case <-ticker.C:
+			c.mu.Lock()
+			var live []worker.Result
+			for _, a := range c.agents {
+				live = append(live, a.snapshot...)
+			}
+			c.mu.Unlock()
+			result := worker.MergeResults(live...)
+			logger.Printf("%d events sent, %d accepted so far", result.EventsSent(), result.EventsAccepted)
+		}
+	}
+}
+
+func (c *coordinator) missingReports() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var missing []string
+	for i, a := range c.agents {
+		if a.final == nil {
+			missing = append(missing, fmt.Sprintf("%d (%s)", i, a.host))
+		}
+	}
+	return fmt.Errorf("timed out waiting for results of agents %s", strings.Join(missing, ", "))
+}
+
+// registeredCount must be called with the lock held.
+func (c *coordinator) registeredCount() int {
+	var n int
+	for _, a := range c.agents {
+		if a.host != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// ServeHTTP handles agent requests.
+func (c *coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/agents" && r.Method == http.MethodPost {
+		c.register(w, r)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[0] != "agents" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil || id < 0 || id >= len(c.agents) {
+		writeError(w, http.StatusNotFound, "unknown agent")
+		return
+	}
+	switch {
+	case parts[2] == "assignment" && r.Method == http.MethodGet:
+		c.assign(w, r, id)
+	case parts[2] == "stats" && r.Method == http.MethodPost:
+		c.receiveStats(w, r, id)
+	case parts[2] == "report" && r.Method == http.MethodPost:
+		c.receiveReport(w, r, id)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (c *coordinator) register(w http.ResponseWriter, r *http.Request) {
+	var reg registration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil || reg.Host == "" {
+		writeError(w, http.StatusBadRequest, "invalid registration")
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.registeredCount()
+	if id == len(c.agents) {
+		writeError(w, http.StatusConflict, "all agents already registered")
+		return
+	}
+	c.agents[id].host = reg.Host
+	log.Printf("agent %d registered from %s", id, reg.Host)
+	if id == len(c.agents)-1 {
+		close(c.registeredC)
+	}
+	writeJSON(w, http.StatusOK, registered{ID: id})
+}
+
+func (c *coordinator) assign(w http.ResponseWriter, r *http.Request, id int) {
+	select {
+	case <-r.Context().Done():
+		return
+	case <-c.assignedC:
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	encoded, err := json.Marshal(c.agents[id].input)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, assignment{
+		Input:    encoded,
+		TestName: c.input.TestName,
+		Labels:   c.input.Labels,
+		StartAt:  c.startAt,
+	})
+}
+
+func (c *coordinator) receiveStats(w http.ResponseWriter, r *http.Request, id int) {
+	var s snapshot
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid stats")
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.agents[id].snapshot = s.Results
+	writeJSON(w, http.StatusOK, snapshotResponse{Stop: c.stopAgents})
+}
+
+func (c *coordinator) receiveReport(w http.ResponseWriter, r *http.Request, id int) {
+	var report finalReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid report")
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.agents[id].final != nil {
+		writeError(w, http.StatusConflict, "agent already reported")
+		return
+	}
+	c.agents[id].final = &report
+	c.agents[id].snapshot = report.Results
+	w.WriteHeader(http.StatusNoContent)
+
+	for _, a := range c.agents {
+		if a.final == nil {
+			return
+		}
+	}
+	close(c.reportedC)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
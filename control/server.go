@@ -0,0 +1,251 @@
+// Package control serves an HTTP API to start, adjust and stop load generation remotely.
+//
+// The API has the following endpoints:
+//
+//	POST /run          starts a run, with a JSON body holding models.Input workload fields to override
+//	GET  /run          returns the status of the current or last run
+//	PUT  /run/rates    changes the event generation frequencies of the current run (see worker.Rates),
+//	                   starting generators disabled with a zero frequency, but not those that reached their limit
+//	POST /run/stop     gracefully stops the current run
+//	GET  /run/stats    returns the live stats of every instance of the current or last run
+//	GET  /run/report   returns the reports of the last run, once finished
+//
+// Only one run can be active at a time.
+//
+// The API is not authenticated, so the URLs that credentials given on the command line are sent to
+// can't be overridden: requests changing apm_url or elastic_url are refused.
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/elastic/hey-apm/models"
+	"github.com/elastic/hey-apm/worker"
+)
+
+// Server handles control API requests.
+type Server struct {
+	// base holds defaults for every run, including settings not encoded in JSON such as credentials
+	base models.Input
+
+	mu  sync.Mutex
+	run *run
+}
+
+type run struct {
+	input   models.Input
+	control *worker.Control
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	// set once done is closed
+	reports []models.Report
+	err     error
+}
+
+// Status describes the current or last run.
+type Status struct {
+	Running bool          `json:"running"`
+	Input   *models.Input `json:"input,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// NewServer returns a control server that starts runs with the given input,
+// overridden by the JSON body of each start request.
+func NewServer(base models.Input) *Server {
+	return &Server{base: base}
+}
+
+// ListenAndServe serves the control API on the given address until the context is cancelled,
+// and then cancels any run in progress.
+func ListenAndServe(ctx context.Context, addr string, base models.Input) error {
+	s := NewServer(base)
+	srv := &http.Server{Addr: addr, Handler: s}
+	go func() {
+		<-ctx.Done()
+		s.cancel()
+		srv.Shutdown(context.Background())
+	}()
+	log.Printf("serving control API on %s", addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// ServeHTTP routes control API requests.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/run" && r.Method == http.MethodPost:
+		s.start(w, r)
+	case r.URL.Path == "/run" && r.Method == http.MethodGet:
+		s.status(w)
+	case r.URL.Path == "/run/rates" && r.Method == http.MethodPut:
+		s.setRates(w, r)
+	case r.URL.Path == "/run/stop" && r.Method == http.MethodPost:
+		s.stop(w)
+	case r.URL.Path == "/run/stats" && r.Method == http.MethodGet:
+		s.stats(w)
+	case r.URL.Path == "/run/report" && r.Method == http.MethodGet:
+		s.report(w)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Server) start(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.run != nil && s.run.running() {
+		writeError(w, http.StatusConflict, "a run is already in progress")
+		return
+	}
+
+	input := s.base
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid input: "+err.Error())
+		return
+	}
+	if input.ApmServerUrl != s.base.ApmServerUrl || input.ApmElasticsearchUrl != s.base.ApmElasticsearchUrl {
+		writeError(w, http.StatusBadRequest, "invalid input: apm_url and elastic_url can't be changed, "+
+			"they receive the credentials of hey-apm")
+		return
+	}
+	input.IsBenchmark = false
+	if input.Instances < 1 {
+		input.Instances = 1
+	}
+	if input.SpanMaxLimit < input.SpanMinLimit {
+		input.SpanMaxLimit = input.SpanMinLimit
+	}
+	if input.ErrorFrameMaxLimit < input.ErrorFrameMinLimit {
+		input.ErrorFrameMaxLimit = input.ErrorFrameMinLimit
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	current := &run{
+		input:   input,
+		control: worker.NewControl(),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(current.done)
+		defer cancel()
+		current.reports, _, current.err = worker.RunInstances(ctx, input, current.control)
+		if current.err != nil {
+			log.Printf("run failed: %s", current.err)
+		}
+	}()
+	s.run = current
+	writeJSON(w, http.StatusAccepted, current.status())
+}
+
+func (s *Server) status(w http.ResponseWriter) {
+	current := s.current()
+	if current == nil {
+		writeJSON(w, http.StatusOK, Status{})
+		return
+	}
+	writeJSON(w, http.StatusOK, current.status())
+}
+
+func (s *Server) setRates(w http.ResponseWriter, r *http.Request) {
+	current := s.current()
+	if current == nil || !current.running() {
+		writeError(w, http.StatusConflict, "no run in progress")
+		return
+	}
+	var rates worker.Rates
+	if err := json.NewDecoder(r.Body).Decode(&rates); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid rates: "+err.Error())
+		return
+	}
+	if rates.TransactionFrequency < 0 || rates.ErrorFrequency < 0 {
+		writeError(w, http.StatusBadRequest, "invalid rates: frequencies can't be negative")
+		return
+	}
+	if err := current.control.SetRates(rates); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, rates)
+}
+
+func (s *Server) stop(w http.ResponseWriter) {
+	current := s.current()
+	if current == nil || !current.running() {
+		writeError(w, http.StatusConflict, "no run in progress")
+		return
+	}
+	current.control.Stop()
+	writeJSON(w, http.StatusAccepted, current.status())
+}
+
+func (s *Server) stats(w http.ResponseWriter) {
+	current := s.current()
+	if current == nil {
+		writeError(w, http.StatusNotFound, "no run started")
+		return
+	}
+	writeJSON(w, http.StatusOK, current.control.Stats())
+}
+
+func (s *Server) report(w http.ResponseWriter) {
+	current := s.current()
+	switch {
+	case current == nil:
+		writeError(w, http.StatusNotFound, "no run started")
+	case current.running():
+		writeError(w, http.StatusConflict, "run still in progress")
+	case current.err != nil:
+		writeError(w, http.StatusInternalServerError, current.err.Error())
+	default:
+		writeJSON(w, http.StatusOK, current.reports)
+	}
+}
+
+// cancel aborts the current run, if any.
+func (s *Server) cancel() {
+	if current := s.current(); current != nil {
+		current.cancel()
+		<-current.done
+	}
+}
+
+func (s *Server) current() *run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.run
+}
+
+func (r *run) running() bool {
+	select {
+	case <-r.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (r *run) status() Status {
+	status := Status{Running: r.running(), Input: &r.input}
+	if !status.Running && r.err != nil {
+		status.Error = r.err.Error()
+	}
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
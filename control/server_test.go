@@ -0,0 +1,146 @@
+package control
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/hey-apm/fake"
+	"github.com/elastic/hey-apm/models"
+	"github.com/elastic/hey-apm/worker"
+)
+
+func testServer() (*httptest.Server, func()) {
+	elasticsearch := fake.NewElasticsearch()
+	apmServer := fake.NewAPMServer(fake.APMServerConfig{Elasticsearch: elasticsearch})
+	s := NewServer(models.Input{
+		ApmServerUrl:         apmServer.URL,
+		ApmElasticsearchUrl:  elasticsearch.URL,
+		ServiceName:          "hey-control-test",
+		SkipIndexReport:      true,
+		RunTimeout:           time.Minute,
+		FlushTimeout:         time.Second,
+		TransactionFrequency: 5 * time.Millisecond,
+		TransactionLimit:     math.MaxInt32,
+	})
+	srv := httptest.NewServer(s)
+	return srv, func() {
+		srv.Close()
+		s.cancel()
+		apmServer.Close()
+		elasticsearch.Close()
+	}
+}
+
+// do sends a request to the control API, and decodes the JSON response into v unless nil.
+func do(t *testing.T, srv *httptest.Server, method, path, body string, v interface{}) int {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	if v != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+// eventually polls cond until it is true, and fails the test if it isn't within 10 seconds.
+func eventually(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 10s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer(t *testing.T) {
+	srv, closeAll := testServer()
+	defer closeAll()
+
+	var status Status
+	assert.Equal(t, http.StatusAccepted, do(t, srv, http.MethodPost, "/run", `{"spans_generated_min_limit": 2, "error_generation_limit": 5}`, &status))
+	assert.True(t, status.Running)
+	assert.Equal(t, 2, status.Input.SpanMinLimit)
+	assert.Equal(t, 2, status.Input.SpanMaxLimit)
+	assert.Equal(t, 1, status.Input.Instances)
+	assert.Equal(t, http.StatusConflict, do(t, srv, http.MethodPost, "/run", `{}`, nil))
+	assert.Equal(t, http.StatusConflict, do(t, srv, http.MethodGet, "/run/report", "", nil))
+
+	var rates worker.Rates
+	assert.Equal(t, http.StatusOK, do(t, srv, http.MethodPut, "/run/rates", `{"transaction_generation_frequency": 1000000}`, &rates))
+	assert.Equal(t, time.Millisecond, rates.TransactionFrequency)
+	assert.Equal(t, http.StatusBadRequest, do(t, srv, http.MethodPut, "/run/rates", `{"transaction_generation_frequency": -1}`, nil))
+	assert.Equal(t, http.StatusBadRequest, do(t, srv, http.MethodPut, "/run/rates", `not json`, nil))
+
+	// errors are disabled with a zero frequency until a rate is set, and then generated up to their limit
+	assert.Equal(t, http.StatusOK, do(t, srv, http.MethodPut, "/run/rates", `{"error_generation_frequency": 1000000}`, nil))
+	eventually(t, func() bool {
+		return do(t, srv, http.MethodPut, "/run/rates", `{"error_generation_frequency": 1000000}`, nil) == http.StatusConflict
+	})
+
+	eventually(t, func() bool {
+		var stats []worker.Result
+		do(t, srv, http.MethodGet, "/run/stats", "", &stats)
+		return len(stats) == 1 && stats[0].Generated > 0
+	})
+
+	assert.Equal(t, http.StatusAccepted, do(t, srv, http.MethodPost, "/run/stop", "", nil))
+	eventually(t, func() bool {
+		var status Status
+		do(t, srv, http.MethodGet, "/run", "", &status)
+		return !status.Running
+	})
+
+	var reports []models.Report
+	assert.Equal(t, http.StatusOK, do(t, srv, http.MethodGet, "/run/report", "", &reports))
+	require.Len(t, reports, 1)
+	assert.NotZero(t, reports[0].TransactionsSent)
+	assert.Equal(t, uint64(5), reports[0].ErrorsSent)
+	assert.Equal(t, reports[0].EventsSent, reports[0].EventsAccepted)
+
+	// stats of the last run are kept until the next one
+	var stats []worker.Result
+	assert.Equal(t, http.StatusOK, do(t, srv, http.MethodGet, "/run/stats", "", &stats))
+	assert.Len(t, stats, 1)
+	assert.Equal(t, http.StatusConflict, do(t, srv, http.MethodPut, "/run/rates", `{"transaction_generation_frequency": 1000000}`, nil))
+	assert.Equal(t, http.StatusConflict, do(t, srv, http.MethodPost, "/run/stop", "", nil))
+}
+
+func TestServerNoRun(t *testing.T) {
+	srv, closeAll := testServer()
+	defer closeAll()
+
+	var status Status
+	assert.Equal(t, http.StatusOK, do(t, srv, http.MethodGet, "/run", "", &status))
+	assert.False(t, status.Running)
+	assert.Nil(t, status.Input)
+	assert.Equal(t, http.StatusNotFound, do(t, srv, http.MethodGet, "/run/stats", "", nil))
+	assert.Equal(t, http.StatusNotFound, do(t, srv, http.MethodGet, "/run/report", "", nil))
+	assert.Equal(t, http.StatusConflict, do(t, srv, http.MethodPost, "/run/stop", "", nil))
+	assert.Equal(t, http.StatusConflict, do(t, srv, http.MethodPut, "/run/rates", `{}`, nil))
+	assert.Equal(t, http.StatusNotFound, do(t, srv, http.MethodGet, "/nope", "", nil))
+
+	var e map[string]string
+	assert.Equal(t, http.StatusBadRequest, do(t, srv, http.MethodPost, "/run", `{"instances": "many"}`, &e))
+	assert.Contains(t, e["error"], "invalid input")
+	assert.Equal(t, http.StatusOK, do(t, srv, http.MethodGet, "/run", "", &status))
+	assert.False(t, status.Running)
+
+	// credentials must not be sent elsewhere
+	for _, body := range []string{`{"apm_url": "http://attacker:8200"}`, `{"elastic_url": "http://attacker:9200"}`} {
+		assert.Equal(t, http.StatusBadRequest, do(t, srv, http.MethodPost, "/run", body, &e))
+		assert.Contains(t, e["error"], "can't be changed")
+	}
+	assert.Equal(t, http.StatusOK, do(t, srv, http.MethodGet, "/run", "", &status))
+	assert.False(t, status.Running)
+}
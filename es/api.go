@@ -1,8 +1,10 @@
 package es
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"strings"
 
 	"github.com/elastic/go-elasticsearch/v7"
@@ -24,9 +26,50 @@ type Connection struct {
 	password string
 }
 
-// NewConnection returns a client connected to an ElasticSearch node with given `params`
-// "local" is short for http://localhost:9200
-func NewConnection(url, auth string) (Connection, error) {
+// Config holds the address and credentials of an Elasticsearch cluster.
+// CloudID takes precedence over URL, and APIKey or BearerToken over Auth.
+type Config struct {
+	// URL of an Elasticsearch node, "local" is short for http://localhost:9200
+	URL string
+	// <username:password> for basic authentication
+	Auth string
+	// Base64 encoded <id:api_key> of an Elasticsearch API key
+	APIKey string
+	// Bearer token, such as a service account token
+	BearerToken string
+	// Elastic Cloud deployment ID
+	CloudID string
+	// TLS settings, nil to use the defaults
+	TLS *tls.Config
+}
+
+// ReportingConfig returns the configuration of the Elasticsearch cluster where reports are indexed.
+func ReportingConfig(input models.Input, tlsConfig *tls.Config) Config {
+	return Config{
+		URL:         input.ElasticsearchUrl,
+		Auth:        input.ElasticsearchAuth,
+		APIKey:      input.ElasticsearchAPIKey,
+		BearerToken: input.ElasticsearchToken,
+		CloudID:     input.ElasticsearchCloudID,
+		TLS:         tlsConfig,
+	}
+}
+
+// APMConfig returns the configuration of the Elasticsearch cluster used by apm-server.
+func APMConfig(input models.Input, tlsConfig *tls.Config) Config {
+	return Config{
+		URL:         input.ApmElasticsearchUrl,
+		Auth:        input.ApmElasticsearchAuth,
+		APIKey:      input.ApmElasticsearchAPIKey,
+		BearerToken: input.ApmElasticsearchToken,
+		CloudID:     input.ApmElasticsearchCloudID,
+		TLS:         tlsConfig,
+	}
+}
+
+// NewConnection returns a client connected to the ElasticSearch cluster described by `config`
+func NewConnection(config Config) (Connection, error) {
+	url := config.URL
 	if url == "local" {
 		url = local
 	}
@@ -36,15 +79,28 @@ func NewConnection(url, auth string) (Connection, error) {
 	// TODO(axw) consider removing the separate "auth" option to
 	// reduce options, and instead require userinfo to be included
 	// in the URL.
-	username, password := auth, ""
-	if sep := strings.IndexRune(auth, ':'); sep >= 0 {
-		username, password = auth[:sep], auth[sep+1:]
+	username, password := config.Auth, ""
+	if sep := strings.IndexRune(config.Auth, ':'); sep >= 0 {
+		username, password = config.Auth[:sep], config.Auth[sep+1:]
 	}
 
 	cfg := elasticsearch.Config{
-		Addresses: []string{url},
-		Username:  username,
-		Password:  password,
+		Username: username,
+		Password: password,
+		APIKey:   config.APIKey,
+	}
+	if config.CloudID != "" {
+		cfg.CloudID = config.CloudID
+		url = config.CloudID
+	} else {
+		cfg.Addresses = []string{url}
+	}
+	if config.BearerToken != "" && config.APIKey == "" {
+		// Basic authentication is not set when there is an Authorization header
+		cfg.Header = http.Header{"Authorization": []string{"Bearer " + config.BearerToken}}
+	}
+	if config.TLS != nil {
+		cfg.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: config.TLS}
 	}
 
 	client, err := elasticsearch.NewClient(cfg)
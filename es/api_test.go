@@ -0,0 +1,48 @@
+package es
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewConnectionAuth(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"count": 0}`))
+	}))
+	defer server.Close()
+
+	for name, test := range map[string]struct {
+		config   Config
+		expected string
+	}{
+		"none":         {Config{}, ""},
+		"basic":        {Config{Auth: "elastic:changeme"}, "Basic ZWxhc3RpYzpjaGFuZ2VtZQ=="},
+		"api key":      {Config{Auth: "elastic:changeme", APIKey: "a2V5"}, "APIKey a2V5"},
+		"bearer token": {Config{Auth: "elastic:changeme", BearerToken: "token"}, "Bearer token"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			authorization = ""
+			test.config.URL = server.URL
+			conn, err := NewConnection(test.config)
+			require.NoError(t, err)
+			assert.Equal(t, server.URL, conn.Url)
+			Count(conn, "apm", "transaction")
+			assert.Equal(t, test.expected, authorization)
+		})
+	}
+}
+
+func TestNewConnectionCloudID(t *testing.T) {
+	// "name:" followed by base64 of "localhost$es-uuid$kibana-uuid"
+	cloudID := "name:bG9jYWxob3N0JGVzLXV1aWQka2liYW5hLXV1aWQ="
+	conn, err := NewConnection(Config{URL: "http://localhost:9200", CloudID: cloudID})
+	require.NoError(t, err)
+	assert.Equal(t, cloudID, conn.Url)
+}
@@ -0,0 +1,327 @@
+package es
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+	"github.com/pkg/errors"
+
+	"github.com/elastic/hey-apm/models"
+)
+
+const (
+	// reportIndexPattern matches the indices that hold reports, behind the reportingIndex alias.
+	reportIndexPattern = reportingIndex + "-*"
+	// firstReportIndex is the index created behind the reportingIndex alias when there is none.
+	firstReportIndex = reportingIndex + "-000001"
+)
+
+// EnsureReportIndex installs the index template for reports, and makes sure reports
+// are written through an alias to an index with explicit mappings.
+//
+// Reports indexed by older versions of hey-apm into a concrete index with dynamic mappings
+// are reindexed into a new index, which then takes over the name of the old one as an alias.
+// Mappings of the current write index are updated in place, which works as long as fields are only added.
+// Otherwise the alias is rolled over to a new index, created with the new mappings.
+func EnsureReportIndex(conn Connection) error {
+	mappings := ReportMappings()
+	if err := putReportTemplate(conn, mappings); err != nil {
+		return errors.Wrap(err, "error installing report index template")
+	}
+
+	resp, err := conn.Indices.GetAlias(conn.Indices.GetAlias.WithName(reportingIndex))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == 200:
+		var aliases map[string]aliasesOf
+		if err := json.NewDecoder(resp.Body).Decode(&aliases); err != nil {
+			return err
+		}
+		index := writeIndex(aliases)
+		err := putMappings(conn, index, mappings)
+		if err != nil && strings.Contains(err.Error(), "illegal_argument_exception") {
+			// Fields that changed type can't be updated in place, new reports go to a new index instead
+			return errors.Wrapf(rollover(conn), "error rolling %s over", reportingIndex)
+		}
+		return errors.Wrapf(err, "error updating mappings of %s", index)
+	case resp.StatusCode != 404:
+		return errors.New(resp.String())
+	}
+
+	exists, err := conn.Indices.Exists([]string{reportingIndex})
+	if err != nil {
+		return err
+	}
+	exists.Body.Close()
+	switch exists.StatusCode {
+	case 200:
+		return errors.Wrapf(migrateReports(conn), "error migrating %s", reportingIndex)
+	case 404:
+		return createIndex(conn, firstReportIndex, map[string]interface{}{
+			"aliases": map[string]interface{}{
+				reportingIndex: map[string]interface{}{"is_write_index": true},
+			},
+		})
+	default:
+		return errors.New(exists.String())
+	}
+}
+
+// aliasesOf holds the aliases of an index, as returned by the get alias API.
+type aliasesOf struct {
+	Aliases map[string]struct {
+		IsWriteIndex bool `json:"is_write_index"`
+	} `json:"aliases"`
+}
+
+// writeIndex returns the index that reports are written to, given the indices behind the reportingIndex alias.
+func writeIndex(indices map[string]aliasesOf) string {
+	var last string
+	for index, a := range indices {
+		if a.Aliases[reportingIndex].IsWriteIndex {
+			return index
+		}
+		last = index
+	}
+	// an alias with a single index and no explicit write index writes to it
+	return last
+}
+
+// rollover points the reportingIndex alias to a new index, which gets the mappings of the index template.
+func rollover(conn Connection) error {
+	resp, err := conn.Indices.Rollover(reportingIndex)
+	return checkResponse(resp, err)
+}
+
+// migrateReports copies all reports from a concrete index with dynamic mappings into a new index,
+// and replaces the old index with an alias to the new one.
+func migrateReports(conn Connection) error {
+	if err := createIndex(conn, firstReportIndex, map[string]interface{}{}); err != nil {
+		return err
+	}
+	resp, err := conn.Reindex(
+		esutil.NewJSONReader(map[string]interface{}{
+			"source": map[string]interface{}{"index": reportingIndex},
+			"dest":   map[string]interface{}{"index": firstReportIndex},
+		}),
+		conn.Reindex.WithWaitForCompletion(true),
+		conn.Reindex.WithRefresh(true),
+	)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		return errors.New(resp.String())
+	}
+	var result struct {
+		Failures []json.RawMessage `json:"failures"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if len(result.Failures) > 0 {
+		return fmt.Errorf("%d reports failed to reindex into %s, first failure: %s",
+			len(result.Failures), firstReportIndex, result.Failures[0])
+	}
+
+	resp, err = conn.Indices.UpdateAliases(esutil.NewJSONReader(map[string]interface{}{
+		"actions": []map[string]interface{}{
+			{"add": map[string]interface{}{
+				"index": firstReportIndex, "alias": reportingIndex, "is_write_index": true,
+			}},
+			{"remove_index": map[string]interface{}{"index": reportingIndex}},
+		},
+	}))
+	return checkResponse(resp, err)
+}
+
+func putReportTemplate(conn Connection, mappings map[string]interface{}) error {
+	resp, err := conn.Indices.PutIndexTemplate(reportingIndex, esutil.NewJSONReader(map[string]interface{}{
+		"index_patterns": []string{reportIndexPattern},
+		"version":        templateVersion(mappings),
+		"template": map[string]interface{}{
+			"mappings": mappings,
+		},
+		"_meta": map[string]interface{}{
+			"description": "Performance reports generated by hey-apm",
+		},
+	}))
+	return checkResponse(resp, err)
+}
+
+// templateVersion identifies an index template by its mappings, so that it changes whenever they do.
+func templateVersion(mappings map[string]interface{}) int {
+	// map keys are encoded in order, so equal mappings are encoded the same
+	encoded, _ := json.Marshal(mappings)
+	h := fnv.New32a()
+	h.Write(encoded)
+	// Elasticsearch template versions are positive integers
+	return int(h.Sum32() & math.MaxInt32)
+}
+
+func putMappings(conn Connection, index string, mappings map[string]interface{}) error {
+	resp, err := conn.Indices.PutMapping(esutil.NewJSONReader(mappings), conn.Indices.PutMapping.WithIndex(index))
+	return checkResponse(resp, err)
+}
+
+// createIndex creates an index, unless it already exists.
+func createIndex(conn Connection, index string, body map[string]interface{}) error {
+	resp, err := conn.Indices.Create(index, conn.Indices.Create.WithBody(esutil.NewJSONReader(body)))
+	err = checkResponse(resp, err)
+	if err != nil && strings.Contains(err.Error(), "resource_already_exists_exception") {
+		return nil
+	}
+	return err
+}
+
+// checkResponse returns an error if the request failed or Elasticsearch returned an error,
+// and closes the response body.
+func checkResponse(resp *esapi.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		return errors.New(resp.String())
+	}
+	return nil
+}
+
+// ReportMappings returns explicit Elasticsearch mappings for every JSON field of a models.Report.
+// Fields not known to hey-apm are kept in _source but not indexed.
+func ReportMappings() map[string]interface{} {
+	t := reflect.TypeOf(models.Report{})
+	return map[string]interface{}{
+		"dynamic":           false,
+		"dynamic_templates": dynamicTemplates(t, ""),
+		"properties":        properties(t),
+	}
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// properties returns the mapping properties for the JSON encoding of a struct type.
+func properties(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	for name, ft := range jsonFields(t) {
+		props[name] = fieldMapping(ft)
+	}
+	return props
+}
+
+// jsonFields returns the types of the fields in the JSON encoding of a struct type, by name.
+// Fields of embedded structs are promoted.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for k, v := range jsonFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// dynamicTemplates returns the dynamic templates that map the values of maps with numbers as values,
+// given that their keys aren't known in advance. path is the path of the struct type in the mappings.
+func dynamicTemplates(t reflect.Type, path string) []map[string]interface{} {
+	fields := jsonFields(t)
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	// keep templates in the same order across calls, so that installed templates compare equal
+	sort.Strings(names)
+	var templates []map[string]interface{}
+	for _, name := range names {
+		ft := fields[name]
+		for ft.Kind() == reflect.Ptr || ft.Kind() == reflect.Slice || ft.Kind() == reflect.Array {
+			ft = ft.Elem()
+		}
+		switch {
+		case ft.Kind() == reflect.Map && isNumeric(ft.Elem()):
+			templates = append(templates, map[string]interface{}{
+				path + name: map[string]interface{}{
+					"path_match": path + name + ".*",
+					"mapping":    fieldMapping(ft.Elem()),
+				},
+			})
+		case ft.Kind() == reflect.Struct && ft != timeType:
+			templates = append(templates, dynamicTemplates(ft, path+name+".")...)
+		}
+	}
+	return templates
+}
+
+// isNumeric returns true for types mapped as numbers.
+func isNumeric(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func fieldMapping(t reflect.Type) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "date"}
+	case durationType:
+		// durations are encoded as nanoseconds
+		return map[string]interface{}{"type": "long"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		// arrays don't need a specific mapping in Elasticsearch
+		return fieldMapping(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "keyword"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "long"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "double"}
+	case reflect.Map:
+		if isNumeric(t.Elem()) {
+			// keys are arbitrary (eg. status codes or apm-server URLs) and values are counts,
+			// which dynamicTemplates maps as numbers so that they can be aggregated
+			return map[string]interface{}{"type": "object", "dynamic": true}
+		}
+		// keys are arbitrary (eg. apm-server settings with dots in them)
+		return map[string]interface{}{"type": "flattened"}
+	case reflect.Struct:
+		return map[string]interface{}{"properties": properties(t)}
+	}
+	panic(fmt.Sprintf("no Elasticsearch mapping defined for %s", t))
+}
@@ -0,0 +1,149 @@
+package es
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/hey-apm/fake"
+	"github.com/elastic/hey-apm/models"
+)
+
+// Every field of an encoded report must have an explicit mapping.
+func TestReportMappings(t *testing.T) {
+	var n uint64
+	report := models.Report{
+		Metadata:    models.Metadata{TestName: "test", Labels: []string{"a=b"}, GitBranch: "master", GitCommit: "abc", PullRequest: "1"},
+		ApmSettings: map[string]string{"apm-server.expvar.enabled": "true"},
+		TotalAlloc:  &n,
+		HeapAlloc:   &n,
+		Mallocs:     &n,
+		NumGC:       &n,
+	}
+	report.ServiceName = "hey-service"
+	report.ApmElasticsearchUrl = "http://localhost:9200"
+
+	encoded, err := json.Marshal(report)
+	require.NoError(t, err)
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(encoded, &fields))
+
+	props := ReportMappings()["properties"].(map[string]interface{})
+	for k := range fields {
+		assert.Contains(t, props, k)
+	}
+	assert.Equal(t, map[string]interface{}{"type": "date"}, props["@timestamp"])
+	assert.Equal(t, map[string]interface{}{"type": "long"}, props["run_timeout"])
+	assert.Equal(t, map[string]interface{}{"type": "keyword"}, props["labels"])
+	assert.Equal(t, map[string]interface{}{"type": "flattened"}, props["apm_settings"])
+	assert.Equal(t, map[string]interface{}{"type": "object", "dynamic": true}, props["rejections"])
+	assert.NotContains(t, props, "ApmServerSecret")
+
+	// counters keyed by arbitrary names are numbers, so that they can be aggregated
+	templates := ReportMappings()["dynamic_templates"].([]map[string]interface{})
+	assert.Contains(t, templates, map[string]interface{}{
+		"intake_responses": map[string]interface{}{
+			"path_match": "intake_responses.*",
+			"mapping":    map[string]interface{}{"type": "long"},
+		},
+	})
+	for _, template := range templates {
+		for name := range template {
+			assert.Equal(t, map[string]interface{}{"type": "object", "dynamic": true}, props[name])
+		}
+	}
+}
+
+// The index template version only changes along with the report mappings.
+func TestTemplateVersion(t *testing.T) {
+	version := templateVersion(ReportMappings())
+	assert.Equal(t, version, templateVersion(ReportMappings()))
+	assert.True(t, version > 0)
+
+	mappings := ReportMappings()
+	mappings["properties"].(map[string]interface{})["new_field"] = map[string]interface{}{"type": "long"}
+	assert.NotEqual(t, version, templateVersion(mappings))
+}
+
+// Reports are written to a new index when the mappings of the current one can't be updated.
+func TestEnsureReportIndexRollover(t *testing.T) {
+	elasticsearch := fake.NewElasticsearch()
+	defer elasticsearch.Close()
+	conn, err := NewConnection(Config{URL: elasticsearch.URL})
+	require.NoError(t, err)
+
+	// as installed by older versions
+	require.NoError(t, createIndex(conn, firstReportIndex, map[string]interface{}{
+		"aliases": map[string]interface{}{
+			reportingIndex: map[string]interface{}{"is_write_index": true},
+		},
+	}))
+	require.NoError(t, putMappings(conn, firstReportIndex, map[string]interface{}{
+		"properties": map[string]interface{}{"rejections": map[string]interface{}{"type": "flattened"}},
+	}))
+	_, err = elasticsearch.Index(reportingIndex, map[string]interface{}{"test_name": "first"})
+	require.NoError(t, err)
+
+	require.NoError(t, EnsureReportIndex(conn))
+	_, err = elasticsearch.Index(reportingIndex, map[string]interface{}{"test_name": "second"})
+	require.NoError(t, err)
+	assert.Len(t, elasticsearch.Documents(firstReportIndex), 1)
+	assert.Len(t, elasticsearch.Documents(reportingIndex+"-000002"), 1)
+	assert.Len(t, elasticsearch.Documents(reportingIndex), 2)
+
+	// the new index is updated in place
+	require.NoError(t, EnsureReportIndex(conn))
+	_, err = elasticsearch.Index(reportingIndex, map[string]interface{}{"test_name": "third"})
+	require.NoError(t, err)
+	assert.Len(t, elasticsearch.Documents(reportingIndex+"-000002"), 2)
+}
+
+// Only mapping conflicts roll the alias over, other errors are returned.
+func TestEnsureReportIndexForbidden(t *testing.T) {
+	elasticsearch := fake.NewElasticsearch()
+	defer elasticsearch.Close()
+	conn, err := NewConnection(Config{URL: elasticsearch.URL})
+	require.NoError(t, err)
+	require.NoError(t, EnsureReportIndex(conn))
+
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/_mapping") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":{"type":"security_exception","reason":"action [indices:admin/mapping/put] is unauthorized"},"status":403}`))
+			return
+		}
+		elasticsearch.ServeHTTP(w, r)
+	}))
+	defer forbidden.Close()
+	conn, err = NewConnection(Config{URL: forbidden.URL})
+	require.NoError(t, err)
+	err = EnsureReportIndex(conn)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "security_exception")
+	assert.Empty(t, elasticsearch.Documents(reportingIndex+"-000002"))
+	_, err = elasticsearch.Index(reportingIndex, map[string]interface{}{"test_name": "first"})
+	require.NoError(t, err)
+	assert.Len(t, elasticsearch.Documents(firstReportIndex), 1)
+}
+
+// Every field of an encoded telemetry sample must have an explicit mapping.
+func TestTelemetryMappings(t *testing.T) {
+	encoded, err := json.Marshal(models.Sample{})
+	require.NoError(t, err)
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(encoded, &fields))
+
+	props := TelemetryMappings()["properties"].(map[string]interface{})
+	assert.Len(t, props, len(fields))
+	for k := range fields {
+		assert.Contains(t, props, k)
+	}
+	assert.Equal(t, map[string]interface{}{"type": "keyword"}, props["report_id"])
+	assert.Equal(t, map[string]interface{}{"type": "double"}, props["sent_per_second"])
+}
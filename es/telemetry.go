@@ -0,0 +1,94 @@
+package es
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+	"github.com/pkg/errors"
+
+	"github.com/elastic/hey-apm/models"
+)
+
+// telemetryIndex holds the telemetry samples of reports, keyed by report_id.
+const telemetryIndex = reportingIndex + "-telemetry"
+
+// EnsureTelemetryIndex installs the index template for telemetry samples.
+// The index is created with it when the first samples are indexed.
+func EnsureTelemetryIndex(conn Connection) error {
+	mappings := TelemetryMappings()
+	resp, err := conn.Indices.PutIndexTemplate(telemetryIndex, esutil.NewJSONReader(map[string]interface{}{
+		"index_patterns": []string{telemetryIndex + "*"},
+		"version":        templateVersion(mappings),
+		"template": map[string]interface{}{
+			"mappings": mappings,
+		},
+		"_meta": map[string]interface{}{
+			"description": "Telemetry of performance reports generated by hey-apm",
+		},
+	}))
+	return errors.Wrap(checkResponse(resp, err), "error installing telemetry index template")
+}
+
+// TelemetryMappings returns explicit Elasticsearch mappings for every JSON field of a models.Sample.
+func TelemetryMappings() map[string]interface{} {
+	return map[string]interface{}{
+		"dynamic":    false,
+		"properties": properties(reflect.TypeOf(models.Sample{})),
+	}
+}
+
+// IndexTelemetry saves in elasticsearch the telemetry samples of a report with a single bulk request.
+func IndexTelemetry(conn Connection, samples []models.Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, sample := range samples {
+		if err := enc.Encode(map[string]interface{}{
+			"index": map[string]interface{}{"_index": telemetryIndex},
+		}); err != nil {
+			return err
+		}
+		if err := enc.Encode(sample); err != nil {
+			return err
+		}
+	}
+	resp, err := conn.Bulk(&body, conn.Bulk.WithRefresh("true"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		return errors.New(resp.String())
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Error json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Errors {
+		return nil
+	}
+	var failed int
+	var first json.RawMessage
+	for _, item := range result.Items {
+		for _, action := range item {
+			if len(action.Error) > 0 {
+				if failed == 0 {
+					first = action.Error
+				}
+				failed++
+			}
+		}
+	}
+	return fmt.Errorf("%d telemetry samples failed to index into %s, first failure: %s", failed, telemetryIndex, first)
+}
@@ -0,0 +1,390 @@
+// Package fake provides in-process stand-ins for apm-server and Elasticsearch,
+// so that hey-apm can run and be tested without external services.
+package fake
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxEventSize is the default apm-server max_event_size
+	maxEventSize = 300 * 1024
+	// maxDocumentSize is the maximum length of a rejected event returned in intake responses
+	maxDocumentSize = 1024
+)
+
+// APMServerConfig defines how a fake apm-server responds to intake requests.
+type APMServerConfig struct {
+	// Latency is added to every intake request before responding
+	Latency time.Duration
+	// Fraction of intake requests answered with 503 Service Unavailable, between 0 and 1
+	UnavailableRate float64
+	// Fraction of intake requests answered with 429 Too Many Requests, between 0 and 1
+	RateLimitedRate float64
+	// Fraction of events rejected instead of accepted, between 0 and 1
+	RejectRate float64
+	// Error message returned for rejected events, defaults to a validation error
+	RejectMessage string
+	// If set, accepted events are indexed into this Elasticsearch, as apm-server would.
+	// Only the fields needed for counting events are kept, to save memory.
+	Elasticsearch *Elasticsearch
+	// If either is set, requests other than RUM intake must be authenticated with
+	// "Bearer <SecretToken>" or "ApiKey <APIKey>", or they are answered with 401 Unauthorized.
+	SecretToken string
+	APIKey      string
+}
+
+// APMServerStats holds counters of the requests received by a fake apm-server.
+type APMServerStats struct {
+	// Intake requests received, including failed ones
+	Requests uint64
+	// Intake requests answered with an error status
+	FailedRequests uint64
+	// Events accepted and rejected
+	Accepted uint64
+	Rejected uint64
+	// Sourcemaps uploaded
+	Sourcemaps uint64
+}
+
+// APMServer is a fake apm-server, serving the intake, health check and expvar endpoints over HTTP.
+type APMServer struct {
+	// URL of the server, eg. http://127.0.0.1:1234
+	URL string
+
+	server *httptest.Server
+
+	mu     sync.Mutex
+	config APMServerConfig
+	rand   *rand.Rand
+	stats  APMServerStats
+}
+
+// NewAPMServer starts and returns a fake apm-server listening on a loopback address.
+// Callers should call Close when finished, to shut it down.
+func NewAPMServer(config APMServerConfig) *APMServer {
+	s := &APMServer{config: config, rand: rand.New(rand.NewSource(1))}
+	s.server = httptest.NewServer(s)
+	s.URL = s.server.URL
+	return s
+}
+
+// SetConfig changes how the server responds to subsequent intake requests.
+func (s *APMServer) SetConfig(config APMServerConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+}
+
+// Stats returns counters of the requests received so far.
+func (s *APMServer) Stats() APMServerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Close shuts down the server.
+func (s *APMServer) Close() {
+	s.server.Close()
+}
+
+// ServeHTTP handles apm-server requests.
+func (s *APMServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/intake/v2/rum/events" && !s.authorized(r) {
+		s.mu.Lock()
+		if r.URL.Path == "/intake/v2/events" {
+			s.stats.Requests++
+			s.stats.FailedRequests++
+		}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusUnauthorized, intakeResponse{Errors: []intakeError{{Message: "unauthorized: missing or invalid credentials"}}})
+		return
+	}
+	switch r.URL.Path {
+	case "/":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"build_date": "2020-09-01T00:00:00Z",
+			"build_sha":  "0123456789abcdef0123456789abcdef01234567",
+			"version":    "8.0.0",
+		})
+	case "/debug/vars":
+		s.expvar(w)
+	case "/intake/v2/events", "/intake/v2/rum/events":
+		s.intake(w, r)
+	case "/assets/v1/sourcemaps":
+		s.sourcemap(w, r)
+	case "/config/v1/agents":
+		w.Header().Set("Etag", `"fake"`)
+		if r.Header.Get("If-None-Match") == `"fake"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{})
+	default:
+		writeJSON(w, http.StatusNotFound, intakeResponse{Errors: []intakeError{{Message: "404 page not found"}}})
+	}
+}
+
+func (s *APMServer) expvar(w http.ResponseWriter) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	s.mu.Lock()
+	stats := s.stats
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"cmdline": []string{"apm-server", "-e", "-E", "apm-server.expvar.enabled=true"},
+		"memstats": map[string]interface{}{
+			"TotalAlloc": ms.TotalAlloc,
+			"HeapAlloc":  ms.HeapAlloc,
+			"Mallocs":    ms.Mallocs,
+			"NumGC":      ms.NumGC,
+		},
+		"libbeat.output.events.active":               0,
+		"libbeat.pipeline.events.active":             0,
+		"apm-server.server.request.count":            stats.Requests,
+		"apm-server.server.response.valid.accepted":  stats.Requests - stats.FailedRequests,
+		"apm-server.processor.stream.accepted":       stats.Accepted,
+		"apm-server.processor.stream.errors.invalid": stats.Rejected,
+	})
+}
+
+// authorized returns whether a request has the credentials configured, if any.
+func (s *APMServer) authorized(r *http.Request) bool {
+	s.mu.Lock()
+	config := s.config
+	s.mu.Unlock()
+	if config.SecretToken == "" && config.APIKey == "" {
+		return true
+	}
+	authorization := r.Header.Get("Authorization")
+	return (config.SecretToken != "" && authorization == "Bearer "+config.SecretToken) ||
+		(config.APIKey != "" && authorization == "ApiKey "+config.APIKey)
+}
+
+func (s *APMServer) intake(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	config := s.config
+	s.stats.Requests++
+	roll := s.rand.Float64()
+	s.mu.Unlock()
+
+	time.Sleep(config.Latency)
+	fail := func(code int, msg string) {
+		s.mu.Lock()
+		s.stats.FailedRequests++
+		s.mu.Unlock()
+		writeJSON(w, code, intakeResponse{Errors: []intakeError{{Message: msg}}})
+	}
+	switch {
+	case r.Method != http.MethodPost:
+		fail(http.StatusMethodNotAllowed, "only POST requests are supported")
+		return
+	case roll < config.UnavailableRate:
+		fail(http.StatusServiceUnavailable, "queue is full")
+		return
+	case roll < config.UnavailableRate+config.RateLimitedRate:
+		fail(http.StatusTooManyRequests, "rate limit exceeded")
+		return
+	}
+
+	if contentType := r.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/x-ndjson") {
+		fail(http.StatusBadRequest, fmt.Sprintf("invalid content type: '%s'", contentType))
+		return
+	}
+
+	body, err := decodeBody(r)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	defer body.Close()
+
+	rejectMessage := config.RejectMessage
+	if rejectMessage == "" {
+		rejectMessage = "failed to validate event: rejected by fake apm-server"
+	}
+	var response intakeResponse
+	var metadata intakeMetadata
+	var accepted []map[string]json.RawMessage
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, 10*1024*1024)
+	for first := true; scanner.Scan(); first = false {
+		line := scanner.Text()
+		if first {
+			if err := json.Unmarshal(scanner.Bytes(), &metadata); err != nil || metadata.Metadata == nil {
+				fail(http.StatusBadRequest, fmt.Sprintf("failed to validate metadata: %v", err))
+				return
+			}
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		event, errMessage := validateEvent(scanner.Bytes())
+		if errMessage == "" {
+			s.mu.Lock()
+			if s.rand.Float64() < config.RejectRate {
+				errMessage = rejectMessage
+			}
+			s.mu.Unlock()
+		}
+		if errMessage != "" {
+			if len(line) > maxDocumentSize {
+				line = line[:maxDocumentSize]
+			}
+			response.Errors = append(response.Errors, intakeError{Message: errMessage, Document: line})
+			continue
+		}
+		response.Accepted++
+		if config.Elasticsearch != nil {
+			accepted = append(accepted, event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fail(http.StatusBadRequest, "data read error: "+err.Error())
+		return
+	}
+	for _, event := range accepted {
+		for eventType := range event {
+			config.Elasticsearch.Index(eventIndex(eventType), map[string]interface{}{
+				"processor.event": eventType,
+				"service.name":    metadata.Metadata.Service.Name,
+			})
+		}
+	}
+
+	s.mu.Lock()
+	s.stats.Accepted += response.Accepted
+	s.stats.Rejected += uint64(len(response.Errors))
+	s.mu.Unlock()
+
+	code := http.StatusAccepted
+	if len(response.Errors) > 0 {
+		code = http.StatusBadRequest
+	}
+	if _, verbose := r.URL.Query()["verbose"]; !verbose && code == http.StatusAccepted {
+		w.WriteHeader(code)
+		return
+	}
+	writeJSON(w, code, response)
+}
+
+func (s *APMServer) sourcemap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, intakeResponse{Errors: []intakeError{{Message: "only POST requests are supported"}}})
+		return
+	}
+	for _, field := range []string{"service_name", "service_version", "bundle_filepath"} {
+		if r.FormValue(field) == "" {
+			writeJSON(w, http.StatusBadRequest, intakeResponse{Errors: []intakeError{{Message: "missing " + field}}})
+			return
+		}
+	}
+	f, _, err := r.FormFile("sourcemap")
+	if err == nil {
+		var sourcemap struct {
+			Version  int    `json:"version"`
+			Mappings string `json:"mappings"`
+		}
+		err = json.NewDecoder(f).Decode(&sourcemap)
+		f.Close()
+		if err == nil && sourcemap.Version != 3 {
+			err = fmt.Errorf("unsupported sourcemap version %d", sourcemap.Version)
+		}
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, intakeResponse{Errors: []intakeError{{Message: "invalid sourcemap: " + err.Error()}}})
+		return
+	}
+	s.mu.Lock()
+	s.stats.Sourcemaps++
+	s.mu.Unlock()
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{})
+}
+
+// decodeBody returns the uncompressed body of an intake request.
+func decodeBody(r *http.Request) (io.ReadCloser, error) {
+	switch r.Header.Get("Content-Encoding") {
+	case "deflate":
+		return zlib.NewReader(r.Body)
+	case "gzip":
+		return gzip.NewReader(r.Body)
+	}
+	return r.Body, nil
+}
+
+// validateEvent decodes an event and checks it has a known type and an id, like a very lenient
+// version of the apm-server intake schema. It returns an error message if the event is invalid.
+func validateEvent(line []byte) (map[string]json.RawMessage, string) {
+	if len(line) > maxEventSize {
+		return nil, "event exceeded the permitted size."
+	}
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal(line, &event); err != nil {
+		return nil, "data decoding error: " + err.Error()
+	}
+	for eventType, raw := range event {
+		switch eventType {
+		case "transaction", "span", "error", "metricset":
+		default:
+			return nil, fmt.Sprintf("failed to validate event: did not recognize object type: %q", eventType)
+		}
+		var fields struct {
+			ID *string `json:"id"`
+		}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, fmt.Sprintf("failed to validate %s: %s", eventType, err)
+		}
+		if fields.ID == nil && eventType != "metricset" {
+			return nil, fmt.Sprintf(`failed to validate %s: missing properties: "id"`, eventType)
+		}
+	}
+	return event, ""
+}
+
+// eventIndex returns the data stream apm-server writes events of the given type to.
+func eventIndex(eventType string) string {
+	switch eventType {
+	case "error":
+		return "logs-apm.error-default"
+	case "metricset":
+		return "metrics-apm.internal-default"
+	}
+	return "traces-apm-default"
+}
+
+type intakeMetadata struct {
+	Metadata *struct {
+		Service struct {
+			Name string `json:"name"`
+		} `json:"service"`
+	} `json:"metadata"`
+}
+
+type intakeResponse struct {
+	Accepted uint64        `json:"accepted"`
+	Errors   []intakeError `json:"errors,omitempty"`
+}
+
+type intakeError struct {
+	Message  string `json:"message"`
+	Document string `json:"document,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
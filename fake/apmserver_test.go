@@ -0,0 +1,200 @@
+package fake
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const intakeBody = `{"metadata":{"service":{"name":"svc"}}}
+{"transaction":{"id":"1"}}
+{"span":{"id":"2"}}
+
+{"error":{"id":"3"}}
+{"metricset":{"samples":{}}}
+{"transaction":{"name":"no id"}}
+{"log":{"id":"4"}}
+not json
+`
+
+// serve sends a request straight to a handler, and returns the response.
+func serve(h http.Handler, method, target string, body io.Reader, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func intake(h http.Handler, path string, header map[string]string) *httptest.ResponseRecorder {
+	if header == nil {
+		header = make(map[string]string)
+	}
+	if _, ok := header["Content-Type"]; !ok {
+		header["Content-Type"] = "application/x-ndjson"
+	}
+	return serve(h, http.MethodPost, path, strings.NewReader(intakeBody), header)
+}
+
+func TestAPMServerIntake(t *testing.T) {
+	es := NewElasticsearch()
+	defer es.Close()
+	s := NewAPMServer(APMServerConfig{Elasticsearch: es})
+	defer s.Close()
+
+	w := intake(s, "/intake/v2/events", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var response intakeResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, uint64(4), response.Accepted)
+	require.Len(t, response.Errors, 3)
+	assert.Equal(t, `failed to validate transaction: missing properties: "id"`, response.Errors[0].Message)
+	assert.Equal(t, `{"transaction":{"name":"no id"}}`, response.Errors[0].Document)
+	assert.Contains(t, response.Errors[1].Message, `did not recognize object type: "log"`)
+	assert.Contains(t, response.Errors[2].Message, "data decoding error")
+
+	// accepted events are indexed, with the service they come from
+	assert.Len(t, es.Documents("traces-apm-default"), 2)
+	assert.Equal(t, []map[string]interface{}{{"processor.event": "error", "service.name": "svc"}}, es.Documents("logs-apm.error-default"))
+	assert.Len(t, es.Documents("metrics-apm.internal-default"), 1)
+
+	// compressed bodies are decoded, and events rejected on purpose
+	s.SetConfig(APMServerConfig{RejectRate: 1, RejectMessage: "queue is full"})
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(`{"metadata":{"service":{"name":"svc"}}}` + "\n" + `{"span":{"id":"1"}}` + "\n"))
+	zw.Close()
+	w = serve(s, http.MethodPost, "/intake/v2/rum/events", &compressed,
+		map[string]string{"Content-Type": "application/x-ndjson", "Content-Encoding": "gzip"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "queue is full")
+
+	// responses without errors only have a body if asked for
+	s.SetConfig(APMServerConfig{})
+	w = serve(s, http.MethodPost, "/intake/v2/events", strings.NewReader(`{"metadata":{}}`+"\n"+`{"span":{"id":"1"}}`),
+		map[string]string{"Content-Type": "application/x-ndjson"})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Empty(t, w.Body.String())
+	w = serve(s, http.MethodPost, "/intake/v2/events?verbose", strings.NewReader(`{"metadata":{}}`+"\n"+`{"span":{"id":"1"}}`),
+		map[string]string{"Content-Type": "application/x-ndjson"})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.JSONEq(t, `{"accepted":1}`, w.Body.String())
+
+	assert.Equal(t, APMServerStats{Requests: 4, FailedRequests: 0, Accepted: 6, Rejected: 4}, s.Stats())
+	var vars map[string]interface{}
+	require.NoError(t, json.NewDecoder(serve(s, http.MethodGet, "/debug/vars", nil, nil).Body).Decode(&vars))
+	assert.Equal(t, float64(6), vars["apm-server.processor.stream.accepted"])
+	assert.Equal(t, float64(4), vars["apm-server.processor.stream.errors.invalid"])
+}
+
+func TestAPMServerFailedRequests(t *testing.T) {
+	s := NewAPMServer(APMServerConfig{})
+	defer s.Close()
+
+	auth := APMServerConfig{APIKey: "a2V5", SecretToken: "secret"}
+	for name, tc := range map[string]struct {
+		config APMServerConfig
+		path   string
+		header map[string]string
+		code   int
+		// failed is true if the request fails as a whole, rather than some events in it
+		failed  bool
+		message string
+	}{
+		"no credentials": {
+			config: auth, path: "/intake/v2/events",
+			code: http.StatusUnauthorized, failed: true, message: "unauthorized",
+		},
+		"wrong credentials": {
+			config: auth, path: "/intake/v2/events", header: map[string]string{"Authorization": "ApiKey other"},
+			code: http.StatusUnauthorized, failed: true, message: "unauthorized",
+		},
+		"api key": {
+			config: auth, path: "/intake/v2/events", header: map[string]string{"Authorization": "ApiKey a2V5"},
+			code: http.StatusBadRequest,
+		},
+		"secret token": {
+			config: auth, path: "/intake/v2/events", header: map[string]string{"Authorization": "Bearer secret"},
+			code: http.StatusBadRequest,
+		},
+		// RUM agents can't keep secrets
+		"rum": {config: auth, path: "/intake/v2/rum/events", code: http.StatusBadRequest},
+		"unavailable": {
+			config: APMServerConfig{UnavailableRate: 1}, path: "/intake/v2/events",
+			code: http.StatusServiceUnavailable, failed: true, message: "queue is full",
+		},
+		"rate limited": {
+			config: APMServerConfig{RateLimitedRate: 1}, path: "/intake/v2/events",
+			code: http.StatusTooManyRequests, failed: true, message: "rate limit exceeded",
+		},
+		"content type": {
+			path: "/intake/v2/events", header: map[string]string{"Content-Type": "application/json"},
+			code: http.StatusBadRequest, failed: true, message: "invalid content type",
+		},
+		"encoding": {
+			path: "/intake/v2/events", header: map[string]string{"Content-Encoding": "gzip"},
+			code: http.StatusBadRequest, failed: true, message: "gzip: invalid header",
+		},
+	} {
+		s.SetConfig(tc.config)
+		before := s.Stats()
+		w := intake(s, tc.path, tc.header)
+		assert.Equal(t, tc.code, w.Code, name)
+		assert.Contains(t, w.Body.String(), tc.message, name)
+		after := s.Stats()
+		assert.Equal(t, before.Requests+1, after.Requests, name)
+		if tc.failed {
+			assert.Equal(t, before.FailedRequests+1, after.FailedRequests, name)
+			assert.Equal(t, before.Accepted, after.Accepted, name)
+		} else {
+			assert.Equal(t, before.FailedRequests, after.FailedRequests, name)
+			assert.Equal(t, before.Accepted+4, after.Accepted, name)
+		}
+	}
+
+	// invalid metadata fails the whole request
+	s.SetConfig(APMServerConfig{})
+	w := serve(s, http.MethodPost, "/intake/v2/events", strings.NewReader(`{"transaction":{"id":"1"}}`),
+		map[string]string{"Content-Type": "application/x-ndjson"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "failed to validate metadata")
+}
+
+func TestAPMServerSourcemap(t *testing.T) {
+	s := NewAPMServer(APMServerConfig{})
+	defer s.Close()
+
+	upload := func(fields map[string]string, sourcemap string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for k, v := range fields {
+			mw.WriteField(k, v)
+		}
+		fw, _ := mw.CreateFormFile("sourcemap", "bundle.js.map")
+		fw.Write([]byte(sourcemap))
+		mw.Close()
+		return serve(s, http.MethodPost, "/assets/v1/sourcemaps", &body, map[string]string{"Content-Type": mw.FormDataContentType()})
+	}
+	fields := map[string]string{"service_name": "svc", "service_version": "1.0", "bundle_filepath": "/bundle.js"}
+
+	assert.Equal(t, http.StatusAccepted, upload(fields, `{"version":3,"mappings":"AAAA"}`).Code)
+	w := upload(fields, `{"version":2}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "unsupported sourcemap version 2")
+	delete(fields, "bundle_filepath")
+	w = upload(fields, `{"version":3,"mappings":"AAAA"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "missing bundle_filepath")
+	assert.Equal(t, uint64(1), s.Stats().Sourcemaps)
+}
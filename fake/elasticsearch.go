@@ -0,0 +1,774 @@
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Elasticsearch is an in-memory stand-in for the Elasticsearch APIs used by hey-apm:
+// indexing (one by one or in bulk), searching, counting and deleting documents, plus managing
+// index templates and aliases for reports.
+//
+// Queries support the bool, term, match, range and match_all clauses, which is enough
+// for hey-apm but far from complete.
+type Elasticsearch struct {
+	// URL of the server, eg. http://127.0.0.1:1234
+	URL string
+
+	server *httptest.Server
+
+	mu        sync.Mutex
+	indices   map[string]*fakeIndex
+	aliases   map[string][]string // alias name to index names, the last one being the write index
+	templates map[string]json.RawMessage
+	nextID    int
+}
+
+type fakeIndex struct {
+	docs     []document
+	mappings json.RawMessage
+}
+
+type document struct {
+	id     string
+	source map[string]interface{}
+}
+
+// NewElasticsearch starts and returns a fake Elasticsearch listening on a loopback address.
+// Callers should call Close when finished, to shut it down.
+func NewElasticsearch() *Elasticsearch {
+	es := &Elasticsearch{
+		indices:   make(map[string]*fakeIndex),
+		aliases:   make(map[string][]string),
+		templates: make(map[string]json.RawMessage),
+	}
+	es.server = httptest.NewServer(es)
+	es.URL = es.server.URL
+	return es
+}
+
+// Close shuts down the server.
+func (es *Elasticsearch) Close() {
+	es.server.Close()
+}
+
+// Index adds a document to an index, creating the index if needed, and returns the document id.
+func (es *Elasticsearch) Index(index string, doc interface{}) (string, error) {
+	source, err := toMap(doc)
+	if err != nil {
+		return "", err
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.index(index, "", source), nil
+}
+
+// Documents returns the sources of all documents in the indices matching the given expression,
+// which may include aliases, wildcards and comma separated names.
+func (es *Elasticsearch) Documents(indices string) []map[string]interface{} {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	var sources []map[string]interface{}
+	for _, name := range es.resolve(indices) {
+		for _, doc := range es.indices[name].docs {
+			sources = append(sources, doc.source)
+		}
+	}
+	return sources
+}
+
+// ServeHTTP handles Elasticsearch requests.
+func (es *Elasticsearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if r.URL.Path == "/_bulk" && r.Method == http.MethodPost {
+		// The body is made of several JSON lines
+		es.bulk(w, r.Body)
+		return
+	}
+
+	var body map[string]interface{}
+	if r.Body != nil && r.Method != http.MethodHead {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			writeESError(w, http.StatusBadRequest, "parse_exception", err.Error())
+			return
+		}
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.URL.Path == "/":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"name":    "fake",
+			"version": map[string]interface{}{"number": "7.8.0"},
+			"tagline": "You Know, for Search",
+		})
+	case parts[0] == "_index_template" && len(parts) == 2 && r.Method == http.MethodPut:
+		encoded, _ := json.Marshal(body)
+		es.templates[parts[1]] = encoded
+		writeJSON(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+	case parts[0] == "_alias" && len(parts) == 2 && r.Method == http.MethodGet:
+		es.getAlias(w, parts[1])
+	case parts[0] == "_aliases" && r.Method == http.MethodPost:
+		es.updateAliases(w, body)
+	case len(parts) == 2 && parts[1] == "_rollover" && r.Method == http.MethodPost:
+		es.rollover(w, parts[0])
+	case parts[0] == "_reindex" && r.Method == http.MethodPost:
+		es.reindex(w, body)
+	case len(parts) == 1 && r.Method == http.MethodHead:
+		if _, ok := es.indices[parts[0]]; ok {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		es.createIndex(w, parts[0], body)
+	case len(parts) == 2 && parts[1] == "_mapping" && r.Method == http.MethodPut:
+		es.putMapping(w, parts[0], body)
+	case len(parts) == 2 && parts[1] == "_doc" && r.Method == http.MethodPost:
+		es.indexDoc(w, parts[0], "", body)
+	case len(parts) == 3 && parts[1] == "_doc" && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		es.indexDoc(w, parts[0], parts[2], body)
+	case len(parts) <= 2 && parts[len(parts)-1] == "_count":
+		es.count(w, indexExpr(parts), body)
+	case len(parts) <= 2 && parts[len(parts)-1] == "_search":
+		es.search(w, r, indexExpr(parts), body)
+	case len(parts) == 2 && parts[1] == "_delete_by_query" && r.Method == http.MethodPost:
+		es.deleteByQuery(w, parts[0], body)
+	default:
+		writeESError(w, http.StatusBadRequest, "illegal_argument_exception",
+			fmt.Sprintf("request [%s %s] not supported by fake Elasticsearch", r.Method, r.URL.Path))
+	}
+}
+
+// indexExpr returns the index expression of a request path, defaulting to all indices.
+func indexExpr(parts []string) string {
+	if len(parts) == 2 {
+		return parts[0]
+	}
+	return "*"
+}
+
+func (es *Elasticsearch) getAlias(w http.ResponseWriter, name string) {
+	targets, ok := es.aliases[name]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"error":  fmt.Sprintf("alias [%s] missing", name),
+			"status": http.StatusNotFound,
+		})
+		return
+	}
+	indices := make(map[string]interface{})
+	for i, target := range targets {
+		indices[target] = map[string]interface{}{
+			"aliases": map[string]interface{}{
+				name: map[string]interface{}{"is_write_index": i == len(targets)-1},
+			},
+		}
+	}
+	writeJSON(w, http.StatusOK, indices)
+}
+
+// rollover creates a new index named after the write index of an alias with its number increased,
+// and makes it the write index of the alias.
+func (es *Elasticsearch) rollover(w http.ResponseWriter, alias string) {
+	targets, ok := es.aliases[alias]
+	if !ok {
+		writeESError(w, http.StatusBadRequest, "illegal_argument_exception", "rollover target ["+alias+"] does not exist")
+		return
+	}
+	old := targets[len(targets)-1]
+	sep := strings.LastIndex(old, "-")
+	n, err := strconv.Atoi(old[sep+1:])
+	if sep < 0 || err != nil {
+		writeESError(w, http.StatusBadRequest, "illegal_argument_exception",
+			"index name ["+old+"] does not match pattern '^.*-\\d+$'")
+		return
+	}
+	name := fmt.Sprintf("%s-%06d", old[:sep], n+1)
+	es.indices[name] = &fakeIndex{}
+	es.aliases[alias] = append(targets, name)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"acknowledged": true, "old_index": old, "new_index": name, "rolled_over": true,
+	})
+}
+
+func (es *Elasticsearch) updateAliases(w http.ResponseWriter, body map[string]interface{}) {
+	actions, _ := body["actions"].([]interface{})
+	for _, a := range actions {
+		action, _ := a.(map[string]interface{})
+		for kind, v := range action {
+			params, _ := v.(map[string]interface{})
+			index, _ := params["index"].(string)
+			if _, ok := es.indices[index]; !ok {
+				writeESError(w, http.StatusNotFound, "index_not_found_exception", "no such index ["+index+"]")
+				return
+			}
+			switch kind {
+			case "add":
+				alias, _ := params["alias"].(string)
+				es.aliases[alias] = append(es.removeFromAlias(alias, index), index)
+			case "remove":
+				alias, _ := params["alias"].(string)
+				es.aliases[alias] = es.removeFromAlias(alias, index)
+				if len(es.aliases[alias]) == 0 {
+					delete(es.aliases, alias)
+				}
+			case "remove_index":
+				delete(es.indices, index)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
+
+func (es *Elasticsearch) reindex(w http.ResponseWriter, body map[string]interface{}) {
+	source, _ := body["source"].(map[string]interface{})
+	dest, _ := body["dest"].(map[string]interface{})
+	from, _ := source["index"].(string)
+	to, _ := dest["index"].(string)
+	var n int
+	for _, name := range es.resolve(from) {
+		for _, doc := range es.indices[name].docs {
+			es.index(to, doc.id, doc.source)
+			n++
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"total": n, "created": n, "failures": []interface{}{}})
+}
+
+func (es *Elasticsearch) createIndex(w http.ResponseWriter, name string, body map[string]interface{}) {
+	if _, ok := es.indices[name]; ok {
+		writeESError(w, http.StatusBadRequest, "resource_already_exists_exception", "index ["+name+"] already exists")
+		return
+	}
+	es.indices[name] = &fakeIndex{}
+	aliases, _ := body["aliases"].(map[string]interface{})
+	for alias := range aliases {
+		es.aliases[alias] = append(es.aliases[alias], name)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"acknowledged": true, "index": name})
+}
+
+func (es *Elasticsearch) putMapping(w http.ResponseWriter, name string, body map[string]interface{}) {
+	names := es.resolve(name)
+	if len(names) == 0 {
+		writeESError(w, http.StatusNotFound, "index_not_found_exception", "no such index ["+name+"]")
+		return
+	}
+	for _, n := range names {
+		if err := conflict(es.indices[n].mappings, body); err != "" {
+			writeESError(w, http.StatusBadRequest, "illegal_argument_exception", err)
+			return
+		}
+	}
+	for _, n := range names {
+		es.indices[n].mappings = merge(es.indices[n].mappings, body)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
+
+func (es *Elasticsearch) indexDoc(w http.ResponseWriter, name, id string, source map[string]interface{}) {
+	id = es.index(name, id, source)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"_index": es.writeIndex(name), "_id": id, "result": "created"})
+}
+
+// bulk handles the index and create actions of a bulk request.
+func (es *Elasticsearch) bulk(w http.ResponseWriter, body io.Reader) {
+	type result struct {
+		Index  string `json:"_index"`
+		ID     string `json:"_id"`
+		Status int    `json:"status"`
+	}
+	var items []map[string]result
+	dec := json.NewDecoder(body)
+	for {
+		var action map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		if err := dec.Decode(&action); err == io.EOF {
+			break
+		} else if err != nil {
+			writeESError(w, http.StatusBadRequest, "parse_exception", err.Error())
+			return
+		}
+		var source map[string]interface{}
+		if err := dec.Decode(&source); err != nil {
+			writeESError(w, http.StatusBadRequest, "parse_exception", err.Error())
+			return
+		}
+		for op, meta := range action {
+			if op != "index" && op != "create" {
+				writeESError(w, http.StatusBadRequest, "illegal_argument_exception",
+					fmt.Sprintf("bulk action [%s] not supported by fake Elasticsearch", op))
+				return
+			}
+			id := es.index(meta.Index, meta.ID, source)
+			items = append(items, map[string]result{op: {Index: es.writeIndex(meta.Index), ID: id, Status: http.StatusCreated}})
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"errors": false, "items": items})
+}
+
+func (es *Elasticsearch) count(w http.ResponseWriter, indices string, body map[string]interface{}) {
+	query, _ := body["query"].(map[string]interface{})
+	var n int
+	for _, name := range es.resolve(indices) {
+		for _, doc := range es.indices[name].docs {
+			if matches(query, doc.source) {
+				n++
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"count": n})
+}
+
+func (es *Elasticsearch) search(w http.ResponseWriter, r *http.Request, indices string, body map[string]interface{}) {
+	query, _ := body["query"].(map[string]interface{})
+	type hit struct {
+		Index  string                 `json:"_index"`
+		ID     string                 `json:"_id"`
+		Source map[string]interface{} `json:"_source"`
+	}
+	hits := []hit{}
+	for _, name := range es.resolve(indices) {
+		for _, doc := range es.indices[name].docs {
+			if matches(query, doc.source) {
+				hits = append(hits, hit{Index: name, ID: doc.id, Source: doc.source})
+			}
+		}
+	}
+	total := len(hits)
+
+	if sortParam := r.URL.Query().Get("sort"); sortParam != "" {
+		field, order := sortParam, "asc"
+		if sep := strings.LastIndex(sortParam, ":"); sep > 0 {
+			field, order = sortParam[:sep], sortParam[sep+1:]
+		}
+		sort.SliceStable(hits, func(i, j int) bool {
+			a, b := lookup(hits[i].Source, field), lookup(hits[j].Source, field)
+			if order == "desc" {
+				return compare(a, b) > 0
+			}
+			return compare(a, b) < 0
+		})
+	}
+	size := 10
+	if s, ok := body["size"].(float64); ok {
+		size = int(s)
+	}
+	if s, err := strconv.Atoi(r.URL.Query().Get("size")); err == nil {
+		size = s
+	}
+	if len(hits) > size {
+		hits = hits[:size]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"hits": map[string]interface{}{
+			"total": map[string]interface{}{"value": total, "relation": "eq"},
+			"hits":  hits,
+		},
+	})
+}
+
+func (es *Elasticsearch) deleteByQuery(w http.ResponseWriter, indices string, body map[string]interface{}) {
+	query, _ := body["query"].(map[string]interface{})
+	var deleted int
+	for _, name := range es.resolve(indices) {
+		idx := es.indices[name]
+		kept := idx.docs[:0]
+		for _, doc := range idx.docs {
+			if matches(query, doc.source) {
+				deleted++
+			} else {
+				kept = append(kept, doc)
+			}
+		}
+		idx.docs = kept
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": deleted, "failures": []interface{}{}})
+}
+
+// index adds a document to an index or the write index of an alias, and returns its id.
+// If a document with the same id exists, it is replaced.
+// It must be called with the lock held.
+func (es *Elasticsearch) index(name, id string, source map[string]interface{}) string {
+	name = es.writeIndex(name)
+	idx, ok := es.indices[name]
+	if !ok {
+		idx = &fakeIndex{}
+		es.indices[name] = idx
+	}
+	if id == "" {
+		es.nextID++
+		id = strconv.Itoa(es.nextID)
+	} else {
+		for i, doc := range idx.docs {
+			if doc.id == id {
+				idx.docs[i].source = source
+				return id
+			}
+		}
+	}
+	idx.docs = append(idx.docs, document{id: id, source: source})
+	return id
+}
+
+// writeIndex returns the write index of an alias, or the given name if it is not an alias.
+func (es *Elasticsearch) writeIndex(name string) string {
+	if targets, ok := es.aliases[name]; ok {
+		return targets[len(targets)-1]
+	}
+	return name
+}
+
+// removeFromAlias returns the indices of an alias without the given one.
+func (es *Elasticsearch) removeFromAlias(alias, index string) []string {
+	var kept []string
+	for _, target := range es.aliases[alias] {
+		if target != index {
+			kept = append(kept, target)
+		}
+	}
+	return kept
+}
+
+// conflict returns why mappings can't be updated, if a top level field changes its type.
+// Fields without type are objects, as in Elasticsearch.
+func conflict(old json.RawMessage, mappings map[string]interface{}) string {
+	var current map[string]interface{}
+	if json.Unmarshal(old, &current) != nil {
+		return ""
+	}
+	oldProps, _ := current["properties"].(map[string]interface{})
+	newProps, _ := mappings["properties"].(map[string]interface{})
+	typeOf := func(prop interface{}) string {
+		if t, ok := prop.(map[string]interface{})["type"].(string); ok {
+			return t
+		}
+		return "object"
+	}
+	for name, prop := range newProps {
+		if oldProp, ok := oldProps[name]; ok && typeOf(oldProp) != typeOf(prop) {
+			return fmt.Sprintf("mapper [%s] cannot be changed from type [%s] to [%s]", name, typeOf(oldProp), typeOf(prop))
+		}
+	}
+	return ""
+}
+
+// merge returns mappings with new top level fields added, as Elasticsearch keeps the fields
+// already mapped that are missing in a mappings update.
+func merge(old json.RawMessage, mappings map[string]interface{}) json.RawMessage {
+	var merged map[string]interface{}
+	if json.Unmarshal(old, &merged) != nil || merged == nil {
+		merged = make(map[string]interface{})
+	}
+	props, _ := merged["properties"].(map[string]interface{})
+	for k, v := range mappings {
+		merged[k] = v
+	}
+	if newProps, ok := mappings["properties"].(map[string]interface{}); ok && props != nil {
+		for name, prop := range newProps {
+			props[name] = prop
+		}
+		merged["properties"] = props
+	}
+	encoded, _ := json.Marshal(merged)
+	return encoded
+}
+
+// resolve returns the names of the indices matching a comma separated list of names,
+// aliases and wildcard patterns.
+//
+// Patterns for data stream backing indices (eg. ".ds-traces-apm*") match indices named
+// after the data stream (eg. "traces-apm-default"), which is where the fake indexes documents.
+func (es *Elasticsearch) resolve(expr string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, pattern := range strings.Split(expr, ",") {
+		if targets, ok := es.aliases[pattern]; ok {
+			for _, target := range targets {
+				add(target)
+			}
+			continue
+		}
+		if _, ok := es.indices[pattern]; ok {
+			add(pattern)
+			continue
+		}
+		if !strings.Contains(pattern, "*") {
+			continue
+		}
+		var matched []string
+		for name := range es.indices {
+			if ok, _ := path.Match(pattern, name); ok {
+				matched = append(matched, name)
+			} else if ok, _ := path.Match(pattern, ".ds-"+name); ok {
+				matched = append(matched, name)
+			}
+		}
+		sort.Strings(matched)
+		for _, name := range matched {
+			add(name)
+		}
+	}
+	return names
+}
+
+// matches returns true if a document matches a query.
+func matches(query, doc map[string]interface{}) bool {
+	for kind, v := range query {
+		params, _ := v.(map[string]interface{})
+		switch kind {
+		case "match_all":
+		case "bool":
+			if !matchesBool(params, doc) {
+				return false
+			}
+		case "term", "match":
+			for field, want := range params {
+				if m, ok := want.(map[string]interface{}); ok {
+					if want, ok = m["value"]; !ok {
+						want = m["query"]
+					}
+				}
+				if !containsValue(lookup(doc, field), want) {
+					return false
+				}
+			}
+		case "range":
+			for field, bounds := range params {
+				if !inRange(lookup(doc, field), bounds.(map[string]interface{})) {
+					return false
+				}
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func matchesBool(params, doc map[string]interface{}) bool {
+	for _, clause := range []string{"must", "filter"} {
+		for _, q := range clauses(params[clause]) {
+			if !matches(q, doc) {
+				return false
+			}
+		}
+	}
+	for _, q := range clauses(params["must_not"]) {
+		if matches(q, doc) {
+			return false
+		}
+	}
+	if should := clauses(params["should"]); len(should) > 0 {
+		for _, q := range should {
+			if matches(q, doc) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// clauses returns the queries of a bool clause, given either as an object or an array.
+func clauses(v interface{}) []map[string]interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{v}
+	case []interface{}:
+		var qs []map[string]interface{}
+		for _, q := range v {
+			if q, ok := q.(map[string]interface{}); ok {
+				qs = append(qs, q)
+			}
+		}
+		return qs
+	}
+	return nil
+}
+
+// lookup returns the value of a field in a document, given either with dots in its name
+// or as nested objects.
+func lookup(doc map[string]interface{}, field string) interface{} {
+	if v, ok := doc[field]; ok {
+		return v
+	}
+	for i := range field {
+		if field[i] != '.' {
+			continue
+		}
+		if nested, ok := doc[field[:i]].(map[string]interface{}); ok {
+			if v := lookup(nested, field[i+1:]); v != nil {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// containsValue returns true if v, or any of its elements if it is an array, equals want.
+func containsValue(v, want interface{}) bool {
+	if values, ok := v.([]interface{}); ok {
+		for _, v := range values {
+			if compare(v, want) == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	return v != nil && compare(v, want) == 0
+}
+
+func inRange(v interface{}, bounds map[string]interface{}) bool {
+	if v == nil {
+		return false
+	}
+	for op, bound := range bounds {
+		if s, ok := bound.(string); ok && strings.HasPrefix(s, "now") {
+			bound = dateMath(s).Format(time.RFC3339Nano)
+		}
+		c := compare(v, bound)
+		switch op {
+		case "gt":
+			if c <= 0 {
+				return false
+			}
+		case "gte":
+			if c < 0 {
+				return false
+			}
+		case "lt":
+			if c >= 0 {
+				return false
+			}
+		case "lte":
+			if c > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// dateMath evaluates simple Elasticsearch date math expressions such as "now-7d/d".
+func dateMath(expr string) time.Time {
+	t := time.Now().UTC()
+	expr = strings.TrimPrefix(expr, "now")
+	var round string
+	if sep := strings.Index(expr, "/"); sep >= 0 {
+		expr, round = expr[:sep], expr[sep+1:]
+	}
+	if len(expr) > 2 {
+		n, _ := strconv.Atoi(expr[1 : len(expr)-1])
+		if expr[0] == '-' {
+			n = -n
+		}
+		switch expr[len(expr)-1] {
+		case 'd':
+			t = t.AddDate(0, 0, n)
+		case 'h', 'H':
+			t = t.Add(time.Duration(n) * time.Hour)
+		case 'm':
+			t = t.Add(time.Duration(n) * time.Minute)
+		case 's':
+			t = t.Add(time.Duration(n) * time.Second)
+		}
+	}
+	switch round {
+	case "d":
+		t = t.Truncate(24 * time.Hour)
+	case "h", "H":
+		t = t.Truncate(time.Hour)
+	}
+	return t
+}
+
+// compare orders two JSON values, as numbers, dates or strings.
+func compare(a, b interface{}) int {
+	af, aok := toFloat(a)
+	bf, bok := toFloat(b)
+	if aok && bok {
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		}
+		return 0
+	}
+	as, bs := fmt.Sprint(a), fmt.Sprint(b)
+	at, aerr := time.Parse(time.RFC3339Nano, as)
+	bt, berr := time.Parse(time.RFC3339Nano, bs)
+	if aerr == nil && berr == nil {
+		switch {
+		case at.Before(bt):
+			return -1
+		case at.After(bt):
+			return 1
+		}
+		return 0
+	}
+	if reflect.DeepEqual(a, b) {
+		return 0
+	}
+	return strings.Compare(as, bs)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func toMap(doc interface{}) (map[string]interface{}, error) {
+	if m, ok := doc.(map[string]interface{}); ok {
+		return m, nil
+	}
+	encoded, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(encoded, &m)
+	return m, err
+}
+
+func writeESError(w http.ResponseWriter, code int, errType, reason string) {
+	writeJSON(w, code, map[string]interface{}{
+		"error": map[string]interface{}{
+			"root_cause": []map[string]interface{}{{"type": errType, "reason": reason}},
+			"type":       errType,
+			"reason":     reason,
+		},
+		"status": code,
+	})
+}
@@ -0,0 +1,171 @@
+package fake
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// request sends a JSON request straight to a fake Elasticsearch, and returns the status code
+// and decoded response.
+func request(t *testing.T, es *Elasticsearch, method, target, body string) (int, map[string]interface{}) {
+	w := serve(es, method, target, strings.NewReader(body), map[string]string{"Content-Type": "application/json"})
+	var response map[string]interface{}
+	if w.Body.Len() > 0 {
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response), target)
+	}
+	return w.Code, response
+}
+
+func errorType(response map[string]interface{}) string {
+	err, _ := response["error"].(map[string]interface{})
+	errType, _ := err["type"].(string)
+	return errType
+}
+
+func TestElasticsearchAliases(t *testing.T) {
+	es := NewElasticsearch()
+	defer es.Close()
+
+	code, _ := request(t, es, http.MethodHead, "/reports-000001", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = request(t, es, http.MethodPut, "/reports-000001", `{"aliases":{"reports":{}}}`)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = request(t, es, http.MethodHead, "/reports-000001", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, response := request(t, es, http.MethodPut, "/reports-000001", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "resource_already_exists_exception", errorType(response))
+
+	_, err := es.Index("reports", map[string]interface{}{"n": 1})
+	require.NoError(t, err)
+
+	// documents go to the new write index after a rollover, and the alias reads from both
+	code, response = request(t, es, http.MethodPost, "/reports/_rollover", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "reports-000001", response["old_index"])
+	assert.Equal(t, "reports-000002", response["new_index"])
+	_, err = es.Index("reports", map[string]interface{}{"n": 2})
+	require.NoError(t, err)
+	assert.Len(t, es.Documents("reports-000002"), 1)
+	assert.Len(t, es.Documents("reports"), 2)
+
+	code, response = request(t, es, http.MethodGet, "/_alias/reports", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{
+		"reports-000001": map[string]interface{}{"aliases": map[string]interface{}{"reports": map[string]interface{}{"is_write_index": false}}},
+		"reports-000002": map[string]interface{}{"aliases": map[string]interface{}{"reports": map[string]interface{}{"is_write_index": true}}},
+	}, response)
+
+	code, _ = request(t, es, http.MethodPost, "/_aliases", `{"actions":[
+		{"remove":{"index":"reports-000001","alias":"reports"}},
+		{"remove_index":{"index":"reports-000001"}}]}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, es.Documents("reports"), 1)
+	code, response = request(t, es, http.MethodPost, "/_aliases", `{"actions":[{"add":{"index":"reports-000001","alias":"reports"}}]}`)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "index_not_found_exception", errorType(response))
+
+	code, _ = request(t, es, http.MethodGet, "/_alias/other", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, response = request(t, es, http.MethodPost, "/other/_rollover", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "illegal_argument_exception", errorType(response))
+}
+
+func TestElasticsearchMappings(t *testing.T) {
+	es := NewElasticsearch()
+	defer es.Close()
+
+	code, response := request(t, es, http.MethodPut, "/reports/_mapping", `{"properties":{"n":{"type":"long"}}}`)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "index_not_found_exception", errorType(response))
+
+	request(t, es, http.MethodPut, "/reports-000001", `{"aliases":{"reports":{}}}`)
+	code, _ = request(t, es, http.MethodPut, "/reports/_mapping", `{"properties":{"n":{"type":"long"},"labels":{"type":"keyword"}}}`)
+	require.Equal(t, http.StatusOK, code)
+	// new fields can be added, or existing ones mapped again with the same type
+	code, _ = request(t, es, http.MethodPut, "/reports/_mapping", `{"properties":{"n":{"type":"long"},"elapsed":{"type":"double"}}}`)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, response = request(t, es, http.MethodPut, "/reports/_mapping", `{"properties":{"labels":{"properties":{"env":{"type":"keyword"}}}}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "illegal_argument_exception", errorType(response))
+	assert.Contains(t, response["error"].(map[string]interface{})["reason"], "mapper [labels] cannot be changed from type [keyword] to [object]")
+}
+
+func TestElasticsearchQueries(t *testing.T) {
+	es := NewElasticsearch()
+	defer es.Close()
+
+	now := time.Now().UTC()
+	code, response := request(t, es, http.MethodPost, "/_bulk", strings.Join([]string{
+		`{"index":{"_index":"reports","_id":"a"}}`,
+		`{"name":"a","n":1,"labels":["env=ci"],"@timestamp":"` + now.Add(-48*time.Hour).Format(time.RFC3339Nano) + `"}`,
+		`{"create":{"_index":"reports","_id":"b"}}`,
+		`{"name":"b","n":2,"labels":["env=ci","os=linux"],"@timestamp":"` + now.Format(time.RFC3339Nano) + `"}`,
+		`{"index":{"_index":"reports"}}`,
+		`{"name":"c","n":3,"nested":{"field":"x"},"@timestamp":"` + now.Format(time.RFC3339Nano) + `"}`,
+	}, "\n")+"\n")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, false, response["errors"])
+	assert.Len(t, response["items"], 3)
+	// documents with the same id are replaced
+	request(t, es, http.MethodPut, "/reports/_doc/a", `{"name":"a","n":10,"labels":["env=ci"],"@timestamp":"`+now.Add(-48*time.Hour).Format(time.RFC3339Nano)+`"}`)
+	code, response = request(t, es, http.MethodPost, "/_bulk", `{"delete":{"_index":"reports","_id":"a"}}`+"\n{}\n")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "illegal_argument_exception", errorType(response))
+
+	count := func(query string) float64 {
+		code, response := request(t, es, http.MethodPost, "/reports/_count", `{"query":`+query+`}`)
+		require.Equal(t, http.StatusOK, code, query)
+		return response["count"].(float64)
+	}
+	for query, expected := range map[string]float64{
+		`{"match_all":{}}`:                                   3,
+		`{"term":{"labels":"env=ci"}}`:                       2,
+		`{"match":{"name":{"query":"b"}}}`:                   1,
+		`{"term":{"nested.field":{"value":"x"}}}`:            1,
+		`{"range":{"n":{"gt":1,"lte":3}}}`:                   2,
+		`{"range":{"@timestamp":{"gte":"now-1d/d"}}}`:        2,
+		`{"bool":{"filter":[{"term":{"labels":"env=ci"}}]}}`: 2,
+		`{"bool":{"must":{"term":{"labels":"env=ci"}},"must_not":{"term":{"labels":"os=linux"}}}}`: 1,
+		`{"bool":{"should":[{"term":{"name":"a"}},{"term":{"name":"c"}}]}}`:                        2,
+		`{"unsupported":{}}`: 0,
+	} {
+		assert.Equal(t, expected, count(query), query)
+	}
+
+	code, response = request(t, es, http.MethodPost, "/reports/_search?sort=n:desc&size=2", `{"query":{"match_all":{}}}`)
+	require.Equal(t, http.StatusOK, code)
+	hits := response["hits"].(map[string]interface{})
+	assert.Equal(t, float64(3), hits["total"].(map[string]interface{})["value"])
+	var names []interface{}
+	for _, hit := range hits["hits"].([]interface{}) {
+		names = append(names, hit.(map[string]interface{})["_source"].(map[string]interface{})["name"])
+	}
+	assert.Equal(t, []interface{}{"a", "c"}, names)
+
+	code, response = request(t, es, http.MethodPost, "/reports/_delete_by_query", `{"query":{"term":{"labels":"env=ci"}}}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(2), response["deleted"])
+	assert.Equal(t, float64(1), count(`{"match_all":{}}`))
+}
+
+// Data stream backing index patterns match the indices apm-server events are written to.
+func TestElasticsearchDataStreams(t *testing.T) {
+	es := NewElasticsearch()
+	defer es.Close()
+
+	es.Index("traces-apm-default", map[string]interface{}{"processor.event": "transaction"})
+	es.Index("logs-apm.error-default", map[string]interface{}{"processor.event": "error"})
+	es.Index("metrics-apm.internal-default", map[string]interface{}{"processor.event": "metric"})
+	assert.Len(t, es.Documents(".ds-traces-apm*,.ds-logs-apm*"), 2)
+	assert.Len(t, es.Documents("*-apm*"), 3)
+	assert.Empty(t, es.Documents("missing"))
+}
@@ -7,16 +7,22 @@ import (
 	"log"
 	"math"
 	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"time"
 
 	"go.elastic.co/apm"
-	"golang.org/x/sync/errgroup"
 
 	"github.com/elastic/hey-apm/benchmark"
+	"github.com/elastic/hey-apm/cluster"
+	"github.com/elastic/hey-apm/control"
+	"github.com/elastic/hey-apm/fake"
 	"github.com/elastic/hey-apm/models"
+	"github.com/elastic/hey-apm/output"
 	"github.com/elastic/hey-apm/worker"
 )
 
@@ -35,6 +41,32 @@ func Main() error {
 	signalC := make(chan os.Signal, 1)
 	signal.Notify(signalC, os.Interrupt)
 	input := parseFlags()
+	if err := output.Check(input.Output); err != nil {
+		return err
+	}
+	if input.DryRun {
+		elasticsearch := fake.NewElasticsearch()
+		defer elasticsearch.Close()
+		apmServer := fake.NewAPMServer(fake.APMServerConfig{Elasticsearch: elasticsearch})
+		defer apmServer.Close()
+		log.Printf("dry run: using a fake apm-server at %s and a fake Elasticsearch at %s", apmServer.URL, elasticsearch.URL)
+		input.ApmServerUrl = apmServer.URL
+		input.ApmElasticsearchUrl, input.ApmElasticsearchAuth = elasticsearch.URL, ""
+		input.ApmElasticsearchAPIKey, input.ApmElasticsearchToken, input.ApmElasticsearchCloudID = "", "", ""
+		input.ElasticsearchUrl, input.ElasticsearchAuth = elasticsearch.URL, ""
+		input.ElasticsearchAPIKey, input.ElasticsearchToken, input.ElasticsearchCloudID = "", "", ""
+		input.ReportPath = ""
+	}
+	if input.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", worker.MetricsHandler())
+		go func() {
+			log.Printf("serving metrics on %s/metrics", input.MetricsAddr)
+			if err := http.ListenAndServe(input.MetricsAddr, mux); err != nil {
+				log.Printf("error serving metrics: %s", err)
+			}
+		}()
+	}
 	if input.IsBenchmark {
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -52,30 +84,63 @@ func Main() error {
 		return nil
 	}
 
-	stopChan := make(chan struct{})
+	if input.ControlAddr != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			// Ctrl+C when serving the control API stops any running
+			// load generation, and shuts down the server.
+			defer cancel()
+			<-signalC
+			log.Printf("Interrupt signal received, shutting down control server...")
+		}()
+		return control.ListenAndServe(ctx, input.ControlAddr, input)
+	}
+
+	if input.CoordinatorAddr != "" {
+		ln, err := net.Listen("tcp", input.CoordinatorAddr)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			// Ctrl+C when coordinating agents gracefully stops them,
+			// and waits for their results.
+			defer cancel()
+			<-signalC
+			log.Printf("Interrupt signal received, stopping agents...")
+		}()
+		_, err = cluster.Coordinate(ctx, ln, input.Agents, input)
+		return err
+	}
+
+	if input.CoordinatorUrl != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			// Ctrl+C when running as an agent aborts the load
+			// generation, and reports the failure to the coordinator.
+			defer cancel()
+			<-signalC
+			log.Printf("Interrupt signal received, aborting agent...")
+		}()
+		return cluster.Join(ctx, input.CoordinatorUrl, input)
+	}
+
+	ctrl := worker.NewControl()
 	go func() {
 		// Ctrl+C when running load generation gracefully stops the
 		// workers and prints the statistics.
-		defer close(stopChan)
+		defer ctrl.Stop()
 		<-signalC
 		log.Printf("Interrupt signal received, stopping load generator...")
 	}()
-	return runWorkers(input, stopChan)
-}
-
-func runWorkers(input models.Input, stop <-chan struct{}) error {
-	g, ctx := errgroup.WithContext(context.Background())
-	for i := 0; i < input.Instances; i++ {
-		idx := i
-		g.Go(func() error {
-			randomDelay := time.Duration(rand.Intn(input.DelayMillis)) * time.Millisecond
-			fmt.Println(fmt.Sprintf("--- Starting instance (%v) in %v milliseconds", idx, randomDelay))
-			time.Sleep(randomDelay)
-			_, err := worker.Run(ctx, input, "", stop)
-			return err
-		})
+	reports, results, err := worker.RunInstances(context.Background(), input, ctrl)
+	if err != nil {
+		return err
 	}
-	return g.Wait()
+	return output.Save(input, reports, results)
 }
 
 func parseFlags() models.Input {
@@ -83,8 +148,28 @@ func parseFlags() models.Input {
 	runTimeout := flag.Duration("run", 30*time.Second, "stop run after this duration")
 	flushTimeout := flag.Duration("flush", 10*time.Second, "wait timeout for agent flush")
 	seed := flag.Int64("seed", time.Now().Unix(), "random seed")
+	dryRun := flag.Bool("dry-run", false, "use in-process fakes of apm-server and Elasticsearch instead of -apm-url, -apm-es-url and -es-url")
 	instances := flag.Int("instances", 1, "number of concurrent instances to create load (only if -bench is not passed)")
 	delayMillis := flag.Int("delay", 1000, "max delay in milliseconds per worker to start (only if -bench is not passed)")
+	progressInterval := flag.Duration("progress", 0, "print live progress to stderr this often during runs (eg. 1s), disabled by default")
+	telemetryInterval := flag.Duration("telemetry", 0, "sample the rates of runs this often into a telemetry series stored along reports (eg. 10s), disabled by default")
+	outputFormat := flag.String("output", output.Text, "format of the final reports and results, one of "+strings.Join(output.Formats, ", "))
+	outputFile := flag.String("output-file", "", "write the final reports and results to this file, instead of the standard output")
+	metricsAddr := flag.String("metrics", "", "serve Prometheus metrics of the load generator on this address at /metrics, eg. :9100")
+	controlAddr := flag.String("serve", "", "serve an HTTP API on this address to start, adjust and stop runs remotely, instead of running once")
+	coordinatorAddr := flag.String("coordinator", "", "coordinate agents joining on this address to generate the workload together")
+	agents := flag.Int("agents", 2, "number of agents to wait for (only in combination with -coordinator)")
+	coordinatorUrl := flag.String("join", "", "join the coordinator at this URL as an agent, and generate the share of the workload it assigns")
+
+	// Go agent tuning, see https://www.elastic.co/guide/en/apm/agent/go/current/configuration.html
+	var agentBufferSize, agentRequestSize sizeFlag
+	flag.Var(&agentBufferSize, "agent-buffer-size", "size of the Go agent buffer of events waiting to be sent, eg. 1MB (default from the agent)")
+	flag.Var(&agentRequestSize, "agent-request-size", "size after which the Go agent ends intake requests, as compressed by the agent with level 1, eg. 750KB (default from the agent)")
+	agentRequestTime := flag.Duration("agent-request-time", 0, "time after which the Go agent ends intake requests (default from the agent)")
+	agentCompressionLevel := flag.Int("agent-compression", 0, "zlib compression level of intake requests from 1 (the agent default) to 9, or -1 for none")
+	agentMaxSpans := flag.Int("agent-max-spans", 0, "max spans per transaction sent by the Go agent, -1 for no limit (default -sx)")
+	contextLevel := flag.String("context", "", "how detailed the context of generated transactions and spans is, any of "+
+		strings.Join(worker.ContextLevels, ", ")+" (default minimal)")
 
 	// convenience for https://www.elastic.co/guide/en/apm/agent/go/current/configuration.html
 	serviceName := os.Getenv("ELASTIC_APM_SERVICE_NAME")
@@ -94,17 +179,39 @@ func parseFlags() models.Input {
 	// apm-server options
 	apmServerSecret := flag.String("apm-secret", "", "apm server secret token") // ELASTIC_APM_SECRET_TOKEN
 	apmServerAPIKey := flag.String("api-key", "", "APM API yey")
-	apmServerUrl := flag.String("apm-url", "http://localhost:8200", "apm server url") // ELASTIC_APM_SERVER_URL
+	apmServerUrl := flag.String("apm-url", "http://localhost:8200", "apm server url, or comma-separated urls to distribute requests across") // ELASTIC_APM_SERVER_URL
+	apmServerStrategy := flag.String("apm-strategy", "", "how to distribute requests across several -apm-url: round-robin (default), random, or sticky per service")
 
 	elasticsearchUrl := flag.String("es-url", "http://localhost:9200", "elasticsearch url for reporting")
 	elasticsearchAuth := flag.String("es-auth", "", "elasticsearch username:password reporting")
+	elasticsearchAPIKey := flag.String("es-api-key", "", "elasticsearch base64 encoded API key for reporting")   // ES_API_KEY
+	elasticsearchToken := flag.String("es-token", "", "elasticsearch bearer token for reporting")                // ES_BEARER_TOKEN
+	elasticsearchCloudID := flag.String("es-cloud-id", "", "elastic cloud ID for reporting, instead of -es-url") // ES_CLOUD_ID
+	reportPath := flag.String("report-path", "", "local file or directory to append reports to as JSON lines, instead of indexing them in elasticsearch")
 
 	apmElasticsearchUrl := flag.String("apm-es-url", "http://localhost:9200", "elasticsearch output host for apm-server under load")
 	apmElasticsearchAuth := flag.String("apm-es-auth", "", "elasticsearch output username:password for apm-server under load")
+	apmElasticsearchAPIKey := flag.String("apm-es-api-key", "", "elasticsearch output base64 encoded API key for apm-server under load") // APM_ES_API_KEY
+	apmElasticsearchToken := flag.String("apm-es-token", "", "elasticsearch output bearer token for apm-server under load")              // APM_ES_BEARER_TOKEN
+	apmElasticsearchCloudID := flag.String("apm-es-cloud-id", "", "elastic cloud ID of the apm-server output, instead of -apm-es-url")   // APM_ES_CLOUD_ID
+
+	// TLS options, for both apm-server and elasticsearch
+	tlsCACert := flag.String("tls-ca", "", "file with PEM encoded CA certificates to verify apm-server and elasticsearch certificates")
+	tlsClientCert := flag.String("tls-cert", "", "file with a PEM encoded client certificate, for mutual TLS")
+	tlsClientKey := flag.String("tls-key", "", "file with the PEM encoded key of the client certificate, for mutual TLS")
+	tlsServerName := flag.String("tls-server-name", "", "server name to verify apm-server and elasticsearch certificates against, instead of the URL host")
+	tlsInsecure := flag.Bool("tls-insecure", false, "skip verification of apm-server and elasticsearch certificates")
+
+	testName := flag.String("test-name", "", "name of the test run, stored in the report (only if -bench is not passed)")
+	var labels labelsFlag
+	flag.Var(&labels, "label", "key=value label stored in the report and used to filter regression checks, can be repeated")
 
 	isBench := flag.Bool("bench", false, "execute a benchmark with fixed parameters")
 	regressionMargin := flag.Float64("rm", 1.1, "margin of acceptable performance decrease to not consider a regression (only in combination with -bench)")
 	regressionDays := flag.String("rd", "7", "number of days back to check for regressions (only in combination with -bench)")
+	regressionBranch := flag.String("rb", "", "git branch to compare with when checking for regressions, defaults to any (only in combination with -bench)")
+	junitFile := flag.String("junit", "", "write benchmark results to this JUnit XML file (only in combination with -bench)")
+	markdownFile := flag.String("markdown", "", "write a summary of benchmark results to this Markdown file (only in combination with -bench)")
 
 	// payload options
 	errorLimit := flag.Int("e", math.MaxInt64, "max errors to generate (only if -bench is not passed)")
@@ -117,8 +224,37 @@ func parseFlags() models.Input {
 	transactionLimit := flag.Int("t", math.MaxInt64, "max transactions to generate (only if -bench is not passed)")
 	transactionFrequency := flag.Duration("tf", 1*time.Nanosecond, "transaction frequency. "+
 		"generate transactions up to once in this duration (only if -bench is not passed)")
+	chaosRate := flag.Float64("chaos", 0, "fraction of events and requests to corrupt on purpose, "+
+		"to load test apm-server rejections (only if -bench is not passed)")
+	chaosFaults := flag.String("chaos-faults", "", "comma separated faults to inject with -chaos, any of "+
+		strings.Join(worker.Faults, ", ")+" (default all)")
+	trickleRate := flag.Int("trickle", 0, "upload intake requests at this many bytes per second, like a slow agent (only if -bench is not passed)")
+	holdStream := flag.Duration("hold", 0, "keep intake streams open for this long after the agent finished writing them (only if -bench is not passed)")
+	disconnectRate := flag.Float64("disconnect", 0, "fraction of intake requests aborted mid-stream (only if -bench is not passed)")
+	idleConnections := flag.Int("idle-conns", 0, "number of idle keep-alive connections to hold open to apm-server, per instance (only if -bench is not passed)")
+	configPollers := flag.Int("config-pollers", 0, "number of agents polling agent central configuration, per instance (only if -bench is not passed)")
+	configPollInterval := flag.Duration("config-interval", 30*time.Second, "how often each agent polls its configuration (only in combination with -config-pollers)")
+	configServices := flag.Int("config-services", 0, "number of distinct service names polling configuration, one per agent if 0 (only in combination with -config-pollers)")
+	rumErrorFrequency := flag.Duration("rum-ef", 0, "RUM error frequency. "+
+		"send RUM errors with JavaScript frames up to once in this duration, 0 to disable (only if -bench is not passed)")
+	sourcemaps := flag.Int("sourcemaps", 0, "number of synthetic sourcemaps to upload and apply to RUM errors (only in combination with -rum-ef)")
+	sourcemapLines := flag.Int("sourcemap-lines", 1000, "number of lines of each synthetic JavaScript bundle (only in combination with -rum-ef)")
+	simulatedAgents := flag.String("simulate-agents", "", "comma separated agents of other languages to simulate with raw intake payloads, "+
+		"as name[/version][=weight] with name any of "+strings.Join(worker.SimulatedAgentNames(), ", ")+" (only if -bench is not passed)")
+	simulatedFrequency := flag.Duration("simulate-frequency", 10*time.Millisecond, "send a transaction from a simulated agent "+
+		"up to once in this duration (only in combination with -simulate-agents)")
+	simulatedErrorRate := flag.Float64("simulate-error-rate", 0.1, "fraction of simulated transactions sent along an error "+
+		"(only in combination with -simulate-agents)")
 	flag.Parse()
 
+	// Credentials can be passed as environment variables, to keep them out of process listings
+	fromEnv(elasticsearchAPIKey, "ES_API_KEY")
+	fromEnv(elasticsearchToken, "ES_BEARER_TOKEN")
+	fromEnv(elasticsearchCloudID, "ES_CLOUD_ID")
+	fromEnv(apmElasticsearchAPIKey, "APM_ES_API_KEY")
+	fromEnv(apmElasticsearchToken, "APM_ES_BEARER_TOKEN")
+	fromEnv(apmElasticsearchCloudID, "APM_ES_CLOUD_ID")
+
 	if *spanMaxLimit < *spanMinLimit {
 		spanMaxLimit = spanMinLimit
 	}
@@ -126,20 +262,51 @@ func parseFlags() models.Input {
 	rand.Seed(*seed)
 
 	input := models.Input{
-		IsBenchmark:          *isBench,
-		ApmServerUrl:         *apmServerUrl,
-		ApmServerSecret:      *apmServerSecret,
-		APIKey:               *apmServerAPIKey,
-		ElasticsearchUrl:     *elasticsearchUrl,
-		ElasticsearchAuth:    *elasticsearchAuth,
-		ApmElasticsearchUrl:  *apmElasticsearchUrl,
-		ApmElasticsearchAuth: *apmElasticsearchAuth,
-		ServiceName:          serviceName,
-		RunTimeout:           *runTimeout,
-		FlushTimeout:         *flushTimeout,
-		Instances:            *instances,
-		DelayMillis:          *delayMillis,
+		IsBenchmark:             *isBench,
+		DryRun:                  *dryRun,
+		ApmServerUrl:            *apmServerUrl,
+		ApmServerStrategy:       *apmServerStrategy,
+		ApmServerSecret:         *apmServerSecret,
+		APIKey:                  *apmServerAPIKey,
+		ElasticsearchUrl:        *elasticsearchUrl,
+		ElasticsearchAuth:       *elasticsearchAuth,
+		ElasticsearchAPIKey:     *elasticsearchAPIKey,
+		ElasticsearchToken:      *elasticsearchToken,
+		ElasticsearchCloudID:    *elasticsearchCloudID,
+		ReportPath:              *reportPath,
+		ApmElasticsearchUrl:     *apmElasticsearchUrl,
+		ApmElasticsearchAuth:    *apmElasticsearchAuth,
+		ApmElasticsearchAPIKey:  *apmElasticsearchAPIKey,
+		ApmElasticsearchToken:   *apmElasticsearchToken,
+		ApmElasticsearchCloudID: *apmElasticsearchCloudID,
+		TLSCACert:               *tlsCACert,
+		TLSClientCert:           *tlsClientCert,
+		TLSClientKey:            *tlsClientKey,
+		TLSServerName:           *tlsServerName,
+		TLSInsecure:             *tlsInsecure,
+		ServiceName:             serviceName,
+		RunTimeout:              *runTimeout,
+		FlushTimeout:            *flushTimeout,
+		Instances:               *instances,
+		DelayMillis:             *delayMillis,
+		ProgressInterval:        *progressInterval,
+		TelemetryInterval:       *telemetryInterval,
+		MetricsAddr:             *metricsAddr,
+		Output:                  *outputFormat,
+		OutputFile:              *outputFile,
+		ControlAddr:             *controlAddr,
+		CoordinatorAddr:         *coordinatorAddr,
+		Agents:                  *agents,
+		CoordinatorUrl:          *coordinatorUrl,
+		AgentBufferSize:         int(agentBufferSize),
+		AgentRequestSize:        int(agentRequestSize),
+		AgentRequestTime:        *agentRequestTime,
+		AgentCompressionLevel:   *agentCompressionLevel,
+		AgentMaxSpans:           *agentMaxSpans,
+		ContextLevel:            *contextLevel,
 	}
+	input.Labels = labels
+	input.GitBranch, input.GitCommit, input.PullRequest = gitFromEnv(os.Getenv)
 
 	if *isBench {
 		if _, err := strconv.Atoi(*regressionDays); err != nil {
@@ -147,9 +314,13 @@ func parseFlags() models.Input {
 		}
 		input.RegressionDays = *regressionDays
 		input.RegressionMargin = *regressionMargin
+		input.RegressionBranch = *regressionBranch
+		input.JUnitFile = *junitFile
+		input.MarkdownFile = *markdownFile
 		return input
 	}
 
+	input.TestName = *testName
 	input.TransactionFrequency = *transactionFrequency
 	input.TransactionLimit = *transactionLimit
 	input.SpanMaxLimit = *spanMaxLimit
@@ -158,6 +329,117 @@ func parseFlags() models.Input {
 	input.ErrorLimit = *errorLimit
 	input.ErrorFrameMaxLimit = *errorFrameMaxLimit
 	input.ErrorFrameMinLimit = *errorFrameMinLimit
+	input.ChaosRate = *chaosRate
+	if *chaosFaults != "" {
+		input.ChaosFaults = strings.Split(*chaosFaults, ",")
+	}
+	input.TrickleRate = *trickleRate
+	input.HoldStream = *holdStream
+	input.DisconnectRate = *disconnectRate
+	input.IdleConnections = *idleConnections
+	input.ConfigPollers = *configPollers
+	if *configPollers > 0 {
+		input.ConfigPollInterval = *configPollInterval
+		input.ConfigServices = *configServices
+	}
+	input.RUMErrorFrequency = *rumErrorFrequency
+	if *rumErrorFrequency > 0 {
+		input.Sourcemaps = *sourcemaps
+		input.SourcemapLines = *sourcemapLines
+	}
+	if *simulatedAgents != "" {
+		input.SimulatedAgents = strings.Split(*simulatedAgents, ",")
+		input.SimulatedFrequency = *simulatedFrequency
+		input.SimulatedErrorRate = *simulatedErrorRate
+	}
 
 	return input
 }
+
+// labelsFlag collects repeated key=value flags.
+type labelsFlag []string
+
+func (l *labelsFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *labelsFlag) Set(value string) error {
+	sep := strings.IndexRune(value, '=')
+	if sep <= 0 {
+		return fmt.Errorf("invalid label %q, expected key=value", value)
+	}
+	// reports are filtered by labels, a key with several values would match none of them
+	for _, label := range *l {
+		if strings.HasPrefix(label, value[:sep+1]) {
+			return fmt.Errorf("duplicate label %q, already set as %q", value, label)
+		}
+	}
+	*l = append(*l, value)
+	return nil
+}
+
+// sizeFlag is a size in bytes, set with a unit: B, KB or MB (multiples of 1024), like Go agent sizes.
+type sizeFlag int
+
+func (s *sizeFlag) String() string {
+	if *s == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dB", int(*s))
+}
+
+func (s *sizeFlag) Set(value string) error {
+	units := []struct {
+		suffix string
+		bytes  int
+	}{{"KB", 1024}, {"MB", 1024 * 1024}, {"B", 1}}
+	upper := strings.ToUpper(strings.TrimSpace(value))
+	for _, unit := range units {
+		if !strings.HasSuffix(upper, unit.suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(upper, unit.suffix)))
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid size %q", value)
+		}
+		*s = sizeFlag(n * unit.bytes)
+		return nil
+	}
+	return fmt.Errorf("invalid size %q, expected a unit: B, KB or MB", value)
+}
+
+// gitFromEnv returns the git branch, commit and pull request number being tested,
+// as set by Jenkins, GitHub Actions or Buildkite in the environment variables looked up with getenv.
+func gitFromEnv(getenv func(string) string) (branch, commit, pullRequest string) {
+	firstEnv := func(keys ...string) string {
+		for _, k := range keys {
+			if v := getenv(k); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	branch = firstEnv("BRANCH_NAME", "CHANGE_BRANCH", "GITHUB_HEAD_REF", "BUILDKITE_BRANCH", "GIT_BRANCH")
+	commit = firstEnv("GIT_COMMIT", "GITHUB_SHA", "BUILDKITE_COMMIT")
+	pullRequest = firstEnv("CHANGE_ID")
+	if pr := getenv("BUILDKITE_PULL_REQUEST"); pullRequest == "" && pr != "false" {
+		pullRequest = pr
+	}
+
+	// GITHUB_REF is refs/heads/<branch> for pushes, and refs/pull/<number>/merge for pull requests
+	ref := getenv("GITHUB_REF")
+	if branch == "" && strings.HasPrefix(ref, "refs/heads/") {
+		branch = strings.TrimPrefix(ref, "refs/heads/")
+	}
+	if pullRequest == "" && strings.HasPrefix(ref, "refs/pull/") {
+		pullRequest = strings.SplitN(strings.TrimPrefix(ref, "refs/pull/"), "/", 2)[0]
+	}
+	return strings.TrimPrefix(branch, "origin/"), commit, pullRequest
+}
+
+// fromEnv sets an empty flag value from the given environment variable, if set.
+func fromEnv(value *string, key string) {
+	if *value == "" {
+		*value = os.Getenv(key)
+	}
+}
@@ -46,3 +46,70 @@ func TestDefaultInput(t *testing.T) {
 		assert.False(t, r.IsZero(), fmt.Sprintf("field %s has zero value %v", k, v))
 	}
 }
+
+func TestSizeFlag(t *testing.T) {
+	for value, expected := range map[string]int{"1024B": 1024, "750KB": 750 * 1024, "2mb": 2 * 1024 * 1024} {
+		var s sizeFlag
+		require.NoError(t, s.Set(value), value)
+		assert.Equal(t, expected, int(s), value)
+	}
+	for _, value := range []string{"", "1024", "KB", "-1KB", "1GB"} {
+		var s sizeFlag
+		assert.Error(t, s.Set(value), value)
+	}
+}
+
+func TestLabelsFlag(t *testing.T) {
+	var labels labelsFlag
+	for _, value := range []string{"env=ci", "empty=", "url=http://host?a=b"} {
+		require.NoError(t, labels.Set(value), value)
+	}
+	assert.Equal(t, "env=ci,empty=,url=http://host?a=b", labels.String())
+	for _, value := range []string{"", "env", "=ci", "env=other", "url=http://other"} {
+		assert.Error(t, labels.Set(value), value)
+	}
+	assert.Len(t, labels, 3)
+}
+
+func TestGitFromEnv(t *testing.T) {
+	for name, tc := range map[string]struct {
+		env                         map[string]string
+		branch, commit, pullRequest string
+	}{
+		"none": {},
+		"jenkins branch": {
+			env:    map[string]string{"BRANCH_NAME": "master", "GIT_COMMIT": "abc", "GIT_BRANCH": "origin/master"},
+			branch: "master", commit: "abc",
+		},
+		"jenkins pull request": {
+			env:    map[string]string{"BRANCH_NAME": "PR-12", "CHANGE_BRANCH": "feature", "CHANGE_ID": "12", "GIT_COMMIT": "abc"},
+			branch: "PR-12", commit: "abc", pullRequest: "12",
+		},
+		"git branch": {
+			env:    map[string]string{"GIT_BRANCH": "origin/7.x"},
+			branch: "7.x",
+		},
+		"github push": {
+			env:    map[string]string{"GITHUB_REF": "refs/heads/master", "GITHUB_SHA": "abc"},
+			branch: "master", commit: "abc",
+		},
+		"github pull request": {
+			env:    map[string]string{"GITHUB_REF": "refs/pull/12/merge", "GITHUB_HEAD_REF": "feature", "GITHUB_SHA": "abc"},
+			branch: "feature", commit: "abc", pullRequest: "12",
+		},
+		"buildkite branch": {
+			env:    map[string]string{"BUILDKITE_BRANCH": "master", "BUILDKITE_COMMIT": "abc", "BUILDKITE_PULL_REQUEST": "false"},
+			branch: "master", commit: "abc",
+		},
+		"buildkite pull request": {
+			env:    map[string]string{"BUILDKITE_BRANCH": "feature", "BUILDKITE_COMMIT": "abc", "BUILDKITE_PULL_REQUEST": "12"},
+			branch: "feature", commit: "abc", pullRequest: "12",
+		},
+	} {
+		getenv := func(key string) string { return tc.env[key] }
+		branch, commit, pullRequest := gitFromEnv(getenv)
+		assert.Equal(t, tc.branch, branch, name)
+		assert.Equal(t, tc.commit, commit, name)
+		assert.Equal(t, tc.pullRequest, pullRequest, name)
+	}
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"strings"
 	"time"
 )
 
@@ -10,31 +11,74 @@ type Input struct {
 
 	// Whether or not this object will be processed by the `benchmark` package
 	IsBenchmark bool `json:"-"`
+	// Whether to use in-process fakes of APM Server and Elasticsearch instead of real ones
+	DryRun bool `json:"-"`
+	// Address to serve the HTTP control API on, instead of running once (only if IsBenchmark is false)
+	ControlAddr string `json:"-"`
+	// Address to coordinate agents on, instead of generating load directly (only if IsBenchmark is false)
+	CoordinatorAddr string `json:"-"`
+	// Number of agents to coordinate (only if CoordinatorAddr is set)
+	Agents int `json:"-"`
+	// URL of the coordinator to join as an agent (only if IsBenchmark is false)
+	CoordinatorUrl string `json:"-"`
 	// Number of days to look back for regressions (only if IsBenchmark is true)
 	RegressionDays string `json:"-"`
 	// Acceptable performance decrease without being considered as regressions, as a percentage
 	// (only if IsBenchmark is true)
 	RegressionMargin float64 `json:"-"`
+	// Only compare with reports from this git branch when looking for regressions, if set
+	// (only if IsBenchmark is true)
+	RegressionBranch string `json:"-"`
+	// Path of a JUnit XML file to write benchmark results to (only if IsBenchmark is true)
+	JUnitFile string `json:"-"`
+	// Path of a Markdown file to write a summary of benchmark results to (only if IsBenchmark is true)
+	MarkdownFile string `json:"-"`
 
-	// URL of the APM Server under test
+	// URL of the APM Server under test, or comma-separated URLs of several APM Servers to send requests to
 	ApmServerUrl string `json:"apm_url"`
+	// How to distribute requests across several APM Servers: round-robin (default), random or sticky
+	ApmServerStrategy string `json:"apm_strategy,omitempty"`
 	// Secret token of the APM Server under test
 	ApmServerSecret string `json:"-"`
 	// API Key for communication between APM Server and the Go agent
 	APIKey string `json:"-"`
 	// If true, it will index the performance report of a run in ElasticSearch
 	SkipIndexReport bool `json:"-"`
+	// If true, APM Server and Elasticsearch aren't queried for their status around runs,
+	// which reports of agents coordinated by another hey-apm don't need
+	SkipStatus bool `json:"-"`
 	// URL of the Elasticsearch instance used for indexing the performance report
 	ElasticsearchUrl string `json:"-"`
 	// <username:password> of the Elasticsearch instance used for indexing the performance report
 	ElasticsearchAuth string `json:"-"`
+	// API key, bearer token and Elastic Cloud ID of the Elasticsearch instance used for indexing the performance report
+	ElasticsearchAPIKey  string `json:"-"`
+	ElasticsearchToken   string `json:"-"`
+	ElasticsearchCloudID string `json:"-"`
+	// Local file or directory to append performance reports to, instead of indexing them in Elasticsearch
+	ReportPath string `json:"-"`
 	// URL of the Elasticsearch instance used by APM Server
 	ApmElasticsearchUrl string `json:"elastic_url,omitempty"`
 	// <username:password> of the Elasticsearch instance used by APM Server
 	ApmElasticsearchAuth string `json:"-"`
+	// API key, bearer token and Elastic Cloud ID of the Elasticsearch instance used by APM Server
+	ApmElasticsearchAPIKey  string `json:"-"`
+	ApmElasticsearchToken   string `json:"-"`
+	ApmElasticsearchCloudID string `json:"-"`
+	// TLS settings for connections to APM Server and Elasticsearch:
+	// CA certificates file, client certificate and key files for mutual TLS,
+	// server name to verify certificates against, and whether to skip verification
+	TLSCACert     string `json:"-"`
+	TLSClientCert string `json:"-"`
+	TLSClientKey  string `json:"-"`
+	TLSServerName string `json:"-"`
+	TLSInsecure   bool   `json:"-"`
 	// Service name passed to the tracer
 	ServiceName string `json:"service_name,omitempty"`
 
+	// What is being tested, reported apart from the input arguments
+	Metadata `json:"-"`
+
 	// Run timeout of the performance test (ends the test when reached)
 	RunTimeout time.Duration `json:"run_timeout"`
 	// Timeout for flushing the workload to APM Server
@@ -44,6 +88,29 @@ type Input struct {
 	// DelayMillis is the maximum amount of milliseconds to wait per instance before starting it,
 	// can be used to add some randomness for producing load
 	DelayMillis int `json:"delay_millis"`
+	// How often live progress is printed during a run, 0 to disable it
+	ProgressInterval time.Duration `json:"-"`
+	// How often the rates of a run are sampled into its telemetry series, 0 to disable it
+	TelemetryInterval time.Duration `json:"-"`
+	// Address to serve Prometheus metrics of the load generator on, if any
+	MetricsAddr string `json:"-"`
+	// Format of the final reports and results: text (default), json or csv
+	Output string `json:"-"`
+	// File to write the final reports and results to, instead of the standard output
+	OutputFile string `json:"-"`
+	// Go agent settings, which keep their default values if not set.
+	// Size of the buffer of events waiting to be sent, in bytes
+	AgentBufferSize int `json:"agent_buffer_size,omitempty"`
+	// Size of the compressed body of an intake request after which it is ended, in bytes,
+	// as compressed by the agent regardless of AgentCompressionLevel
+	AgentRequestSize int `json:"agent_request_size,omitempty"`
+	// Time after which an intake request is ended
+	AgentRequestTime time.Duration `json:"agent_request_time,omitempty"`
+	// zlib compression level of intake requests, from 1 (the agent default) to 9, or -1 for no compression
+	AgentCompressionLevel int `json:"agent_compression_level,omitempty"`
+	// Maximum number of spans per transaction sent by the agent, SpanMaxLimit if not set, or no limit if negative
+	AgentMaxSpans int `json:"agent_max_spans,omitempty"`
+
 	// Frequency at which the tracer will generate transactions
 	TransactionFrequency time.Duration `json:"transaction_generation_frequency"`
 	// Maximum number of transactions to push to the APM Server (ends the test when reached)
@@ -52,6 +119,8 @@ type Input struct {
 	SpanMaxLimit int `json:"spans_generated_max_limit"`
 	// Minimum number of spans per transaction
 	SpanMinLimit int `json:"spans_generated_min_limit"`
+	// How detailed the context of transactions and spans is: minimal (default), basic or full
+	ContextLevel string `json:"context_level,omitempty"`
 	// Frequency at which the tracer will generate errors
 	ErrorFrequency time.Duration `json:"error_generation_frequency"`
 	// Maximum number of errors to push to the APM Server (ends the test when reached)
@@ -60,6 +129,54 @@ type Input struct {
 	ErrorFrameMaxLimit int `json:"error_generation_frames_max_limit"`
 	// Minimum number of stacktrace frames per error
 	ErrorFrameMinLimit int `json:"error_generation_frames_min_limit"`
+
+	// Fraction of events and requests to corrupt on purpose, between 0 and 1,
+	// to load test the apm-server rejection paths
+	ChaosRate float64 `json:"chaos_rate,omitempty"`
+	// Faults to inject when ChaosRate is set, all of them if empty
+	ChaosFaults []string `json:"chaos_faults,omitempty"`
+
+	// Upload intake requests at this many bytes per second, like a slow agent
+	TrickleRate int `json:"trickle_bytes_per_second,omitempty"`
+	// Keep intake streams open for this long after the agent finished writing them
+	HoldStream time.Duration `json:"hold_stream,omitempty"`
+	// Fraction of intake requests aborted mid-stream, between 0 and 1
+	DisconnectRate float64 `json:"disconnect_rate,omitempty"`
+	// Number of idle keep-alive connections to hold open to the APM Server, per instance
+	IdleConnections int `json:"idle_connections,omitempty"`
+
+	// Number of agents polling the APM Server for their central configuration, per instance
+	ConfigPollers int `json:"config_pollers,omitempty"`
+	// How often each agent polls its configuration, 30 seconds if not set
+	ConfigPollInterval time.Duration `json:"config_poll_interval,omitempty"`
+	// Number of distinct service names polling configuration, one per agent if not set
+	ConfigServices int `json:"config_services,omitempty"`
+
+	// Frequency at which RUM errors are sent, with frames in synthetic JavaScript bundles
+	RUMErrorFrequency time.Duration `json:"rum_error_generation_frequency,omitempty"`
+	// Number of synthetic sourcemaps uploaded before sending RUM errors,
+	// which are not sourcemapped if 0
+	Sourcemaps int `json:"sourcemaps,omitempty"`
+	// Number of lines of each synthetic bundle, which defines the size of its sourcemap
+	SourcemapLines int `json:"sourcemap_lines,omitempty"`
+
+	// Agents of other languages simulated with raw intake payloads, as name[/version][=weight],
+	// eg. java/1.30.0=2 sends twice as many payloads as agents with the default weight of 1
+	SimulatedAgents []string `json:"simulated_agents,omitempty"`
+	// Frequency at which simulated agents send a transaction with its spans, each time from an agent picked by weight
+	SimulatedFrequency time.Duration `json:"simulated_frequency,omitempty"`
+	// Fraction of simulated transactions sent along an error, between 0 and 1
+	SimulatedErrorRate float64 `json:"simulated_error_rate,omitempty"`
+}
+
+// ApmServerUrls returns the URLs of the APM Servers under test, the first one receiving
+// the requests not distributed across them.
+func (in Input) ApmServerUrls() []string {
+	urls := strings.Split(in.ApmServerUrl, ",")
+	for i, u := range urls {
+		urls[i] = strings.TrimSpace(u)
+	}
+	return urls
 }
 
 func (in Input) WithErrors(limit int, freq time.Duration) Input {
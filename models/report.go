@@ -6,6 +6,18 @@ import (
 
 const GITRFC = "Mon, 2 Jan 2006 15:04:05 -0700"
 
+// Metadata describes what a load test work is testing, to identify and filter its report.
+type Metadata struct {
+	// name of the test run (benchmarks name each of their tests instead)
+	TestName string `json:"test_name,omitempty"`
+	// <key=value> labels set by the user, meant to filter results
+	Labels []string `json:"labels,omitempty"`
+	// git branch, commit and pull request number being tested, as detected from CI environment variables
+	GitBranch   string `json:"git_branch,omitempty"`
+	GitCommit   string `json:"git_commit,omitempty"`
+	PullRequest string `json:"pull_request,omitempty"`
+}
+
 // Report holds performance statistics generated by a load test work.
 type Report struct {
 
@@ -20,10 +32,8 @@ type Report struct {
 	ReporterHost string `json:"reporter_host"`
 	// like reportDate, but better for querying ES and sorting
 	Timestamp time.Time `json:"@timestamp"`
-	// any arbitrary strings set by the user, meant to filter results
-	Labels []string `json:"labels,omitempty"`
-	// name of the test run
-	TestName string `json:"test_name,omitempty"`
+	// what is being tested, see Metadata
+	Metadata
 	// apm-server release version or build sha
 	ApmVersion string `json:"apm_version,omitempty"`
 	// commit SHA
@@ -43,6 +53,16 @@ type Report struct {
 	// number of total failed requests
 	FailedRequests uint64 `json:"failed_requests"`
 
+	// number of events generated but not sent, by reason:
+	// the Go agent buffer was full (apm-server not keeping up, or hey-apm generating too fast)
+	DroppedBufferFull uint64 `json:"dropped_buffer_full"`
+	// spans over the max spans per transaction
+	DroppedMaxSpans uint64 `json:"dropped_max_spans"`
+	// events in intake requests that failed
+	DroppedSendFailure uint64 `json:"dropped_send_failure"`
+	// events still buffered by the Go agent when flushing timed out
+	DroppedFlushTimeout uint64 `json:"dropped_flush_timeout"`
+
 	// TODO
 	// total number of responses
 	// Responses uint64 `json:"responses"`
@@ -87,9 +107,53 @@ type Report struct {
 	EventsSent uint64 `json:"events_sent"`
 	// total accepted
 	EventsAccepted uint64 `json:"events_accepted"`
+	// errors returned by apm-server, by reason
+	Rejections map[string]uint64 `json:"rejections,omitempty"`
+	// intake responses by status code, with 0 for failed requests
+	IntakeResponses map[int]uint64 `json:"intake_responses,omitempty"`
+	// intake requests, failed ones and events accepted by apm-server URL, when sending to several of them
+	TargetRequests       map[string]uint64 `json:"target_requests,omitempty"`
+	TargetFailedRequests map[string]uint64 `json:"target_failed_requests,omitempty"`
+	TargetEventsAccepted map[string]uint64 `json:"target_events_accepted,omitempty"`
+
+	// TLS handshakes made with apm-server, and their average duration in milliseconds
+	TLSHandshakes   uint64  `json:"tls_handshakes,omitempty"`
+	TLSHandshakeAvg float64 `json:"tls_handshake_avg,omitempty"`
+
+	// agent config requests, by response status code (0 for failed requests)
+	ConfigResponses map[int]uint64 `json:"config_responses,omitempty"`
+	// average and maximum time to get a response to agent config requests, in milliseconds
+	ConfigLatencyAvg float64 `json:"config_latency_avg,omitempty"`
+	ConfigLatencyMax float64 `json:"config_latency_max,omitempty"`
+
+	// number of RUM errors sent to and accepted by apm-server
+	RUMErrorsSent     uint64 `json:"rum_errors_sent,omitempty"`
+	RUMErrorsAccepted uint64 `json:"rum_errors_accepted,omitempty"`
+	// average and maximum time to get a response to RUM intake requests, in milliseconds
+	RUMLatencyAvg float64 `json:"rum_latency_avg,omitempty"`
+	RUMLatencyMax float64 `json:"rum_latency_max,omitempty"`
+
+	// number of intake requests sent by simulated agents of other languages, and of their events sent and accepted
+	SimulatedRequests       uint64 `json:"simulated_requests,omitempty"`
+	SimulatedEventsSent     uint64 `json:"simulated_events_sent,omitempty"`
+	SimulatedEventsAccepted uint64 `json:"simulated_events_accepted,omitempty"`
+	// events accepted by simulated agent name and version
+	SimulatedAgentsAccepted map[string]uint64 `json:"simulated_agents_accepted,omitempty"`
 	// total indexed
 	EventsIndexed uint64 `json:"events_indexed"`
 
+	// CPU time spent by hey-apm in seconds, and as a percentage of the CPU available to it
+	GeneratorCPU    float64 `json:"generator_cpu,omitempty"`
+	GeneratorCPUPct float64 `json:"generator_cpu_pct,omitempty"`
+	// peak resident set size of hey-apm in bytes, and heap at the end of the work
+	GeneratorMaxRSS    uint64 `json:"generator_max_rss,omitempty"`
+	GeneratorHeapAlloc uint64 `json:"generator_heap_alloc,omitempty"`
+	// number of GC runs in hey-apm, and their total pause time in milliseconds
+	GeneratorNumGC   uint32  `json:"generator_num_gc,omitempty"`
+	GeneratorGCPause float64 `json:"generator_gc_pause,omitempty"`
+	// reasons why hey-apm itself was likely the bottleneck, if any
+	GeneratorSaturation []string `json:"generator_saturation,omitempty"`
+
 	// total memory allocated in bytes
 	TotalAlloc *uint64 `json:"total_alloc,omitempty"`
 	// total memory allocated in the heap, in bytes
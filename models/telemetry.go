@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+)
+
+// Sample holds the rates of a load test work over an interval, so that throughput
+// can be charted over time. Samples of a work are stored along its report.
+type Sample struct {
+	// Elasticsearch doc id of the report
+	ReportId string `json:"report_id"`
+	// index of the worker, for reports merging the work of several ones
+	Instance int `json:"instance"`
+	// end of the interval
+	Timestamp time.Time `json:"@timestamp"`
+	// seconds since the work started, at the end of the interval
+	Elapsed float64 `json:"elapsed"`
+	// length of the interval in seconds
+	Interval float64 `json:"interval"`
+
+	// events generated per second
+	Generated float64 `json:"generated_per_second"`
+	// events sent to apm-server per second
+	Sent float64 `json:"sent_per_second"`
+	// events dropped by the Go agent per second
+	Dropped float64 `json:"dropped_per_second"`
+	// events accepted by apm-server per second
+	Accepted float64 `json:"accepted_per_second"`
+	// requests to apm-server per second
+	Requests float64 `json:"requests_per_second"`
+	// failed requests to apm-server per second
+	FailedRequests float64 `json:"failed_requests_per_second"`
+}
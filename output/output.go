@@ -0,0 +1,359 @@
+// Package output writes the final reports and results of runs in text, JSON or CSV.
+//
+// The JSON and CSV schemas are meant to be consumed by scripts: fields and columns may be added,
+// but are not renamed or removed without increasing SchemaVersion.
+package output
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/hey-apm/models"
+	"github.com/elastic/hey-apm/worker"
+)
+
+// SchemaVersion is the version of the JSON and CSV schemas.
+const SchemaVersion = 1
+
+const (
+	Text = "text"
+	JSON = "json"
+	CSV  = "csv"
+)
+
+// Formats are the supported output formats.
+var Formats = []string{Text, JSON, CSV}
+
+// Check returns an error if the format is not supported. An empty format means text.
+func Check(format string) error {
+	switch format {
+	case "", Text, JSON, CSV:
+		return nil
+	}
+	return errors.Errorf("unknown output format %q, expected one of %s", format, strings.Join(Formats, ", "))
+}
+
+// Document is the JSON output.
+type Document struct {
+	SchemaVersion int   `json:"schema_version"`
+	Runs          []Run `json:"runs"`
+}
+
+// Run holds the report and result of an instance, or of a benchmark test.
+type Run struct {
+	// Index of the instance or test
+	Index  int           `json:"index"`
+	Report models.Report `json:"report"`
+	Result Result        `json:"result"`
+
+	// text is the result as printed during runs
+	text string
+}
+
+// NewRun returns a run with the given index, report and result.
+func NewRun(index int, report models.Report, result worker.Result) Run {
+	return Run{Index: index, Report: report, Result: NewResult(result), text: result.String()}
+}
+
+// Result holds the stats of a worker, with a stable schema.
+type Result struct {
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	Flushed        time.Time `json:"flushed"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+
+	EventsGenerated     uint64 `json:"events_generated"`
+	EventsSent          uint64 `json:"events_sent"`
+	EventsAccepted      uint64 `json:"events_accepted"`
+	TransactionsSent    uint64 `json:"transactions_sent"`
+	TransactionsDropped uint64 `json:"transactions_dropped"`
+	SpansSent           uint64 `json:"spans_sent"`
+	SpansDropped        uint64 `json:"spans_dropped"`
+	ErrorsSent          uint64 `json:"errors_sent"`
+	ErrorsDropped       uint64 `json:"errors_dropped"`
+
+	// Events not sent, by reason
+	DroppedBufferFull   uint64 `json:"dropped_buffer_full"`
+	DroppedMaxSpans     uint64 `json:"dropped_max_spans"`
+	DroppedSendFailure  uint64 `json:"dropped_send_failure"`
+	DroppedFlushTimeout uint64 `json:"dropped_flush_timeout"`
+
+	Requests        uint64            `json:"requests"`
+	FailedRequests  uint64            `json:"failed_requests"`
+	IntakeResponses map[int]uint64    `json:"intake_responses,omitempty"`
+	IntakeLatency   Histogram         `json:"intake_latency"`
+	Rejections      map[string]uint64 `json:"rejections,omitempty"`
+	UniqueErrors    []string          `json:"unique_errors,omitempty"`
+	// Intake requests by apm-server URL, when sending to several of them
+	Targets map[string]Target `json:"targets,omitempty"`
+	// Intake requests of simulated agents of other languages, by name and version
+	SimulatedAgents map[string]SimulatedAgent `json:"simulated_agents,omitempty"`
+
+	SchedulerLagSeconds float64 `json:"scheduler_lag_seconds"`
+	Generator           Usage   `json:"generator"`
+
+	ConfigResponses    map[int]uint64 `json:"config_responses,omitempty"`
+	RUMRequests        uint64         `json:"rum_requests,omitempty"`
+	RUMEventsAccepted  uint64         `json:"rum_events_accepted,omitempty"`
+	TLSHandshakes      uint64         `json:"tls_handshakes,omitempty"`
+	TLSHandshakeErrors uint64         `json:"tls_handshake_errors,omitempty"`
+}
+
+// Histogram is a distribution of durations in seconds.
+type Histogram struct {
+	// Upper bounds of the buckets, the last bucket holds durations above the largest one
+	BucketsSeconds []float64 `json:"buckets_seconds"`
+	// Number of durations in each bucket, not cumulative
+	Counts     []uint64 `json:"counts"`
+	Count      uint64   `json:"count"`
+	SumSeconds float64  `json:"sum_seconds"`
+}
+
+// Target holds the stats of intake requests sent to a single apm-server.
+type Target struct {
+	Requests          uint64  `json:"requests"`
+	FailedRequests    uint64  `json:"failed_requests"`
+	EventsAccepted    uint64  `json:"events_accepted"`
+	LatencySumSeconds float64 `json:"latency_sum_seconds"`
+}
+
+// SimulatedAgent holds the stats of intake requests sent by a simulated agent.
+type SimulatedAgent struct {
+	Requests       uint64 `json:"requests"`
+	FailedRequests uint64 `json:"failed_requests"`
+	EventsSent     uint64 `json:"events_sent"`
+	EventsAccepted uint64 `json:"events_accepted"`
+}
+
+// Usage holds the resources used by hey-apm itself.
+type Usage struct {
+	CPUSeconds float64 `json:"cpu_seconds"`
+	// Share of the CPU available to hey-apm, from 0 to 1
+	CPUUtilization float64  `json:"cpu_utilization"`
+	CPUs           int      `json:"cpus"`
+	MaxRSS         uint64   `json:"max_rss,omitempty"`
+	HeapAlloc      uint64   `json:"heap_alloc"`
+	NumGC          uint32   `json:"num_gc"`
+	GCPauseSeconds float64  `json:"gc_pause_seconds"`
+	Saturation     []string `json:"saturation,omitempty"`
+}
+
+// NewResult returns the stats of a worker result.
+func NewResult(r worker.Result) Result {
+	bounds := make([]float64, len(worker.LatencyBuckets))
+	for i, bound := range worker.LatencyBuckets {
+		bounds[i] = bound.Seconds()
+	}
+	counts := r.IntakeLatency.Counts
+	if counts == nil {
+		counts = make([]uint64, len(bounds)+1)
+	}
+	drops := r.Drops()
+	var targets map[string]Target
+	if len(r.Targets) > 1 {
+		targets = make(map[string]Target, len(r.Targets))
+		for target, s := range r.Targets {
+			targets[target] = Target{
+				Requests:          s.Requests,
+				FailedRequests:    s.FailedRequests,
+				EventsAccepted:    s.EventsAccepted,
+				LatencySumSeconds: s.Latency.Seconds(),
+			}
+		}
+	}
+	var simulated map[string]SimulatedAgent
+	if len(r.SimulatedAgents) > 0 {
+		simulated = make(map[string]SimulatedAgent, len(r.SimulatedAgents))
+		for agent, s := range r.SimulatedAgents {
+			simulated[agent] = SimulatedAgent{
+				Requests:       s.Requests,
+				FailedRequests: s.FailedRequests,
+				EventsSent:     s.EventsSent,
+				EventsAccepted: s.EventsAccepted,
+			}
+		}
+	}
+	return Result{
+		Start:          r.Start,
+		End:            r.End,
+		Flushed:        r.Flushed,
+		ElapsedSeconds: r.ElapsedSeconds(),
+
+		EventsGenerated:     r.Generated,
+		EventsSent:          r.EventsSent(),
+		EventsAccepted:      r.EventsAccepted,
+		TransactionsSent:    r.TransactionsSent,
+		TransactionsDropped: r.TransactionsDropped,
+		SpansSent:           r.SpansSent,
+		SpansDropped:        r.SpansDropped,
+		ErrorsSent:          r.ErrorsSent,
+		ErrorsDropped:       r.ErrorsDropped,
+
+		DroppedBufferFull:   drops.BufferFull,
+		DroppedMaxSpans:     drops.MaxSpans,
+		DroppedSendFailure:  drops.SendFailure,
+		DroppedFlushTimeout: drops.FlushTimeout,
+
+		Requests:        r.NumRequests,
+		FailedRequests:  r.Errors.SendStream,
+		IntakeResponses: r.IntakeResponses,
+		IntakeLatency: Histogram{
+			BucketsSeconds: bounds,
+			Counts:         counts,
+			Count:          r.IntakeLatency.Count,
+			SumSeconds:     r.IntakeLatency.Sum.Seconds(),
+		},
+		Rejections:   r.Rejections,
+		UniqueErrors: r.UniqueErrors,
+		Targets:      targets,
+
+		SimulatedAgents: simulated,
+
+		SchedulerLagSeconds: r.SchedulerLag.Seconds(),
+		Generator: Usage{
+			CPUSeconds:     r.Usage.CPUTime.Seconds(),
+			CPUUtilization: r.CPUUtilization(),
+			CPUs:           r.Usage.CPUs,
+			MaxRSS:         r.Usage.MaxRSS,
+			HeapAlloc:      r.Usage.HeapAlloc,
+			NumGC:          r.Usage.NumGC,
+			GCPauseSeconds: r.Usage.GCPause.Seconds(),
+			Saturation:     r.Saturation(),
+		},
+
+		ConfigResponses:    r.ConfigResponses,
+		RUMRequests:        r.RUMRequests,
+		RUMEventsAccepted:  r.RUMEventsAccepted,
+		TLSHandshakes:      r.TLSHandshakes,
+		TLSHandshakeErrors: r.TLSHandshakeErrors,
+	}
+}
+
+// columns of the CSV output, one row per run.
+var columns = []struct {
+	name  string
+	value func(Run) string
+}{
+	{"index", func(r Run) string { return strconv.Itoa(r.Index) }},
+	{"report_id", func(r Run) string { return r.Report.ReportId }},
+	{"test_name", func(r Run) string { return r.Report.TestName }},
+	{"timestamp", func(r Run) string { return r.Report.Timestamp.Format(time.RFC3339) }},
+	{"labels", func(r Run) string { return strings.Join(r.Report.Labels, ",") }},
+	{"apm_version", func(r Run) string { return r.Report.ApmVersion }},
+	{"elapsed_seconds", func(r Run) string { return formatFloat(r.Result.ElapsedSeconds) }},
+	{"events_generated", func(r Run) string { return formatUint(r.Result.EventsGenerated) }},
+	{"events_sent", func(r Run) string { return formatUint(r.Result.EventsSent) }},
+	{"events_accepted", func(r Run) string { return formatUint(r.Result.EventsAccepted) }},
+	{"events_indexed", func(r Run) string { return formatUint(r.Report.EventsIndexed) }},
+	{"transactions_sent", func(r Run) string { return formatUint(r.Result.TransactionsSent) }},
+	{"transactions_dropped", func(r Run) string { return formatUint(r.Result.TransactionsDropped) }},
+	{"transactions_indexed", func(r Run) string { return formatUint(r.Report.TransactionsIndexed) }},
+	{"spans_sent", func(r Run) string { return formatUint(r.Result.SpansSent) }},
+	{"spans_dropped", func(r Run) string { return formatUint(r.Result.SpansDropped) }},
+	{"spans_indexed", func(r Run) string { return formatUint(r.Report.SpansIndexed) }},
+	{"errors_sent", func(r Run) string { return formatUint(r.Result.ErrorsSent) }},
+	{"errors_dropped", func(r Run) string { return formatUint(r.Result.ErrorsDropped) }},
+	{"errors_indexed", func(r Run) string { return formatUint(r.Report.ErrorsIndexed) }},
+	{"dropped_buffer_full", func(r Run) string { return formatUint(r.Result.DroppedBufferFull) }},
+	{"dropped_max_spans", func(r Run) string { return formatUint(r.Result.DroppedMaxSpans) }},
+	{"dropped_send_failure", func(r Run) string { return formatUint(r.Result.DroppedSendFailure) }},
+	{"dropped_flush_timeout", func(r Run) string { return formatUint(r.Result.DroppedFlushTimeout) }},
+	{"requests", func(r Run) string { return formatUint(r.Result.Requests) }},
+	{"failed_requests", func(r Run) string { return formatUint(r.Result.FailedRequests) }},
+	{"intake_latency_avg_seconds", func(r Run) string {
+		if r.Result.IntakeLatency.Count == 0 {
+			return ""
+		}
+		return formatFloat(r.Result.IntakeLatency.SumSeconds / float64(r.Result.IntakeLatency.Count))
+	}},
+	{"scheduler_lag_seconds", func(r Run) string { return formatFloat(r.Result.SchedulerLagSeconds) }},
+	{"generator_cpu_seconds", func(r Run) string { return formatFloat(r.Result.Generator.CPUSeconds) }},
+	{"generator_cpu_utilization", func(r Run) string { return formatFloat(r.Result.Generator.CPUUtilization) }},
+	{"generator_max_rss", func(r Run) string { return formatUint(r.Result.Generator.MaxRSS) }},
+	{"generator_saturation", func(r Run) string { return strings.Join(r.Result.Generator.Saturation, "; ") }},
+	{"apm_heap_alloc", func(r Run) string {
+		if r.Report.HeapAlloc == nil {
+			return ""
+		}
+		return formatUint(*r.Report.HeapAlloc)
+	}},
+}
+
+// Write writes runs to w in the given format.
+// Text shows results as printed during runs, while JSON and CSV also include reports.
+func Write(w io.Writer, format string, runs []Run) error {
+	switch format {
+	case "", Text:
+		for _, run := range runs {
+			if _, err := fmt.Fprintf(w, "--- Run %d\n%s\n", run.Index, run.text); err != nil {
+				return err
+			}
+		}
+		return nil
+	case JSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(Document{SchemaVersion: SchemaVersion, Runs: runs})
+	case CSV:
+		cw := csv.NewWriter(w)
+		header := make([]string, len(columns))
+		for i, c := range columns {
+			header[i] = c.name
+		}
+		cw.Write(header)
+		for _, run := range runs {
+			row := make([]string, len(columns))
+			for i, c := range columns {
+				row[i] = c.value(run)
+			}
+			cw.Write(row)
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return Check(format)
+}
+
+// Save writes the reports and results of runs in the output format and file of the input.
+// Nothing is written for text output to the standard output, as it is printed during runs.
+func Save(input models.Input, reports []models.Report, results []worker.Result) error {
+	if (input.Output == "" || input.Output == Text) && input.OutputFile == "" {
+		return nil
+	}
+	runs := make([]Run, len(reports))
+	for i := range reports {
+		var result worker.Result
+		if i < len(results) {
+			result = results[i]
+		}
+		runs[i] = NewRun(i, reports[i], result)
+	}
+	if input.OutputFile == "" {
+		return Write(os.Stdout, input.Output, runs)
+	}
+	f, err := os.Create(input.OutputFile)
+	if err != nil {
+		return errors.Wrap(err, "error creating output file")
+	}
+	if err := Write(f, input.Output, runs); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func formatUint(n uint64) string {
+	return strconv.FormatUint(n, 10)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
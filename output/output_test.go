@@ -0,0 +1,86 @@
+package output
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/hey-apm/models"
+	"github.com/elastic/hey-apm/worker"
+)
+
+func testRuns() []Run {
+	var result worker.Result
+	result.Start = time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	result.Flushed = result.Start.Add(2 * time.Second)
+	result.TransactionsSent = 10
+	result.SpansSent = 20
+	result.Generated = 31
+	result.IntakeLatency.Observe(200 * time.Millisecond)
+	result.IntakeLatency.Observe(400 * time.Millisecond)
+	report := models.Report{ReportId: "abc", Metadata: models.Metadata{TestName: "test"}}
+	report.TransactionsIndexed = 10
+	return []Run{NewRun(0, report, result), NewRun(1, models.Report{ReportId: "def"}, worker.Result{})}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, JSON, testRuns()))
+
+	var doc struct {
+		SchemaVersion int `json:"schema_version"`
+		Runs          []struct {
+			Index  int                    `json:"index"`
+			Report map[string]interface{} `json:"report"`
+			Result map[string]interface{} `json:"result"`
+		} `json:"runs"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+	assert.Equal(t, SchemaVersion, doc.SchemaVersion)
+	require.Len(t, doc.Runs, 2)
+	assert.Equal(t, 1, doc.Runs[1].Index)
+	assert.Equal(t, "abc", doc.Runs[0].Report["report_id"])
+	assert.Equal(t, 2.0, doc.Runs[0].Result["elapsed_seconds"])
+	assert.Equal(t, 30.0, doc.Runs[0].Result["events_sent"])
+	assert.Equal(t, 31.0, doc.Runs[0].Result["events_generated"])
+	latency := doc.Runs[0].Result["intake_latency"].(map[string]interface{})
+	assert.Equal(t, 2.0, latency["count"])
+	assert.Len(t, latency["counts"], len(worker.LatencyBuckets)+1)
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, CSV, testRuns()))
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	row := make(map[string]string)
+	for i, name := range rows[0] {
+		row[name] = rows[1][i]
+	}
+	assert.Equal(t, "abc", row["report_id"])
+	assert.Equal(t, "30", row["events_sent"])
+	assert.Equal(t, "10", row["transactions_indexed"])
+	assert.Equal(t, "0.3", row["intake_latency_avg_seconds"])
+	assert.Equal(t, "", rows[2][len(rows[2])-1])
+}
+
+func TestWriteText(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, Text, testRuns()))
+	assert.Contains(t, buf.String(), "--- Run 1\n")
+	assert.Contains(t, buf.String(), "transactions sent")
+}
+
+func TestCheck(t *testing.T) {
+	for _, format := range append(Formats, "") {
+		assert.NoError(t, Check(format))
+	}
+	assert.Error(t, Check("xml"))
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	apmtransport "go.elastic.co/apm/transport"
+)
+
+var (
+	// ErrUnauthorized is the cause of errors for requests with missing or invalid credentials.
+	ErrUnauthorized = errors.New("apm-server rejected the credentials, check the secret token or API key")
+	// ErrForbidden is the cause of errors for requests with credentials lacking the required privileges.
+	ErrForbidden = errors.New("apm-server credentials lack the required privileges")
+)
+
+// IsAuthError returns whether an error was caused by apm-server rejecting the credentials.
+func IsAuthError(err error) bool {
+	cause := errors.Cause(err)
+	return cause == ErrUnauthorized || cause == ErrForbidden
+}
+
+// Client sends requests to an apm-server, authenticated with an API key or a secret token,
+// or anonymously if neither is set. The API key takes precedence, as with Elastic APM agents.
+type Client struct {
+	// URL of the apm-server, eg. http://localhost:8200
+	URL string
+
+	secretToken string
+	apiKey      string
+	tlsConfig   *tls.Config
+	httpClient  *http.Client
+}
+
+// NewClient returns a client for the apm-server at the given URL.
+// tlsConfig may be nil to use the default TLS settings.
+func NewClient(serverURL, secretToken, apiKey string, tlsConfig *tls.Config) *Client {
+	httpClient := &http.Client{}
+	if tlsConfig != nil {
+		httpClient.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
+	}
+	return &Client{
+		URL:         serverURL,
+		secretToken: secretToken,
+		apiKey:      apiKey,
+		tlsConfig:   tlsConfig,
+		httpClient:  httpClient,
+	}
+}
+
+// NewClients returns a client for each of the apm-servers at the given URLs.
+func NewClients(serverURLs []string, secretToken, apiKey string, tlsConfig *tls.Config) []*Client {
+	clients := make([]*Client, len(serverURLs))
+	for i, serverURL := range serverURLs {
+		clients[i] = NewClient(serverURL, secretToken, apiKey, tlsConfig)
+	}
+	return clients
+}
+
+// WithTransport returns a copy of the client sending requests through the given round tripper.
+func (c *Client) WithTransport(roundTripper http.RoundTripper) *Client {
+	client := *c
+	client.httpClient = &http.Client{Transport: roundTripper}
+	return &client
+}
+
+// WithTimeout returns a copy of the client giving up on requests after the given timeout.
+func (c *Client) WithTimeout(timeout time.Duration) *Client {
+	client := *c
+	httpClient := *c.httpClient
+	httpClient.Timeout = timeout
+	client.httpClient = &httpClient
+	return &client
+}
+
+// Authorization returns the Authorization header sent with every request, or an empty string.
+func (c *Client) Authorization() string {
+	if c.apiKey != "" {
+		return "ApiKey " + c.apiKey
+	}
+	if c.secretToken != "" {
+		return "Bearer " + c.secretToken
+	}
+	return ""
+}
+
+// ConfigureTransport sets the URL, credentials and TLS settings of the client in a Go agent transport.
+func (c *Client) ConfigureTransport(transport *apmtransport.HTTPTransport) error {
+	if c.apiKey != "" {
+		transport.SetAPIKey(c.apiKey)
+	} else if c.secretToken != "" {
+		transport.SetSecretToken(c.secretToken)
+	}
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			return errors.Wrap(err, "invalid apm-server URL")
+		}
+		transport.SetServerURL(u)
+	}
+	if c.tlsConfig != nil {
+		transport.Client.Transport.(*http.Transport).TLSClientConfig = c.tlsConfig
+	}
+	return nil
+}
+
+// Do sends a request with the credentials of the client.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if authorization := c.Authorization(); authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return c.httpClient.Do(req)
+}
+
+// CheckResponse returns an error if the response status is not successful,
+// with ErrUnauthorized or ErrForbidden as cause if the credentials were rejected.
+// body is the response body, included in the error message.
+func CheckResponse(resp *http.Response, body []byte) error {
+	var err error
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized:
+		err = ErrUnauthorized
+	case resp.StatusCode == http.StatusForbidden:
+		err = ErrForbidden
+	default:
+		err = errors.New("server status not OK: " + resp.Status)
+	}
+	if body = bytes.TrimSpace(body); len(body) > 0 {
+		err = errors.Wrap(err, string(body))
+	}
+	return errors.Wrap(err, fmt.Sprintf("%s %s", resp.Request.Method, resp.Request.URL.Path))
+}
+
+// get sends a GET request to the given path, and returns the body of a successful response.
+func (c *Client) get(path string) ([]byte, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid apm-server URL")
+	}
+	u.Path = path
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return body, CheckResponse(resp, body)
+}
@@ -3,11 +3,8 @@ package server
 import (
 	"bytes"
 	"encoding/json"
-	errs "errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"net/url"
 	"strings"
 	"text/tabwriter"
@@ -26,11 +23,12 @@ type Status struct {
 	ErrorIndexCount       uint64
 }
 
-// GetStatus returns apm-server info and memory stats, plus elasticsearch counts of apm documents.
-func GetStatus(logger *log.Logger, secret, url string, connection es.Connection) Status {
+// GetStatus returns the memory stats of apm-servers, added up across all of them,
+// plus elasticsearch counts of apm documents.
+func GetStatus(logger *log.Logger, clients []*Client, connection es.Connection) Status {
 	status := Status{}
 
-	metrics, err := QueryExpvar(secret, url)
+	metrics, err := TotalExpvar(clients)
 	if err == nil {
 		status.Metrics = &metrics
 	} else {
@@ -69,6 +67,32 @@ type Memstats struct {
 	TotalAllocDiff uint64
 }
 
+// Add adds up the metrics of two apm-servers, keeping the command line of the first one.
+func (m ExpvarMetrics) Add(m2 ExpvarMetrics) ExpvarMetrics {
+	m.Memstats = Memstats{
+		TotalAlloc:     m.Memstats.TotalAlloc + m2.Memstats.TotalAlloc,
+		HeapAlloc:      m.Memstats.HeapAlloc + m2.Memstats.HeapAlloc,
+		Mallocs:        m.Memstats.Mallocs + m2.Memstats.Mallocs,
+		NumGC:          m.Memstats.NumGC + m2.Memstats.NumGC,
+		TotalAllocDiff: m.Memstats.TotalAllocDiff + m2.Memstats.TotalAllocDiff,
+	}
+	m.OutputEventsActive = addInt64(m.OutputEventsActive, m2.OutputEventsActive)
+	m.PipelineEventsActive = addInt64(m.PipelineEventsActive, m2.PipelineEventsActive)
+	return m
+}
+
+// addInt64 returns the sum of two optional values, nil if both are nil.
+func addInt64(a, b *int64) *int64 {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	sum := *a + *b
+	return &sum
+}
+
 // Sub subtracts some memory stats from another
 func (ms Memstats) Sub(ms2 Memstats) Memstats {
 	return Memstats{
@@ -122,9 +146,9 @@ func (cmd Cmdline) Parse() map[string]string {
 	return ret
 }
 
-// QueryInfo sends a request to an apm-server health-check endpoint and parses the result.
-func QueryInfo(secret, url string) (Info, error) {
-	body, err := request(secret, url)
+// Info sends a request to the apm-server health-check endpoint and parses the result.
+func (c *Client) Info() (Info, error) {
+	body, err := c.get("/")
 	info := Info{}
 	if err == nil {
 		err = json.Unmarshal(body, &info)
@@ -132,37 +156,37 @@ func QueryInfo(secret, url string) (Info, error) {
 	return info, err
 }
 
-// QueryExpvar sends a request to an apm-server /debug/vars endpoint and parses the result.
-func QueryExpvar(secret, raw string) (ExpvarMetrics, error) {
-	u, _ := url.Parse(raw)
-	u.Path = "/debug/vars"
-	body, err := request(secret, u.String())
-	metrics := ExpvarMetrics{}
-	if err == nil {
-		err = json.Unmarshal(body, &metrics)
+// TotalExpvar queries the metrics of every apm-server and adds them up.
+// It fails if any apm-server fails, as partial totals can't be compared.
+func TotalExpvar(clients []*Client) (ExpvarMetrics, error) {
+	var total ExpvarMetrics
+	for i, client := range clients {
+		metrics, err := client.Expvar()
+		if err != nil {
+			if u, perr := url.Parse(client.URL); perr == nil && len(clients) > 1 {
+				err = errors.Wrap(err, u.Host)
+			}
+			return ExpvarMetrics{}, err
+		}
+		if i == 0 {
+			total = metrics
+		} else {
+			total = total.Add(metrics)
+		}
 	}
-	return metrics, errors.Wrap(err, fmt.Sprintf("error querying %s, ensure to start apm-server"+
-		" with -E apm-server.expvar.enabled=true", u.Path))
+	return total, nil
 }
 
-func request(secret, url string) ([]byte, error) {
-	req, _ := http.NewRequest("GET", url, nil)
-	if secret != "" {
-		req.Header.Set("Authorization", "Beater "+secret)
-	}
-	req.Header.Set("Accept", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-
-	if err != nil {
-		return nil, err
+// Expvar sends a request to the apm-server /debug/vars endpoint and parses the result.
+func (c *Client) Expvar() (ExpvarMetrics, error) {
+	body, err := c.get("/debug/vars")
+	metrics := ExpvarMetrics{}
+	if err == nil {
+		err = json.Unmarshal(body, &metrics)
 	}
-	defer resp.Body.Close()
-
-	body, _ := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode >= 300 {
-		return body, errs.New("server status not OK: " + resp.Status)
+	if err != nil && !IsAuthError(err) {
+		err = errors.Wrap(err, "error querying /debug/vars, ensure to start apm-server"+
+			" with -E apm-server.expvar.enabled=true")
 	}
-	return body, err
+	return metrics, err
 }
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/elastic/hey-apm/es"
+	"github.com/elastic/hey-apm/models"
+)
+
+type elasticsearchStorage struct {
+	conn es.Connection
+}
+
+var (
+	setupMu   sync.Mutex
+	setupDone = make(map[string]bool)
+)
+
+// NewElasticsearch returns a storage that indexes reports in Elasticsearch, and their telemetry in a separate index.
+// The index templates and mappings are installed the first time a URL is used.
+func NewElasticsearch(conn es.Connection) (Storage, error) {
+	setupMu.Lock()
+	defer setupMu.Unlock()
+	if !setupDone[conn.Url] {
+		if err := es.EnsureReportIndex(conn); err != nil {
+			return nil, err
+		}
+		if err := es.EnsureTelemetryIndex(conn); err != nil {
+			return nil, err
+		}
+		setupDone[conn.Url] = true
+	}
+	return elasticsearchStorage{conn: conn}, nil
+}
+
+func (s elasticsearchStorage) IndexReport(report models.Report) error {
+	return es.IndexReport(s.conn, report)
+}
+
+func (s elasticsearchStorage) IndexTelemetry(samples []models.Sample) error {
+	return es.IndexTelemetry(s.conn, samples)
+}
+
+func (s elasticsearchStorage) FetchReports(query Query) ([]models.Report, error) {
+	filters := []map[string]interface{}{{
+		"range": map[string]interface{}{
+			"@timestamp": map[string]interface{}{
+				"gte": fmt.Sprintf("now-%dd/d", query.Days),
+				"lt":  "now",
+			},
+		},
+	}}
+	for k, v := range query.Fields {
+		filters = append(filters, map[string]interface{}{
+			"term": map[string]interface{}{k: v},
+		})
+	}
+	for _, label := range query.Labels {
+		filters = append(filters, map[string]interface{}{
+			"term": map[string]interface{}{"labels": label},
+		})
+	}
+	return es.FetchReports(s.conn, map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": filters,
+			},
+		},
+	})
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/hey-apm/models"
+)
+
+// reportsFile is the name of the file reports are appended to when the storage path is a directory.
+const reportsFile = "hey-bench.ndjson"
+
+// telemetrySuffix is added to the name of the reports file, before its extension,
+// to get the name of the file telemetry samples are appended to.
+const telemetrySuffix = "-telemetry"
+
+type fileStorage struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFile returns a storage that appends reports as JSON lines to a local file.
+// If path is a directory (or ends with a path separator), reports are appended
+// to a file named hey-bench.ndjson inside it.
+// Telemetry samples are appended to a file next to it, eg. hey-bench-telemetry.ndjson.
+func NewFile(path string) (Storage, error) {
+	info, err := os.Stat(path)
+	switch {
+	case err == nil && info.IsDir():
+		path = filepath.Join(path, reportsFile)
+	case os.IsNotExist(err) && strings.HasSuffix(path, string(os.PathSeparator)):
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return nil, err
+		}
+		path = filepath.Join(path, reportsFile)
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	}
+	return &fileStorage{path: path}, nil
+}
+
+func (s *fileStorage) IndexReport(report models.Report) error {
+	return s.appendLines(s.path, report)
+}
+
+func (s *fileStorage) IndexTelemetry(samples []models.Sample) error {
+	docs := make([]interface{}, len(samples))
+	for i, sample := range samples {
+		docs[i] = sample
+	}
+	return s.appendLines(telemetryPath(s.path), docs...)
+}
+
+// appendLines appends every document as a JSON line to the file at path.
+func (s *fileStorage) appendLines(path string, docs ...interface{}) error {
+	var buf bytes.Buffer
+	for _, doc := range docs {
+		line, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// telemetryPath returns the path of the telemetry file that goes with a reports file.
+func telemetryPath(reportsPath string) string {
+	ext := filepath.Ext(reportsPath)
+	return strings.TrimSuffix(reportsPath, ext) + telemetrySuffix + ext
+}
+
+func (s *fileStorage) FetchReports(query Query) ([]models.Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Decode the wanted values the same way as stored reports, so they compare equal.
+	var want map[string]interface{}
+	if encoded, err := json.Marshal(query.Fields); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(encoded, &want); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	since := now.UTC().AddDate(0, 0, -query.Days).Truncate(24 * time.Hour)
+
+	var reports []models.Report
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 10*1024*1024)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var report models.Report
+		var fields map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &report); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", s.path, lineno)
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", s.path, lineno)
+		}
+		if report.Timestamp.Before(since) || !report.Timestamp.Before(now) {
+			continue
+		}
+		if matchFields(fields, want) && hasLabels(report.Labels, query.Labels) {
+			reports = append(reports, report)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(reports, func(i, j int) bool {
+		return reports[i].Timestamp.After(reports[j].Timestamp)
+	})
+	return reports, nil
+}
+
+// matchFields returns true if all the wanted fields have the same value in doc.
+func matchFields(doc, want map[string]interface{}) bool {
+	for k, v := range want {
+		if !reflect.DeepEqual(doc[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasLabels returns true if all the wanted labels are in labels.
+func hasLabels(labels, want []string) bool {
+	for _, w := range want {
+		var found bool
+		for _, l := range labels {
+			if l == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
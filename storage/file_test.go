@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/hey-apm/models"
+)
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hey-apm")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewFile(dir)
+	require.NoError(t, err)
+
+	// Nothing saved yet.
+	reports, err := store.FetchReports(Query{Days: 1})
+	require.NoError(t, err)
+	assert.Empty(t, reports)
+
+	now := time.Now()
+	input := models.Input{ApmServerUrl: "http://localhost:8200", Instances: 1}
+	for _, r := range []models.Report{
+		{Input: input, ReportId: "old", Timestamp: now.AddDate(0, 0, -30)},
+		{Input: input, ReportId: "first", Timestamp: now.Add(-2 * time.Minute)},
+		{Input: input.WithSpans(10), ReportId: "other", Timestamp: now.Add(-time.Minute)},
+		{Input: input, ReportId: "second", Timestamp: now.Add(-time.Second)},
+	} {
+		require.NoError(t, store.IndexReport(r))
+	}
+	assert.FileExists(t, filepath.Join(dir, reportsFile))
+
+	reports, err = store.FetchReports(Query{
+		Fields: map[string]interface{}{"apm_url": "http://localhost:8200", "spans_generated_max_limit": 0},
+		Days:   7,
+	})
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+	assert.Equal(t, "second", reports[0].ReportId)
+	assert.Equal(t, "first", reports[1].ReportId)
+}
+
+func TestFileStorageTelemetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hey-apm")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewFile(filepath.Join(dir, "reports.json"))
+	require.NoError(t, err)
+	require.NoError(t, store.IndexTelemetry([]models.Sample{
+		{ReportId: "first", Elapsed: 1, Sent: 100},
+		{ReportId: "first", Elapsed: 2, Sent: 200},
+	}))
+	require.NoError(t, store.IndexTelemetry([]models.Sample{{ReportId: "second", Elapsed: 1}}))
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "reports-telemetry.json"))
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 3)
+	var sample models.Sample
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &sample))
+	assert.Equal(t, "first", sample.ReportId)
+	assert.Equal(t, float64(200), sample.Sent)
+}
@@ -0,0 +1,49 @@
+// Package storage saves performance reports and retrieves them for regression checks.
+package storage
+
+import (
+	"github.com/elastic/hey-apm/es"
+	"github.com/elastic/hey-apm/models"
+	"github.com/elastic/hey-apm/tlsconfig"
+)
+
+// Storage saves performance reports and retrieves previously saved ones.
+type Storage interface {
+	// IndexReport saves a performance report.
+	IndexReport(report models.Report) error
+	// IndexTelemetry saves the telemetry series of a report, whose id the samples hold.
+	IndexTelemetry(samples []models.Sample) error
+	// FetchReports returns the saved reports matching a query, most recent first.
+	FetchReports(query Query) ([]models.Report, error)
+}
+
+// Query selects saved reports.
+type Query struct {
+	// Fields maps JSON field names of a report to the values they must match.
+	Fields map[string]interface{}
+	// Labels that reports must have, along any others.
+	Labels []string
+	// Days is the number of days to look back, counting from the start of the current day (UTC).
+	Days int
+}
+
+// New returns the storage configured in the input: a local file if ReportPath is set,
+// otherwise Elasticsearch if ElasticsearchUrl or ElasticsearchCloudID is set.
+// It returns nil if neither is set.
+func New(input models.Input) (Storage, error) {
+	if input.ReportPath != "" {
+		return NewFile(input.ReportPath)
+	}
+	if input.ElasticsearchUrl != "" || input.ElasticsearchCloudID != "" {
+		tlsConfig, err := tlsconfig.New(input)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := es.NewConnection(es.ReportingConfig(input, tlsConfig))
+		if err != nil {
+			return nil, err
+		}
+		return NewElasticsearch(conn)
+	}
+	return nil, nil
+}
@@ -0,0 +1,46 @@
+// Package tlsconfig builds the TLS configuration shared by the apm-server and Elasticsearch clients.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/hey-apm/models"
+)
+
+// New returns a TLS configuration with the CA certificates, client certificate, server name
+// and verification settings of the input, or nil if none is set and defaults are fine.
+func New(input models.Input) (*tls.Config, error) {
+	if input.TLSCACert == "" && input.TLSClientCert == "" && input.TLSClientKey == "" &&
+		input.TLSServerName == "" && !input.TLSInsecure {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName:         input.TLSServerName,
+		InsecureSkipVerify: input.TLSInsecure,
+	}
+	if input.TLSCACert != "" {
+		pem, err := ioutil.ReadFile(input.TLSCACert)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading CA certificates")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no CA certificates found in %s", input.TLSCACert)
+		}
+	}
+	if input.TLSClientCert != "" || input.TLSClientKey != "" {
+		if input.TLSClientCert == "" || input.TLSClientKey == "" {
+			return nil, errors.New("both a client certificate and key are required for mutual TLS")
+		}
+		cert, err := tls.LoadX509KeyPair(input.TLSClientCert, input.TLSClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,92 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/elastic/hey-apm/server"
+)
+
+// defaultConfigPollInterval is how often Elastic APM agents poll their configuration when
+// apm-server doesn't say otherwise.
+const defaultConfigPollInterval = 30 * time.Second
+
+// configPollKey is the context key marking the agent config requests of simulated agents,
+// which are counted unlike those of the Go agent itself.
+type configPollKey struct{}
+
+// isConfigPoll returns true for agent config requests sent by a configPoller.
+func isConfigPoll(ctx context.Context) bool {
+	return ctx.Value(configPollKey{}) != nil
+}
+
+// configPoller simulates agents polling apm-server for their central configuration.
+type configPoller struct {
+	client      *server.Client
+	logger      *apmLogger
+	serviceName string
+	// number of simulated agents
+	agents int
+	// number of distinct service names, as many as agents if 0
+	services int
+	interval time.Duration
+}
+
+// run polls agent configuration until the context is cancelled.
+// Each simulated agent starts after a random delay, to spread polls over the interval.
+func (p configPoller) run(ctx context.Context) {
+	if p.interval <= 0 {
+		p.interval = defaultConfigPollInterval
+	}
+	if p.services <= 0 || p.services > p.agents {
+		p.services = p.agents
+	}
+	for i := 0; i < p.agents; i++ {
+		service := fmt.Sprintf("%s-%d", p.serviceName, i%p.services)
+		delay := time.Duration(rand.Int63n(int64(p.interval)))
+		go p.poll(ctx, service, delay)
+	}
+}
+
+// poll requests the configuration of a service periodically, sending the ETag of the last
+// configuration received in If-None-Match, like real agents do.
+func (p configPoller) poll(ctx context.Context, service string, delay time.Duration) {
+	u := strings.TrimSuffix(p.client.URL, "/") + "/config/v1/agents?service.name=" + url.QueryEscape(service)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	pollCtx := context.WithValue(ctx, configPollKey{}, true)
+	var etag string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			p.logger.Errorf("invalid agent config request: %s", err)
+			return
+		}
+		req = req.WithContext(pollCtx)
+		req.Header.Set("User-Agent", "hey-apm")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := p.client.Do(req)
+		if err == nil {
+			if resp.StatusCode == http.StatusOK {
+				etag = resp.Header.Get("Etag")
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		timer.Reset(p.interval)
+	}
+}
@@ -0,0 +1,48 @@
+package worker
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/hey-apm/fake"
+	"github.com/elastic/hey-apm/server"
+)
+
+func TestConfigPoller(t *testing.T) {
+	apmServer := fake.NewAPMServer(fake.APMServerConfig{})
+	defer apmServer.Close()
+	rt := testRoundTripper(t, apmServer.URL)
+	client := server.NewClient(apmServer.URL, "", "", nil).WithTransport(rt)
+
+	// polls of the Go agent itself aren't counted
+	req, err := http.NewRequest(http.MethodGet, apmServer.URL+"/config/v1/agents?service.name=hey-worker-test", nil)
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Empty(t, (&tracer{roundTripper: rt}).TransportStats().ConfigResponses)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	configPoller{
+		client:      client,
+		logger:      newApmLogger(log.New(ioutil.Discard, "", 0)),
+		serviceName: "hey-worker-test",
+		agents:      3,
+		interval:    20 * time.Millisecond,
+	}.run(ctx)
+	<-ctx.Done()
+
+	// the first poll of every agent gets the configuration, and later ones are told it didn't change
+	stats := (&tracer{roundTripper: rt}).TransportStats()
+	assert.True(t, stats.ConfigResponses[http.StatusOK] >= 3, stats.ConfigResponses)
+	assert.NotZero(t, stats.ConfigResponses[http.StatusNotModified])
+	assert.NotZero(t, stats.ConfigMaxLatency)
+}
@@ -0,0 +1,102 @@
+package worker
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Strategies to distribute requests across several apm-servers.
+const (
+	// strategyRoundRobin sends each request to the next apm-server in turn
+	strategyRoundRobin = "round-robin"
+	// strategyRandom sends each request to an apm-server picked at random
+	strategyRandom = "random"
+	// strategySticky sends all the requests of a service to the same apm-server
+	strategySticky = "sticky"
+)
+
+// balancer distributes requests built for the first of several apm-servers across all of them.
+// It is safe for concurrent use.
+type balancer struct {
+	targets  []*url.URL
+	names    []string
+	strategy string
+
+	next   uint64
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+// newBalancer returns a balancer across the given apm-server URLs with a strategy,
+// round-robin if empty.
+func newBalancer(urls []string, strategy string) (*balancer, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no apm-server URL")
+	}
+	switch strategy {
+	case "":
+		strategy = strategyRoundRobin
+	case strategyRoundRobin, strategyRandom, strategySticky:
+	default:
+		return nil, errors.Errorf("unknown load balancing strategy %q, must be one of %s, %s or %s",
+			strategy, strategyRoundRobin, strategyRandom, strategySticky)
+	}
+	b := &balancer{strategy: strategy, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid apm-server URL")
+		}
+		b.targets = append(b.targets, u)
+		// Credentials in URLs must not show up in stats
+		b.names = append(b.names, redactURL(raw))
+	}
+	return b, nil
+}
+
+// pick returns the index of the apm-server to send a request of the given service to.
+func (b *balancer) pick(service string) int {
+	n := len(b.targets)
+	if n == 1 {
+		return 0
+	}
+	switch b.strategy {
+	case strategyRandom:
+		b.randMu.Lock()
+		defer b.randMu.Unlock()
+		return b.rand.Intn(n)
+	case strategySticky:
+		h := fnv.New32a()
+		h.Write([]byte(service))
+		return int(h.Sum32() % uint32(n))
+	default:
+		return int((atomic.AddUint64(&b.next, 1) - 1) % uint64(n))
+	}
+}
+
+// route returns the request sent to the apm-server picked for the given service instead of the first one,
+// and the name of that apm-server.
+func (b *balancer) route(req *http.Request, service string) (*http.Request, string) {
+	i := b.pick(service)
+	if i == 0 {
+		return req, b.names[0]
+	}
+	target := b.targets[i]
+	u := *req.URL
+	u.Scheme, u.Host, u.User = target.Scheme, target.Host, target.User
+	// Paths are relative to the path of each apm-server URL, if any
+	u.Path = strings.TrimSuffix(target.Path, "/") +
+		strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(b.targets[0].Path, "/"))
+	u.RawPath = ""
+	routed := req.WithContext(req.Context())
+	routed.URL, routed.Host = &u, target.Host
+	return routed, b.names[i]
+}
@@ -0,0 +1,214 @@
+package worker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Faults injected in intake requests by chaos mode.
+const (
+	// FaultInvalidEvent replaces an event with one missing required fields.
+	FaultInvalidEvent = "invalid-event"
+	// FaultOversizedEvent replaces an event with one over the default apm-server max event size.
+	FaultOversizedEvent = "oversized-event"
+	// FaultTruncatedEvent cuts an event in half, leaving invalid JSON.
+	FaultTruncatedEvent = "truncated-event"
+	// FaultBadMetadata replaces the metadata of a request, so that all its events are rejected.
+	FaultBadMetadata = "bad-metadata"
+	// FaultContentType sends a request with an unsupported content type.
+	FaultContentType = "content-type"
+)
+
+// Faults lists all the faults chaos mode can inject.
+var Faults = []string{FaultInvalidEvent, FaultOversizedEvent, FaultTruncatedEvent, FaultBadMetadata, FaultContentType}
+
+// oversizedEventSize is larger than the default apm-server max_event_size of 300KiB.
+const oversizedEventSize = 400 * 1024
+
+var (
+	oversizedEventOnce sync.Once
+	oversizedEvent     []byte
+)
+
+// chaos corrupts intake requests on purpose, so that apm-server rejects some or all of their events.
+type chaos struct {
+	rate          float64
+	eventFaults   []string
+	requestFaults []string
+}
+
+// newChaos returns a chaos injecting the given faults in the given fraction of events and requests,
+// or nil if rate is 0. All faults are injected if none are given.
+func newChaos(rate float64, faults []string) (*chaos, error) {
+	if rate <= 0 {
+		return nil, nil
+	}
+	if rate > 1 {
+		return nil, fmt.Errorf("chaos rate must be between 0 and 1, got %v", rate)
+	}
+	if len(faults) == 0 {
+		faults = Faults
+	}
+	c := &chaos{rate: rate}
+	for _, f := range faults {
+		switch f {
+		case FaultInvalidEvent, FaultOversizedEvent, FaultTruncatedEvent:
+			c.eventFaults = append(c.eventFaults, f)
+		case FaultBadMetadata, FaultContentType:
+			c.requestFaults = append(c.requestFaults, f)
+		default:
+			return nil, fmt.Errorf("unknown chaos fault %q, expected one of %s", f, strings.Join(Faults, ", "))
+		}
+	}
+	return c, nil
+}
+
+// mutate returns a copy of an intake request with faults injected.
+// The original request body is consumed and closed.
+func (c *chaos) mutate(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	data, err := readRequestBody(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading intake request")
+	}
+	req = req.Clone(req.Context())
+
+	lines := bytes.Split(data, []byte("\n"))
+	if len(c.requestFaults) > 0 && rand.Float64() < c.rate {
+		switch c.requestFaults[rand.Intn(len(c.requestFaults))] {
+		case FaultBadMetadata:
+			lines[0] = []byte(`{"metadata":{"service":{"name":true}}}`)
+		case FaultContentType:
+			req.Header.Set("Content-Type", "text/plain")
+		}
+	}
+	for i := 1; i < len(lines) && len(c.eventFaults) > 0; i++ {
+		if len(lines[i]) == 0 || rand.Float64() >= c.rate {
+			continue
+		}
+		switch c.eventFaults[rand.Intn(len(c.eventFaults))] {
+		case FaultInvalidEvent:
+			lines[i] = invalidEvent(lines[i])
+		case FaultOversizedEvent:
+			oversizedEventOnce.Do(func() {
+				oversizedEvent = []byte(fmt.Sprintf(`{"error":{"id":"0123456789abcdef","log":{"message":"%s"}}}`,
+					strings.Repeat("x", oversizedEventSize)))
+			})
+			lines[i] = oversizedEvent
+		case FaultTruncatedEvent:
+			lines[i] = lines[i][:len(lines[i])/2]
+		}
+	}
+
+	body, err := encodeRequestBody(req.Header.Get("Content-Encoding"), bytes.Join(lines, []byte("\n")))
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+	return req, nil
+}
+
+// invalidEvent returns an event of the same type as the given one, without any of its required fields.
+func invalidEvent(line []byte) []byte {
+	var event map[string]json.RawMessage
+	json.Unmarshal(line, &event)
+	eventType := "transaction"
+	for k := range event {
+		eventType = k
+	}
+	return []byte(fmt.Sprintf(`{%q:{"chaos":true}}`, eventType))
+}
+
+func readRequestBody(req *http.Request) ([]byte, error) {
+	defer req.Body.Close()
+	var r io.Reader = req.Body
+	switch req.Header.Get("Content-Encoding") {
+	case "deflate":
+		zr, err := zlib.NewReader(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	case "gzip":
+		gr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	}
+	return ioutil.ReadAll(r)
+}
+
+func encodeRequestBody(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	default:
+		return data, nil
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// rejectionReason classifies an error message returned by apm-server.
+func rejectionReason(message string) string {
+	m := strings.ToLower(message)
+	switch {
+	case strings.Contains(m, "metadata"):
+		return "invalid_metadata"
+	case strings.Contains(m, "content type"):
+		return "invalid_content_type"
+	case strings.Contains(m, "permitted size") || strings.Contains(m, "too large"):
+		return "event_too_large"
+	case strings.Contains(m, "decod") || strings.Contains(m, "invalid character") ||
+		strings.Contains(m, "unexpected end") || strings.Contains(m, "invalid json"):
+		return "invalid_json"
+	case strings.Contains(m, "validat"):
+		return "invalid_event"
+	case strings.Contains(m, "queue is full"):
+		return "queue_full"
+	case strings.Contains(m, "rate limit") || strings.Contains(m, "too many requests"):
+		return "rate_limited"
+	case strings.Contains(m, "unauthorized") || strings.Contains(m, "authoriz") || strings.Contains(m, "forbidden"):
+		return "unauthorized"
+	}
+	return "other"
+}
+
+// sortedKeys returns the keys of a map in alphabetical order.
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
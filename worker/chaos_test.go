@@ -0,0 +1,93 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChaos(t *testing.T) {
+	_, err := newChaos(0.1, []string{"nope"})
+	assert.Error(t, err)
+	_, err = newChaos(2, nil)
+	assert.Error(t, err)
+	c, err := newChaos(0, []string{FaultInvalidEvent})
+	require.NoError(t, err)
+	assert.Nil(t, c)
+
+	const (
+		metadata    = `{"metadata":{"service":{"name":"svc"}}}`
+		transaction = `{"transaction":{"id":"1","trace_id":"2"}}`
+		apmError    = `{"error":{"id":"3"}}`
+	)
+	body := encodeRequestBodyOrFail(t, metadata+"\n"+transaction+"\n"+apmError+"\n")
+	// mutate returns the request with the given fault injected in everything it can be, and the lines of its body
+	mutate := func(fault string) (*http.Request, []string) {
+		req, err := http.NewRequest(http.MethodPost, "http://apm-server/intake/v2/events", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Encoding", "deflate")
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		c, err := newChaos(1, []string{fault})
+		require.NoError(t, err)
+		mutated, err := c.mutate(req)
+		require.NoError(t, err)
+		assert.Equal(t, "application/x-ndjson", req.Header.Get("Content-Type"))
+
+		raw, err := mutated.GetBody()
+		require.NoError(t, err)
+		encoded, err := ioutil.ReadAll(raw)
+		require.NoError(t, err)
+		assert.Equal(t, mutated.ContentLength, int64(len(encoded)))
+		data, err := readRequestBody(mutated)
+		require.NoError(t, err)
+		return mutated, strings.Split(string(data), "\n")
+	}
+
+	_, lines := mutate(FaultInvalidEvent)
+	assert.Equal(t, []string{metadata, `{"transaction":{"chaos":true}}`, `{"error":{"chaos":true}}`, ""}, lines)
+
+	_, lines = mutate(FaultOversizedEvent)
+	assert.Equal(t, metadata, lines[0])
+	assert.True(t, len(lines[1]) > oversizedEventSize)
+	assert.True(t, json.Valid([]byte(lines[1])))
+
+	_, lines = mutate(FaultTruncatedEvent)
+	assert.Equal(t, transaction[:len(transaction)/2], lines[1])
+	assert.Equal(t, apmError[:len(apmError)/2], lines[2])
+
+	_, lines = mutate(FaultBadMetadata)
+	assert.Equal(t, []string{`{"metadata":{"service":{"name":true}}}`, transaction, apmError, ""}, lines)
+
+	req, lines := mutate(FaultContentType)
+	assert.Equal(t, "text/plain", req.Header.Get("Content-Type"))
+	assert.Equal(t, []string{metadata, transaction, apmError, ""}, lines)
+}
+
+// encodeRequestBodyOrFail returns data compressed as the Go agent sends it.
+func encodeRequestBodyOrFail(t *testing.T, data string) []byte {
+	body, err := encodeRequestBody("deflate", []byte(data))
+	require.NoError(t, err)
+	return body
+}
+
+func TestRejectionReason(t *testing.T) {
+	for message, reason := range map[string]string{
+		"failed to validate event: rejected by fake apm-server":      "invalid_event",
+		"failed to validate metadata: service name must be a string": "invalid_metadata",
+		"invalid content type: 'text/plain'":                         "invalid_content_type",
+		"event exceeded the permitted size":                          "event_too_large",
+		"data read error: invalid character 'x' looking for value":   "invalid_json",
+		"queue is full":     "queue_full",
+		"too many requests": "rate_limited",
+		"unauthorized: missing or invalid credentials": "unauthorized",
+		"something else went wrong":                    "other",
+	} {
+		assert.Equal(t, reason, rejectionReason(message), message)
+	}
+}
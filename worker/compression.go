@@ -0,0 +1,62 @@
+package worker
+
+import (
+	"compress/zlib"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// noCompression is the compression level to send intake requests uncompressed.
+const noCompression = -1
+
+// checkCompressionLevel returns an error if level is not 0 (the Go agent default), noCompression,
+// or a zlib level from 1 to 9.
+func checkCompressionLevel(level int) error {
+	if level < noCompression || level > zlib.BestCompression {
+		return errors.Errorf("invalid compression level %d, expected 1 to 9, or -1 for no compression", level)
+	}
+	return nil
+}
+
+// recompress returns a request with the deflate encoded body of the given one encoded again
+// with a compression level, or not encoded at all with noCompression, as it is sent.
+// The Go agent always compresses intake requests with zlib.BestSpeed, so every other level
+// inflates and deflates again the whole body of every request, and the agent request size
+// still applies to the body as compressed by the agent.
+func recompress(req *http.Request, level int) *http.Request {
+	if level == zlib.BestSpeed || req.Body == nil || req.Body == http.NoBody || req.Header.Get("Content-Encoding") != "deflate" {
+		return req
+	}
+	body := req.Body
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		zr, err := zlib.NewReader(body)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if level == noCompression {
+			_, err = io.Copy(pw, zr)
+			pw.CloseWithError(err)
+			return
+		}
+		zw, _ := zlib.NewWriterLevel(pw, level)
+		if _, err := io.Copy(zw, zr); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(zw.Close())
+	}()
+
+	req = req.Clone(req.Context())
+	req.Body = pr
+	req.GetBody = nil
+	req.ContentLength = -1
+	if level == noCompression {
+		req.Header.Del("Content-Encoding")
+	}
+	return req
+}
@@ -0,0 +1,55 @@
+package worker
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecompress(t *testing.T) {
+	payload := strings.Repeat(`{"transaction":{"id":"abc"}}`+"\n", 1000)
+	var compressed bytes.Buffer
+	zw, _ := zlib.NewWriterLevel(&compressed, zlib.BestSpeed)
+	zw.Write([]byte(payload))
+	zw.Close()
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest(http.MethodPost, "http://apm-server/intake/v2/events", bytes.NewReader(compressed.Bytes()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Encoding", "deflate")
+		return req
+	}
+
+	// the agent already compresses with the best speed
+	req := newRequest()
+	assert.Equal(t, req, recompress(req, zlib.BestSpeed))
+
+	req = recompress(newRequest(), zlib.BestCompression)
+	assert.Equal(t, "deflate", req.Header.Get("Content-Encoding"))
+	assert.Equal(t, int64(-1), req.ContentLength)
+	body, err := ioutil.ReadAll(req.Body)
+	require.NoError(t, err)
+	zr, err := zlib.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	decoded, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(decoded))
+
+	req = recompress(newRequest(), noCompression)
+	assert.Empty(t, req.Header.Get("Content-Encoding"))
+	body, err = ioutil.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(body))
+
+	// bodies that can't be decoded fail the request
+	req = newRequest()
+	req.Body = ioutil.NopCloser(strings.NewReader("not deflate"))
+	_, err = io.Copy(ioutil.Discard, recompress(req, noCompression).Body)
+	assert.Error(t, err)
+}
@@ -0,0 +1,160 @@
+package worker
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Rates holds the frequencies at which workers generate events.
+// Zero values leave the corresponding frequency unchanged, others start generators disabled with a zero frequency.
+type Rates struct {
+	TransactionFrequency time.Duration `json:"transaction_generation_frequency,omitempty"`
+	ErrorFrequency       time.Duration `json:"error_generation_frequency,omitempty"`
+}
+
+// Control stops and adjusts running workers, and captures their stats while they run.
+// A Control can be shared by several workers, and can't be reused once stopped.
+type Control struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu      sync.RWMutex
+	workers []*controlled
+	// number of workers that finished, and channels to close once enough of them did
+	finished int
+	waiters  []finishedWaiter
+}
+
+// finishedWaiter is a channel to close once n workers finished.
+type finishedWaiter struct {
+	n int
+	c chan struct{}
+}
+
+// controlled is a worker attached to a Control.
+type controlled struct {
+	rates chan Rates
+	stats func() Result
+	final *Result
+	// whether the worker generated as many transactions and errors as its limits allow, accessed atomically
+	transactionsExhausted, errorsExhausted int32
+}
+
+// NewControl returns a new Control with no workers attached.
+func NewControl() *Control {
+	return &Control{stop: make(chan struct{})}
+}
+
+// Stop signals all workers to stop gracefully, flushing their events and reporting their results.
+func (c *Control) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// SetRates changes the event generation frequencies of all running workers.
+// Generators that reached their limit can't be restarted: if a running worker has one
+// for a frequency given, it returns an error and no frequency is changed.
+func (c *Control) SetRates(rates Rates) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range c.workers {
+		if w.final != nil {
+			continue
+		}
+		if rates.TransactionFrequency > 0 && atomic.LoadInt32(&w.transactionsExhausted) == 1 {
+			return errors.New("transaction generation limit reached, its frequency can't be changed")
+		}
+		if rates.ErrorFrequency > 0 && atomic.LoadInt32(&w.errorsExhausted) == 1 {
+			return errors.New("error generation limit reached, its frequency can't be changed")
+		}
+	}
+	for _, w := range c.workers {
+		// Only the latest rates matter, discard any not yet applied.
+		select {
+		case <-w.rates:
+		default:
+		}
+		w.rates <- rates
+	}
+	return nil
+}
+
+// Stats returns the stats of every worker attached so far, in the order they started.
+// Stats of finished workers are final.
+func (c *Control) Stats() []Result {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	results := make([]Result, len(c.workers))
+	for i, w := range c.workers {
+		if w.final != nil {
+			results[i] = *w.final
+		} else {
+			results[i] = w.stats()
+		}
+	}
+	return results
+}
+
+// attach registers a running worker. Attaching to a nil Control is a no-op.
+func (c *Control) attach(w *controlled) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.workers = append(c.workers, w)
+}
+
+// exhausted records that a worker generated as many transactions or errors as its limits allow.
+func (w *controlled) exhausted(transactions, errs bool) {
+	if transactions {
+		atomic.StoreInt32(&w.transactionsExhausted, 1)
+	}
+	if errs {
+		atomic.StoreInt32(&w.errorsExhausted, 1)
+	}
+}
+
+// Finished returns a channel closed once n workers attached to the control finished,
+// which may be before they return as their results are final.
+func (c *Control) Finished(n int) <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan struct{})
+	if c.finished >= n {
+		close(ch)
+	} else {
+		c.waiters = append(c.waiters, finishedWaiter{n: n, c: ch})
+	}
+	return ch
+}
+
+// finish records the final result of a worker.
+func (c *Control) finish(w *controlled, result Result) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.final = &result
+	c.finished++
+	waiting := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if c.finished >= waiter.n {
+			close(waiter.c)
+		} else {
+			waiting = append(waiting, waiter)
+		}
+	}
+	c.waiters = waiting
+}
+
+// stopped returns a channel closed when the Control is stopped, or nil for a nil Control.
+func (c *Control) stopped() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	return c.stop
+}
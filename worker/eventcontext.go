@@ -0,0 +1,211 @@
+package worker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.elastic.co/apm"
+)
+
+// contextLevel is how detailed the context of generated transactions and spans is.
+type contextLevel int
+
+const (
+	// contextMinimal only sets a tag on transactions and a destination service on spans
+	contextMinimal contextLevel = iota
+	// contextBasic adds HTTP request and response to transactions, a few labels,
+	// and database, HTTP client or messaging context to spans
+	contextBasic
+	// contextFull adds headers, cookies, body, user and custom context and many labels to transactions,
+	// and long statements, labels and deep stack traces to spans
+	contextFull
+)
+
+// ContextLevels are the names of the context levels, from the least to the most detailed.
+var ContextLevels = []string{"minimal", "basic", "full"}
+
+const (
+	// basicLabels and fullLabels are the number of labels of transactions at each level
+	basicLabels = 5
+	fullLabels  = 50
+	// spanStackDepth is how many more frames are on the stack when ending spans at the full level
+	spanStackDepth = 30
+)
+
+// newContextLevel returns the context level with the given name, minimal if empty.
+func newContextLevel(name string) (contextLevel, error) {
+	if name == "" {
+		return contextMinimal, nil
+	}
+	for i, level := range ContextLevels {
+		if name == level {
+			return contextLevel(i), nil
+		}
+	}
+	return contextMinimal, errors.Errorf("unknown context level %q, must be one of %s",
+		name, strings.Join(ContextLevels, ", "))
+}
+
+// setTransactionContext sets the context of a transaction according to the level.
+func (l contextLevel) setTransactionContext(tracer *apm.Tracer, tx *apm.Transaction) {
+	if l < contextBasic {
+		return
+	}
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Scheme: "http", Host: "hey-apm.local", Path: "/users/42", RawQuery: "page=1&size=20"},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Host:       "hey-apm.local",
+		RemoteAddr: "10.0.0.1:54321",
+		Header: http.Header{
+			"User-Agent": {"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/92.0.4515.159 Safari/537.36"},
+			"Accept":     {"application/json"},
+		},
+	}
+	labels := basicLabels
+	if l >= contextFull {
+		req.Method = http.MethodPost
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+		req.Header.Set("Accept-Language", "en-US,en;q=0.9,fr;q=0.8")
+		req.Header.Set("Cache-Control", "no-cache")
+		req.Header.Set("Origin", "http://hey-apm.local")
+		req.Header.Set("Referer", "http://hey-apm.local/users?page=1")
+		req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+		req.Header.Set("X-Request-Id", fmt.Sprintf("%016x", tx.TraceContext().Span))
+		req.Header.Set("Traceparent", fmt.Sprintf("00-%s-%s-01", tx.TraceContext().Trace, tx.TraceContext().Span))
+		req.Header.Set("Cookie", "session_id=3f1c2a9b7e6d5c4b; theme=dark; locale=en_US; ab_test=variant-b; consent=analytics,marketing")
+		body := `{"name":"Jane Doe","email":"jane@hey-apm.local","roles":["admin","editor"],"preferences":{"newsletter":true,"theme":"dark"}}`
+		req.Body = ioutil.NopCloser(strings.NewReader(body))
+		req.ContentLength = int64(len(body))
+		if bc := tracer.CaptureHTTPRequestBody(req); bc != nil {
+			tx.Context.SetHTTPRequestBody(bc)
+			defer bc.Discard()
+		}
+		labels = fullLabels
+	}
+	tx.Context.SetHTTPRequest(req)
+	tx.Context.SetHTTPStatusCode(http.StatusOK)
+	tx.Result = "HTTP 2xx"
+
+	for i := 0; i < labels; i++ {
+		key := fmt.Sprintf("label_%d", i)
+		switch i % 3 {
+		case 0:
+			tx.Context.SetLabel(key, fmt.Sprintf("value-%d", i))
+		case 1:
+			tx.Context.SetLabel(key, i)
+		default:
+			tx.Context.SetLabel(key, i%2 == 0)
+		}
+	}
+	if l < contextFull {
+		return
+	}
+
+	tx.Context.SetHTTPResponseHeaders(http.Header{
+		"Content-Type":              {"application/json; charset=utf-8"},
+		"Content-Length":            {"1024"},
+		"Cache-Control":             {"private, max-age=0"},
+		"Set-Cookie":                {"session_id=3f1c2a9b7e6d5c4b; Path=/; HttpOnly"},
+		"Strict-Transport-Security": {"max-age=31536000"},
+		"X-Content-Type-Options":    {"nosniff"},
+		"X-Frame-Options":           {"DENY"},
+		"Vary":                      {"Accept-Encoding"},
+	})
+	tx.Context.SetUserID("42")
+	tx.Context.SetUserEmail("jane@hey-apm.local")
+	tx.Context.SetUsername("jane")
+	tx.Context.SetCustom("cart", map[string]interface{}{
+		"id":       "c-8f14e45f",
+		"items":    3,
+		"total":    129.97,
+		"currency": "EUR",
+		"coupons":  []string{"WELCOME10"},
+	})
+	tx.Context.SetCustom("feature_flags", map[string]interface{}{
+		"new_checkout": true,
+		"dark_mode":    true,
+		"beta_search":  false,
+	})
+	tx.Context.SetCustom("tenant", "acme-corp")
+}
+
+// setSpanContext sets the context of the i-th span of a transaction according to the level,
+// making it a database, HTTP client or messaging span in turn.
+func (l contextLevel) setSpanContext(span *apm.Span, i int) {
+	if l < contextBasic {
+		return
+	}
+	switch i % 3 {
+	case 0:
+		span.Name, span.Type, span.Subtype, span.Action = "SELECT FROM users", "db", "postgresql", "query"
+		statement := "SELECT * FROM users WHERE id = $1"
+		if l >= contextFull {
+			statement = "SELECT u.id, u.name, u.email, u.created_at, r.name AS role, count(o.id) AS orders\n" +
+				"FROM users u\n" +
+				"JOIN user_roles ur ON ur.user_id = u.id\n" +
+				"JOIN roles r ON r.id = ur.role_id\n" +
+				"LEFT JOIN orders o ON o.user_id = u.id AND o.created_at > now() - interval '30 days'\n" +
+				"WHERE u.id = $1 AND u.deleted_at IS NULL\n" +
+				"GROUP BY u.id, u.name, u.email, u.created_at, r.name\n" +
+				"ORDER BY orders DESC LIMIT 20"
+			span.Context.SetDatabaseRowsAffected(20)
+		}
+		span.Context.SetDatabase(apm.DatabaseSpanContext{
+			Instance:  "users",
+			Statement: statement,
+			Type:      "sql",
+			User:      "hey",
+		})
+		span.Context.SetDestinationAddress("postgres.hey-apm.local", 5432)
+	case 1:
+		span.Name, span.Type, span.Subtype, span.Action = "GET inventory.hey-apm.local", "external", "http", ""
+		req := &http.Request{
+			Method: http.MethodGet,
+			URL:    &url.URL{Scheme: "http", Host: "inventory.hey-apm.local:8080", Path: "/api/items", RawQuery: "user=42"},
+		}
+		span.Context.SetHTTPRequest(req)
+		span.Context.SetHTTPStatusCode(http.StatusOK)
+	default:
+		// The Go agent doesn't support message context, the queue is only in the destination
+		span.Name, span.Type, span.Subtype, span.Action = "Kafka SEND to orders", "messaging", "kafka", "send"
+		span.Context.SetDestinationAddress("kafka.hey-apm.local", 9092)
+		span.Context.SetDestinationService(apm.DestinationServiceSpanContext{
+			Name:     "kafka",
+			Resource: "kafka/orders",
+		})
+	}
+	if l >= contextFull {
+		span.Context.SetLabel("tier", "backend")
+		span.Context.SetLabel("retry", i%2)
+		span.Context.SetLabel("cached", i%2 == 0)
+		span.Context.SetLabel("region", "eu-west-1")
+		span.Context.SetLabel("shard", fmt.Sprintf("shard-%d", i%4))
+	}
+}
+
+// endSpan ends a span, with as many more frames on the stack as instrumented applications have
+// at the full level, so that its stack trace is as deep as theirs.
+func (l contextLevel) endSpan(span *apm.Span) {
+	if l < contextFull {
+		span.End()
+		return
+	}
+	withStackDepth(spanStackDepth, span.End)
+}
+
+// withStackDepth calls f with n more frames on the stack.
+func withStackDepth(n int, f func()) {
+	if n <= 0 {
+		f()
+		return
+	}
+	withStackDepth(n-1, f)
+}
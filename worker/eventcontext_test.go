@@ -0,0 +1,52 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestContextLevels(t *testing.T) {
+	for i, name := range ContextLevels {
+		level, err := newContextLevel(name)
+		require.NoError(t, err)
+		assert.Equal(t, contextLevel(i), level)
+	}
+	_, err := newContextLevel("verbose")
+	assert.Error(t, err)
+
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	tracer.SetSpanFramesMinDuration(time.Nanosecond)
+	tracer.SetCaptureBody(apm.CaptureBodyTransactions)
+
+	tx := tracer.StartTransaction("tx", "test")
+	sendSpans(tx, 3, contextFull)
+	contextFull.setTransactionContext(tracer, tx)
+	tx.End()
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+
+	require.Len(t, payloads.Transactions, 1)
+	context := payloads.Transactions[0].Context
+	require.NotNil(t, context.Request)
+	assert.NotNil(t, context.Request.Body)
+	assert.NotEmpty(t, context.Request.Cookies)
+	assert.NotEmpty(t, context.Response.Headers)
+	assert.Equal(t, "jane@hey-apm.local", context.User.Email)
+	assert.NotEmpty(t, context.Custom)
+	assert.Len(t, context.Tags, fullLabels)
+
+	require.Len(t, payloads.Spans, 3)
+	assert.Contains(t, payloads.Spans[0].Context.Database.Statement, "JOIN")
+	assert.Equal(t, "inventory.hey-apm.local", payloads.Spans[1].Context.HTTP.URL.Hostname())
+	assert.Equal(t, "messaging", payloads.Spans[2].Type)
+	assert.Equal(t, "kafka/orders", payloads.Spans[2].Context.Destination.Service.Resource)
+	for _, span := range payloads.Spans {
+		assert.True(t, len(span.Stacktrace) > spanStackDepth)
+	}
+}
@@ -0,0 +1,126 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"sync"
+)
+
+// bodyRecorder wraps the body of an intake request, to keep it as it is sent without decoding it.
+// The Go agent doesn't know about the events in failed requests, which are lost,
+// so only the bodies of failed requests are decoded to count them.
+type bodyRecorder struct {
+	io.ReadCloser
+	encoding string
+
+	mu sync.Mutex
+	// buf holds the body read so far, nil once released
+	buf *bytes.Buffer
+	// done is true once the body is closed or read to the end
+	done bool
+	// failed is called with the number of events in the body of a failed request, once done
+	failed func(events uint64)
+}
+
+// newBodyRecorder returns a recorder of body, encoded with the given Content-Encoding.
+func newBodyRecorder(body io.ReadCloser, encoding string) *bodyRecorder {
+	return &bodyRecorder{ReadCloser: body, encoding: encoding, buf: new(bytes.Buffer)}
+}
+
+func (r *bodyRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n > 0 && r.buf != nil && !r.done {
+		r.buf.Write(p[:n])
+	}
+	if err != nil {
+		r.finish()
+	}
+	return n, err
+}
+
+func (r *bodyRecorder) Close() error {
+	err := r.ReadCloser.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finish()
+	return err
+}
+
+// succeeded releases the body kept so far, and stops keeping it.
+func (r *bodyRecorder) succeeded() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf = nil
+}
+
+// fail calls counted with the number of events in the body, once it is closed or read to the end,
+// which may be right away.
+func (r *bodyRecorder) fail(counted func(events uint64)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed = counted
+	if r.done {
+		r.count()
+	}
+}
+
+// finish marks the body as done, and counts its events if the request failed.
+// It must be called with the lock held.
+func (r *bodyRecorder) finish() {
+	if r.done {
+		return
+	}
+	r.done = true
+	if r.failed != nil {
+		r.count()
+	}
+}
+
+// count calls failed with the number of events in the body, and releases it.
+// It must be called with the lock held.
+func (r *bodyRecorder) count() {
+	var events uint64
+	if r.buf != nil {
+		events = countEvents(r.buf, r.encoding)
+	}
+	r.buf = nil
+	r.failed(events)
+}
+
+// countEvents returns the number of transactions, spans and errors in an intake request body,
+// decoding it according to the Content-Encoding of the request.
+// Events after the body is cut short or can't be decoded anymore aren't counted.
+func countEvents(body io.Reader, encoding string) uint64 {
+	var r io.Reader = body
+	switch encoding {
+	case "deflate":
+		zr, err := zlib.NewReader(body)
+		if err != nil {
+			return 0
+		}
+		r = zr
+	case "gzip":
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			return 0
+		}
+		r = gr
+	}
+	var events uint64
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 10*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if bytes.HasPrefix(line, []byte(`{"transaction"`)) ||
+			bytes.HasPrefix(line, []byte(`{"span"`)) ||
+			bytes.HasPrefix(line, []byte(`{"error"`)) {
+			events++
+		}
+	}
+	return events
+}
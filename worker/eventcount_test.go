@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const eventsBody = `{"metadata":{"service":{"name":"svc"}}}
+{"transaction":{"id":"1"}}
+{"span":{"id":"2"}}
+{"span":{"id":"3"}}
+{"error":{"id":"4"}}
+{"metricset":{"samples":{}}}
+`
+
+func encodeBody(encoding string) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	default:
+		return []byte(eventsBody)
+	}
+	w.Write([]byte(eventsBody))
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestCountEvents(t *testing.T) {
+	for _, encoding := range []string{"", "deflate", "gzip"} {
+		body := encodeBody(encoding)
+		assert.Equal(t, uint64(4), countEvents(bytes.NewReader(body), encoding), encoding)
+	}
+	// events after the body is cut short aren't counted
+	body := encodeBody("")
+	assert.Equal(t, uint64(2), countEvents(bytes.NewReader(body[:bytes.Index(body, []byte(`{"span":{"id":"3"}`))]), ""))
+	assert.Zero(t, countEvents(bytes.NewReader([]byte("not deflate")), "deflate"))
+}
+
+func TestBodyRecorder(t *testing.T) {
+	newRecorder := func() *bodyRecorder {
+		return newBodyRecorder(ioutil.NopCloser(bytes.NewReader(encodeBody("deflate"))), "deflate")
+	}
+	var counts []uint64
+	counted := func(events uint64) { counts = append(counts, events) }
+
+	// events of requests failing before their body is sent are counted once it is closed
+	r := newRecorder()
+	buf := make([]byte, 10)
+	r.Read(buf)
+	r.fail(counted)
+	assert.Empty(t, counts)
+	ioutil.ReadAll(r)
+	r.Close()
+	assert.Equal(t, []uint64{4}, counts)
+
+	// and right away if it was already
+	counts = nil
+	r = newRecorder()
+	ioutil.ReadAll(r)
+	r.fail(counted)
+	assert.Equal(t, []uint64{4}, counts)
+	r.Close()
+	assert.Equal(t, []uint64{4}, counts)
+
+	// bodies of successful requests are released
+	r = newRecorder()
+	ioutil.ReadAll(r)
+	r.succeeded()
+	assert.Nil(t, r.buf)
+}
+
+func TestWaitFailedEvents(t *testing.T) {
+	rt := &roundTripperWrapper{counted: make(chan struct{}, 1)}
+	assert.True(t, rt.waitFailedEvents(0))
+
+	r := newBodyRecorder(ioutil.NopCloser(bytes.NewReader(encodeBody("gzip"))), "gzip")
+	ioutil.ReadAll(r)
+	rt.countFailedEvents(r)
+	r = newBodyRecorder(ioutil.NopCloser(bytes.NewReader(encodeBody("gzip"))), "gzip")
+	rt.countFailedEvents(r)
+	assert.False(t, rt.waitFailedEvents(10*time.Millisecond))
+	assert.Equal(t, uint64(4), rt.stats.FailedEvents)
+
+	go func() {
+		ioutil.ReadAll(r)
+		r.Close()
+	}()
+	assert.True(t, rt.waitFailedEvents(time.Second))
+	assert.Equal(t, uint64(8), rt.stats.FailedEvents)
+}
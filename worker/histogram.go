@@ -0,0 +1,59 @@
+package worker
+
+import "time"
+
+// LatencyBuckets are the upper bounds of the buckets of latency histograms.
+// Intake requests are streamed for up to 10 seconds by default, so buckets go well beyond that.
+var LatencyBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+}
+
+// Histogram counts durations in LatencyBuckets.
+type Histogram struct {
+	// Counts holds the number of durations in each bucket, not cumulative,
+	// and one more for those above the largest bound
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// Observe adds a duration to the histogram.
+func (h *Histogram) Observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]uint64, len(LatencyBuckets)+1)
+	}
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// Merge adds the durations of another histogram.
+func (h *Histogram) Merge(other Histogram) {
+	if other.Count == 0 {
+		return
+	}
+	if h.Counts == nil {
+		h.Counts = make([]uint64, len(LatencyBuckets)+1)
+	}
+	for i, n := range other.Counts {
+		h.Counts[i] += n
+	}
+	h.Count += other.Count
+	h.Sum += other.Sum
+}
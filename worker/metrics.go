@@ -0,0 +1,201 @@
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metrics holds the latest control of each test, whose workers' stats are served by MetricsHandler.
+var metrics = struct {
+	sync.Mutex
+	controls map[string]*Control
+}{controls: make(map[string]*Control)}
+
+// RegisterMetrics exposes the stats of the workers attached to the control in MetricsHandler,
+// labelled with the test name, in place of those of any previous control for the same test.
+func RegisterMetrics(testName string, control *Control) {
+	if control == nil {
+		return
+	}
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.controls[testName] = control
+}
+
+// MetricsHandler serves the stats of the workers of registered controls in the Prometheus text format,
+// labelled with test name and instance index.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		writeMetrics(&buf, registeredStats())
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+}
+
+// instanceStats are the stats of a worker, with the labels identifying it.
+type instanceStats struct {
+	labels string
+	Result
+}
+
+// registeredStats returns the stats of all workers of registered controls, sorted by test name.
+func registeredStats() []instanceStats {
+	metrics.Lock()
+	names := make([]string, 0, len(metrics.controls))
+	for name := range metrics.controls {
+		names = append(names, name)
+	}
+	controls := make(map[string]*Control, len(metrics.controls))
+	for name, control := range metrics.controls {
+		controls[name] = control
+	}
+	metrics.Unlock()
+
+	sort.Strings(names)
+	var stats []instanceStats
+	for _, name := range names {
+		for i, result := range controls[name].Stats() {
+			labels := fmt.Sprintf(`test_name="%s",instance="%d"`, escapeLabel(name), i)
+			stats = append(stats, instanceStats{labels: labels, Result: result})
+		}
+	}
+	return stats
+}
+
+// counters are the metrics with a single value per worker.
+var counters = []struct {
+	name, help string
+	value      func(Result) uint64
+}{
+	{"hey_apm_events_generated_total", "Events created by the worker.", func(r Result) uint64 { return r.Generated }},
+	{"hey_apm_transactions_sent_total", "Transactions sent by the Go agent.", func(r Result) uint64 { return r.TransactionsSent }},
+	{"hey_apm_transactions_dropped_total", "Transactions dropped by the Go agent.", func(r Result) uint64 { return r.TransactionsDropped }},
+	{"hey_apm_spans_sent_total", "Spans sent by the Go agent.", func(r Result) uint64 { return r.SpansSent }},
+	{"hey_apm_spans_dropped_total", "Spans dropped by the Go agent.", func(r Result) uint64 { return r.SpansDropped }},
+	{"hey_apm_errors_sent_total", "Errors sent by the Go agent.", func(r Result) uint64 { return r.ErrorsSent }},
+	{"hey_apm_errors_dropped_total", "Errors dropped by the Go agent.", func(r Result) uint64 { return r.ErrorsDropped }},
+	{"hey_apm_events_accepted_total", "Events accepted by apm-server.", func(r Result) uint64 { return r.EventsAccepted }},
+	{"hey_apm_intake_requests_total", "Intake requests sent to apm-server.", func(r Result) uint64 { return r.NumRequests }},
+	{"hey_apm_intake_requests_failed_total", "Intake requests failed, as counted by the Go agent.", func(r Result) uint64 { return r.Errors.SendStream }},
+	{"hey_apm_rum_requests_total", "RUM intake requests sent to apm-server.", func(r Result) uint64 { return r.RUMRequests }},
+	{"hey_apm_rum_events_accepted_total", "RUM events accepted by apm-server.", func(r Result) uint64 { return r.RUMEventsAccepted }},
+	{"hey_apm_tls_handshakes_total", "TLS handshakes with apm-server, including failed ones.", func(r Result) uint64 { return r.TLSHandshakes }},
+	{"hey_apm_tls_handshake_errors_total", "Failed TLS handshakes with apm-server.", func(r Result) uint64 { return r.TLSHandshakeErrors }},
+}
+
+// writeMetrics writes the stats of every worker in the Prometheus text format.
+func writeMetrics(w io.Writer, stats []instanceStats) {
+	for _, c := range counters {
+		header(w, c.name, "counter", c.help)
+		for _, s := range stats {
+			fmt.Fprintf(w, "%s{%s} %d\n", c.name, s.labels, c.value(s.Result))
+		}
+	}
+
+	header(w, "hey_apm_events_dropped_total", "counter", "Events generated but not sent, by reason.")
+	for _, s := range stats {
+		drops := s.Drops()
+		for _, d := range []struct {
+			reason string
+			n      uint64
+		}{
+			{"buffer_full", drops.BufferFull},
+			{"max_spans", drops.MaxSpans},
+			{"send_failure", drops.SendFailure},
+			{"flush_timeout", drops.FlushTimeout},
+		} {
+			fmt.Fprintf(w, "hey_apm_events_dropped_total{%s,reason=\"%s\"} %d\n", s.labels, d.reason, d.n)
+		}
+	}
+
+	header(w, "hey_apm_intake_responses_total", "counter", "Intake responses by status code, with 0 for failed requests.")
+	for _, s := range stats {
+		for _, code := range sortedCodes(s.IntakeResponses) {
+			fmt.Fprintf(w, "hey_apm_intake_responses_total{%s,code=\"%d\"} %d\n", s.labels, code, s.IntakeResponses[code])
+		}
+	}
+	header(w, "hey_apm_config_responses_total", "counter", "Agent config responses by status code, with 0 for failed requests.")
+	for _, s := range stats {
+		for _, code := range sortedCodes(s.ConfigResponses) {
+			fmt.Fprintf(w, "hey_apm_config_responses_total{%s,code=\"%d\"} %d\n", s.labels, code, s.ConfigResponses[code])
+		}
+	}
+	header(w, "hey_apm_rejections_total", "counter", "Errors returned by apm-server, by reason.")
+	for _, s := range stats {
+		for _, reason := range sortedKeys(s.Rejections) {
+			fmt.Fprintf(w, "hey_apm_rejections_total{%s,reason=\"%s\"} %d\n", s.labels, escapeLabel(reason), s.Rejections[reason])
+		}
+	}
+
+	for _, c := range []struct {
+		name, help string
+		value      func(TargetStats) uint64
+	}{
+		{"hey_apm_target_requests_total", "Intake requests sent to apm-server, by URL.", func(s TargetStats) uint64 { return s.Requests }},
+		{"hey_apm_target_requests_failed_total", "Intake requests failed or with an error response, by apm-server URL.", func(s TargetStats) uint64 { return s.FailedRequests }},
+		{"hey_apm_target_events_accepted_total", "Events accepted by apm-server, by URL.", func(s TargetStats) uint64 { return s.EventsAccepted }},
+	} {
+		header(w, c.name, "counter", c.help)
+		for _, s := range stats {
+			for _, target := range sortedTargets(s.Targets) {
+				fmt.Fprintf(w, "%s{%s,target=\"%s\"} %d\n", c.name, s.labels, escapeLabel(target), c.value(s.Targets[target]))
+			}
+		}
+	}
+
+	for _, c := range []struct {
+		name, help string
+		value      func(AgentStats) uint64
+	}{
+		{"hey_apm_simulated_requests_total", "Intake requests sent by simulated agents, by name and version.", func(s AgentStats) uint64 { return s.Requests }},
+		{"hey_apm_simulated_events_sent_total", "Events sent by simulated agents, by name and version.", func(s AgentStats) uint64 { return s.EventsSent }},
+		{"hey_apm_simulated_events_accepted_total", "Events of simulated agents accepted by apm-server, by name and version.", func(s AgentStats) uint64 { return s.EventsAccepted }},
+	} {
+		header(w, c.name, "counter", c.help)
+		for _, s := range stats {
+			for _, agent := range sortedAgents(s.SimulatedAgents) {
+				fmt.Fprintf(w, "%s{%s,agent=\"%s\"} %d\n", c.name, s.labels, escapeLabel(agent), c.value(s.SimulatedAgents[agent]))
+			}
+		}
+	}
+
+	header(w, "hey_apm_intake_request_duration_seconds", "histogram", "Time to get a response to intake requests.")
+	for _, s := range stats {
+		var cumulative uint64
+		for i, bound := range LatencyBuckets {
+			if i < len(s.IntakeLatency.Counts) {
+				cumulative += s.IntakeLatency.Counts[i]
+			}
+			fmt.Fprintf(w, "hey_apm_intake_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				s.labels, formatFloat(bound.Seconds()), cumulative)
+		}
+		fmt.Fprintf(w, "hey_apm_intake_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", s.labels, s.IntakeLatency.Count)
+		fmt.Fprintf(w, "hey_apm_intake_request_duration_seconds_sum{%s} %s\n", s.labels, formatFloat(s.IntakeLatency.Sum.Seconds()))
+		fmt.Fprintf(w, "hey_apm_intake_request_duration_seconds_count{%s} %d\n", s.labels, s.IntakeLatency.Count)
+	}
+
+	header(w, "hey_apm_scheduler_lag_seconds", "gauge", "How far event generation falls behind its target rate.")
+	for _, s := range stats {
+		fmt.Fprintf(w, "hey_apm_scheduler_lag_seconds{%s} %s\n", s.labels, formatFloat(s.SchedulerLag.Seconds()))
+	}
+}
+
+func header(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// escapeLabel escapes a label value as required by the Prometheus text format.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,37 @@
+package worker
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	result := Result{
+		Generated:    10,
+		SchedulerLag: 1500 * time.Millisecond,
+	}
+	result.NumRequests = 1
+	result.Errors.SendStream = 1
+	result.IntakeResponses = map[int]uint64{400: 1}
+	result.Rejections = map[string]uint64{"invalid_event": 10}
+	result.IntakeLatency.Observe(20 * time.Millisecond)
+	control := NewControl()
+	control.attach(&controlled{stats: func() Result { return result }})
+	RegisterMetrics(`metrics "test"`, control)
+
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	labels := `test_name="metrics \"test\"",instance="0"`
+	assert.Contains(t, body, "# TYPE hey_apm_events_generated_total counter\n")
+	assert.Contains(t, body, "hey_apm_events_generated_total{"+labels+"} 10\n")
+	assert.Contains(t, body, "hey_apm_intake_requests_failed_total{"+labels+"} 1\n")
+	assert.Contains(t, body, "hey_apm_intake_responses_total{"+labels+`,code="400"} 1`+"\n")
+	assert.Contains(t, body, "hey_apm_rejections_total{"+labels+`,reason="invalid_event"} 10`+"\n")
+	assert.Contains(t, body, "hey_apm_intake_request_duration_seconds_bucket{"+labels+`,le="+Inf"} 1`+"\n")
+	assert.Contains(t, body, "hey_apm_intake_request_duration_seconds_count{"+labels+"} 1\n")
+	assert.Contains(t, body, "hey_apm_scheduler_lag_seconds{"+labels+"} 1.5\n")
+}
@@ -0,0 +1,119 @@
+package worker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/elastic/hey-apm/models"
+	"github.com/elastic/hey-apm/server"
+	"github.com/elastic/hey-apm/tlsconfig"
+)
+
+// StartProgress prints live stats of the workers attached to the control to stderr every
+// input.ProgressInterval, until input.Instances workers finished or the returned function is called,
+// and a last time then. It does nothing if the interval is not positive.
+func StartProgress(input models.Input, control *Control) (stop func()) {
+	if input.ProgressInterval <= 0 {
+		return func() {}
+	}
+	// TLS settings are validated before running
+	tlsConfig, _ := tlsconfig.New(input)
+	clients := server.NewClients(input.ApmServerUrls(), input.ApmServerSecret, input.APIKey, tlsConfig)
+	// Progress stops as soon as workers finish, rather than while waiting for apm-server and storing reports
+	return startProgress(os.Stderr, control, control.Finished(input.Instances), clients, input.ProgressInterval)
+}
+
+// startProgress prints a line of progress to out every interval, and when finished is closed
+// or the returned function is called, whichever happens first.
+// The heap of apm-servers is queried with the clients and added up, unless there are none.
+func startProgress(out io.Writer, control *Control, finished <-chan struct{}, clients []*server.Client,
+	interval time.Duration) (stop func()) {
+	timeoutClients := make([]*server.Client, len(clients))
+	for i, client := range clients {
+		// Don't hold up progress if apm-server is slow to respond
+		timeoutClients[i] = client.WithTimeout(interval)
+	}
+	p := &progress{out: out, control: control, clients: timeoutClients, start: time.Now()}
+	p.lastTime = p.start
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				p.print(time.Now())
+				return
+			case <-finished:
+				p.print(time.Now())
+				return
+			case now := <-ticker.C:
+				p.print(now)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// progress computes rates from the difference between consecutive stats of the workers.
+type progress struct {
+	out     io.Writer
+	control *Control
+	clients []*server.Client
+	start   time.Time
+
+	last     Result
+	lastTime time.Time
+}
+
+// print writes a line with the rates since the last one.
+func (p *progress) print(now time.Time) {
+	current := MergeResults(p.control.Stats()...)
+	seconds := now.Sub(p.lastTime).Seconds()
+	if seconds <= 0 {
+		return
+	}
+	rate := func(current, last uint64) float64 {
+		return float64(current-last) / seconds
+	}
+	// Events sent are only counted by the Go agent once their request completes
+	sent, lastSent := current.EventsSent(), p.last.EventsSent()
+	dropped := current.ErrorsDropped + current.TransactionsDropped + current.SpansDropped
+	lastDropped := p.last.ErrorsDropped + p.last.TransactionsDropped + p.last.SpansDropped
+
+	var codes []string
+	for _, code := range sortedCodes(current.IntakeResponses) {
+		if n := current.IntakeResponses[code] - p.last.IntakeResponses[code]; n > 0 {
+			codes = append(codes, fmt.Sprintf("%s:%d", statusName(code), n))
+		}
+	}
+	if len(codes) == 0 {
+		codes = []string{"-"}
+	}
+
+	line := fmt.Sprintf("[%v] events/s %.0f generated, %.0f sent, %.0f dropped | requests/s %.1f, %d failed | responses %s",
+		now.Sub(p.start).Truncate(time.Second),
+		rate(current.Generated, p.last.Generated), rate(sent, lastSent), rate(dropped, lastDropped),
+		rate(current.NumRequests, p.last.NumRequests), current.Errors.SendStream-p.last.Errors.SendStream,
+		strings.Join(codes, " "),
+	)
+	if len(p.clients) > 0 {
+		heap := "n/a"
+		if metrics, err := server.TotalExpvar(p.clients); err == nil {
+			heap = humanize.Bytes(metrics.Memstats.HeapAlloc)
+		}
+		line += " | apm-server heap " + heap
+	}
+	fmt.Fprintln(p.out, line)
+	p.last, p.lastTime = current, now
+}
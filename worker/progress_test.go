@@ -0,0 +1,72 @@
+package worker
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/hey-apm/fake"
+	"github.com/elastic/hey-apm/server"
+)
+
+func TestProgress(t *testing.T) {
+	apmServer := fake.NewAPMServer(fake.APMServerConfig{})
+	defer apmServer.Close()
+
+	var result Result
+	control := NewControl()
+	w := &controlled{stats: func() Result { return result }}
+	control.attach(w)
+	var out syncBuffer
+	clients := []*server.Client{server.NewClient(apmServer.URL, "", "", nil)}
+	start := time.Now()
+	p := &progress{out: &out, control: control, clients: clients, start: start, lastTime: start}
+
+	result.Generated = 100
+	result.TransactionsSent = 40
+	result.NumRequests = 2
+	result.Errors.SendStream = 1
+	result.IntakeResponses = map[int]uint64{0: 1, 202: 1}
+	p.print(start.Add(2 * time.Second))
+	result.Generated = 150
+	p.print(start.Add(3 * time.Second))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0],
+		"[2s] events/s 50 generated, 20 sent, 0 dropped | requests/s 1.0, 1 failed | responses failed:1 202:1 | apm-server heap "),
+		lines[0])
+	assert.NotContains(t, lines[0], "heap n/a")
+	assert.True(t, strings.HasPrefix(lines[1],
+		"[3s] events/s 50 generated, 0 sent, 0 dropped | requests/s 0.0, 0 failed | responses - | "), lines[1])
+
+	// progress stops once workers finish, without waiting for apm-server or the report
+	var final syncBuffer
+	stopProgress := startProgress(&final, control, control.Finished(1), nil, time.Hour)
+	control.finish(w, result)
+	waitFor(t, func() bool { return final.String() != "" })
+	stopProgress()
+	assert.Equal(t, 1, strings.Count(final.String(), "\n"))
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
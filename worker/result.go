@@ -3,24 +3,194 @@ package worker
 import (
 	"bytes"
 	"fmt"
+	"sort"
+	"strconv"
 	"text/tabwriter"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"go.elastic.co/apm"
+
+	"github.com/elastic/hey-apm/models"
 )
 
 // Result holds stats captured from a Go agent plus timing information.
 type Result struct {
 	apm.TracerStats
 	TransportStats
+	// Generated counts the events created by the worker, as soon as they are created,
+	// and GeneratedTransactions, GeneratedSpans and GeneratedErrors those of each type
+	Generated             uint64
+	GeneratedTransactions uint64
+	GeneratedSpans        uint64
+	GeneratedErrors       uint64
+	// MaxSpansDropped counts the spans dropped by the Go agent for exceeding the max spans per transaction
+	MaxSpansDropped uint64
+	// FlushTimeoutDropped counts the events still buffered by the Go agent when flushing timed out
+	FlushTimeoutDropped uint64
+	// SchedulerLag is how far event generation falls behind its target rate
+	SchedulerLag time.Duration
+	// Telemetry holds the rates of the work sampled over time, in the order they were taken
+	Telemetry []models.Sample
+	// Usage holds the resources used by hey-apm itself during the work
+	Usage   Usage
 	Start   time.Time
 	End     time.Time
 	Flushed time.Time
 }
 
-func (r Result) EventsGenerated() uint64 {
-	sent := r.EventsSent()
-	return sent + r.ErrorsDropped + r.ErrorsDropped + r.TransactionsDropped
+// MergeResults adds up the results of several workers, spanning from the earliest start
+// to the latest end and flush.
+func MergeResults(results ...Result) Result {
+	var merged Result
+	uniqueErrors := make(map[string]struct{})
+	merged.Rejections = make(map[string]uint64)
+	merged.IntakeResponses = make(map[int]uint64)
+	merged.ConfigResponses = make(map[int]uint64)
+	merged.Targets = make(map[string]TargetStats)
+	merged.SimulatedAgents = make(map[string]AgentStats)
+	for _, r := range results {
+		merged.Errors.SetContext += r.Errors.SetContext
+		merged.Errors.SendStream += r.Errors.SendStream
+		merged.ErrorsSent += r.ErrorsSent
+		merged.ErrorsDropped += r.ErrorsDropped
+		merged.TransactionsSent += r.TransactionsSent
+		merged.TransactionsDropped += r.TransactionsDropped
+		merged.SpansSent += r.SpansSent
+		merged.SpansDropped += r.SpansDropped
+
+		merged.Generated += r.Generated
+		merged.GeneratedTransactions += r.GeneratedTransactions
+		merged.GeneratedSpans += r.GeneratedSpans
+		merged.GeneratedErrors += r.GeneratedErrors
+		merged.MaxSpansDropped += r.MaxSpansDropped
+		merged.FlushTimeoutDropped += r.FlushTimeoutDropped
+		merged.FailedEvents += r.FailedEvents
+		if r.SchedulerLag > merged.SchedulerLag {
+			merged.SchedulerLag = r.SchedulerLag
+		}
+		// Workers in the same process overlap in their usage
+		merged.Usage = merged.Usage.max(r.Usage)
+		merged.EventsAccepted += r.EventsAccepted
+		merged.NumRequests += r.NumRequests
+		for reason, n := range r.Rejections {
+			merged.Rejections[reason] += n
+		}
+		for code, n := range r.IntakeResponses {
+			merged.IntakeResponses[code] += n
+		}
+		merged.IntakeLatency.Merge(r.IntakeLatency)
+		for target, s := range r.Targets {
+			merged.Targets[target] = merged.Targets[target].add(s)
+		}
+		for agent, s := range r.SimulatedAgents {
+			merged.SimulatedAgents[agent] = merged.SimulatedAgents[agent].add(s)
+		}
+		for code, n := range r.ConfigResponses {
+			merged.ConfigResponses[code] += n
+		}
+		merged.ConfigLatency += r.ConfigLatency
+		if r.ConfigMaxLatency > merged.ConfigMaxLatency {
+			merged.ConfigMaxLatency = r.ConfigMaxLatency
+		}
+		merged.RUMRequests += r.RUMRequests
+		merged.RUMEventsAccepted += r.RUMEventsAccepted
+		merged.RUMLatency += r.RUMLatency
+		merged.TLSHandshakes += r.TLSHandshakes
+		merged.TLSHandshakeErrors += r.TLSHandshakeErrors
+		merged.TLSHandshakeTime += r.TLSHandshakeTime
+		if r.RUMMaxLatency > merged.RUMMaxLatency {
+			merged.RUMMaxLatency = r.RUMMaxLatency
+		}
+		for _, e := range r.UniqueErrors {
+			if _, ok := uniqueErrors[e]; !ok {
+				uniqueErrors[e] = struct{}{}
+				merged.UniqueErrors = append(merged.UniqueErrors, e)
+			}
+		}
+
+		if merged.Start.IsZero() || (!r.Start.IsZero() && r.Start.Before(merged.Start)) {
+			merged.Start = r.Start
+		}
+		if r.End.After(merged.End) {
+			merged.End = r.End
+		}
+		if r.Flushed.After(merged.Flushed) {
+			merged.Flushed = r.Flushed
+		}
+	}
+	return merged
+}
+
+// add adds up the stats of the same apm-server from two workers.
+func (s TargetStats) add(s2 TargetStats) TargetStats {
+	return TargetStats{
+		Requests:       s.Requests + s2.Requests,
+		FailedRequests: s.FailedRequests + s2.FailedRequests,
+		EventsAccepted: s.EventsAccepted + s2.EventsAccepted,
+		Latency:        s.Latency + s2.Latency,
+	}
+}
+
+// add adds up the stats of the same simulated agent from two workers.
+func (s AgentStats) add(s2 AgentStats) AgentStats {
+	return AgentStats{
+		Requests:       s.Requests + s2.Requests,
+		FailedRequests: s.FailedRequests + s2.FailedRequests,
+		EventsSent:     s.EventsSent + s2.EventsSent,
+		EventsAccepted: s.EventsAccepted + s2.EventsAccepted,
+	}
+}
+
+// SimulatedTotal adds up the stats of all simulated agents.
+func (r Result) SimulatedTotal() AgentStats {
+	var total AgentStats
+	for _, s := range r.SimulatedAgents {
+		total = total.add(s)
+	}
+	return total
+}
+
+// Drops counts the events generated but not sent, by reason.
+type Drops struct {
+	// BufferFull counts the events dropped by the Go agent because its buffer was full
+	BufferFull uint64
+	// MaxSpans counts the spans dropped for exceeding the max spans per transaction
+	MaxSpans uint64
+	// SendFailure counts the events in intake requests that failed
+	SendFailure uint64
+	// FlushTimeout counts the events still buffered when flushing timed out
+	FlushTimeout uint64
+}
+
+// Total returns the number of events dropped for any reason.
+func (d Drops) Total() uint64 {
+	return d.BufferFull + d.MaxSpans + d.SendFailure + d.FlushTimeout
+}
+
+// Drops returns the number of events not sent, by reason.
+func (r Result) Drops() Drops {
+	return Drops{
+		BufferFull:   r.ErrorsDropped + r.TransactionsDropped + r.SpansDropped,
+		MaxSpans:     r.MaxSpansDropped,
+		SendFailure:  r.FailedEvents,
+		FlushTimeout: r.FlushTimeoutDropped,
+	}
+}
+
+// accounted returns the number of events sent, or dropped for a known reason.
+// Events lost by the Go agent otherwise make it lower than the number of events generated.
+func (r Result) accounted() uint64 {
+	return r.EventsSent() + r.Drops().Total()
+}
+
+// ConfigRequests returns the number of agent config requests sent.
+func (r Result) ConfigRequests() uint64 {
+	var n uint64
+	for _, count := range r.ConfigResponses {
+		n += count
+	}
+	return n
 }
 
 func (r Result) EventsSent() uint64 {
@@ -59,11 +229,19 @@ func (r Result) String() string {
 		add(" - success %", "%.2f", 100*float64(r.ErrorsSent)/float64(total))
 	}
 
+	if drops := r.Drops(); drops.Total() > 0 {
+		add("events dropped", "%d", drops.Total())
+		add(" - buffer full", "%d", drops.BufferFull)
+		add(" - max spans", "%d", drops.MaxSpans)
+		add(" - send failure", "%d", drops.SendFailure)
+		add(" - flush timeout", "%d", drops.FlushTimeout)
+	}
+
 	if elapsedSeconds := r.ElapsedSeconds(); elapsedSeconds > 0 {
 		eventsSent := r.EventsSent()
 		add("total events sent", "%d", eventsSent)
 		add(" - per second", "%.2f", float64(eventsSent)/elapsedSeconds)
-		if total := r.EventsGenerated(); total > 0 {
+		if total := r.Generated; total > 0 {
 			add(" - success %", "%.2f", 100*float64(eventsSent)/float64(total))
 		}
 		add(" - accepted", "%d", r.EventsAccepted)
@@ -71,10 +249,114 @@ func (r Result) String() string {
 	}
 	add("total requests", "%d", r.NumRequests)
 	add("failed", "%d", r.Errors.SendStream)
+	for _, code := range sortedCodes(r.IntakeResponses) {
+		add(" - "+statusName(code), "%d", r.IntakeResponses[code])
+	}
+	if len(r.Targets) > 1 {
+		for _, target := range sortedTargets(r.Targets) {
+			s := r.Targets[target]
+			add("requests to "+target, "%d", s.Requests)
+			add(" - failed", "%d", s.FailedRequests)
+			add(" - events accepted", "%d", s.EventsAccepted)
+			if s.Requests > 0 {
+				add(" - avg latency", "%v", s.Latency/time.Duration(s.Requests))
+			}
+		}
+	}
 	if len(r.UniqueErrors) > 0 {
 		add("server errors", "%d", r.UniqueErrors)
 	}
+	if r.TLSHandshakes > 0 {
+		add("tls handshakes", "%d", r.TLSHandshakes)
+		add(" - failed", "%d", r.TLSHandshakeErrors)
+		add(" - avg time", "%v", r.TLSHandshakeTime/time.Duration(r.TLSHandshakes))
+	}
+	if r.RUMRequests > 0 {
+		add("rum errors sent", "%d", r.RUMRequests)
+		add(" - accepted", "%d", r.RUMEventsAccepted)
+		if elapsedSeconds := r.ElapsedSeconds(); elapsedSeconds > 0 {
+			add("   - per second", "%.2f", float64(r.RUMEventsAccepted)/elapsedSeconds)
+		}
+		add(" - avg latency", "%v", r.RUMLatency/time.Duration(r.RUMRequests))
+		add(" - max latency", "%v", r.RUMMaxLatency)
+	}
+	for _, agent := range sortedAgents(r.SimulatedAgents) {
+		s := r.SimulatedAgents[agent]
+		add("simulated "+agent+" requests", "%d", s.Requests)
+		add(" - failed", "%d", s.FailedRequests)
+		add(" - events sent", "%d", s.EventsSent)
+		add(" - events accepted", "%d", s.EventsAccepted)
+	}
+	if configRequests := r.ConfigRequests(); configRequests > 0 {
+		add("agent config requests", "%d", configRequests)
+		for _, code := range sortedCodes(r.ConfigResponses) {
+			add(" - "+statusName(code), "%d", r.ConfigResponses[code])
+		}
+		add(" - avg latency", "%v", r.ConfigLatency/time.Duration(configRequests))
+		add(" - max latency", "%v", r.ConfigMaxLatency)
+	}
+	if len(r.Rejections) > 0 {
+		var total uint64
+		for _, n := range r.Rejections {
+			total += n
+		}
+		add("rejections", "%d", total)
+		for _, reason := range sortedKeys(r.Rejections) {
+			add(" - "+reason, "%d", r.Rejections[reason])
+		}
+	}
+	if r.Usage.CPUs > 0 {
+		add("hey-apm cpu time", "%v", r.Usage.CPUTime.Truncate(time.Millisecond))
+		add(" - % of available", "%.2f", 100*r.CPUUtilization())
+		if r.Usage.MaxRSS > 0 {
+			add("hey-apm max rss", "%s", humanize.Bytes(r.Usage.MaxRSS))
+		}
+		add("hey-apm heap", "%s", humanize.Bytes(r.Usage.HeapAlloc))
+		add("hey-apm gc runs", "%d", r.Usage.NumGC)
+		add(" - total pause", "%v", r.Usage.GCPause)
+	}
+	for _, reason := range r.Saturation() {
+		add("hey-apm likely saturated", "%s", reason)
+	}
 
 	tw.Flush()
 	return buf.String()
 }
+
+// sortedCodes returns the status codes of a map in ascending order.
+func sortedCodes(m map[int]uint64) []int {
+	codes := make([]int, 0, len(m))
+	for code := range m {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	return codes
+}
+
+// sortedTargets returns the apm-server URLs of a map in ascending order.
+func sortedTargets(m map[string]TargetStats) []string {
+	targets := make([]string, 0, len(m))
+	for target := range m {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// sortedAgents returns the simulated agents of a map in ascending order.
+func sortedAgents(m map[string]AgentStats) []string {
+	agents := make([]string, 0, len(m))
+	for agent := range m {
+		agents = append(agents, agent)
+	}
+	sort.Strings(agents)
+	return agents
+}
+
+// statusName returns a status code as a string, or "failed" for 0.
+func statusName(code int) string {
+	if code == 0 {
+		return "failed"
+	}
+	return strconv.Itoa(code)
+}
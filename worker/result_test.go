@@ -0,0 +1,51 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.elastic.co/apm"
+	apmtransport "go.elastic.co/apm/transport"
+)
+
+func TestSaturation(t *testing.T) {
+	start := time.Now()
+	result := Result{
+		Start:   start,
+		Flushed: start.Add(10 * time.Second),
+		Usage:   Usage{CPUTime: 5 * time.Second, CPUs: 2},
+	}
+	assert.Equal(t, 0.25, result.CPUUtilization())
+	assert.Empty(t, result.Saturation())
+
+	result.Usage.CPUTime = 19 * time.Second
+	result.SchedulerLag = 3 * time.Second
+	assert.Equal(t, []string{
+		"event generation fell 3s behind schedule",
+		"CPU usage at 95% of 2 cores",
+	}, result.Saturation())
+	assert.Contains(t, result.String(), "hey-apm likely saturated")
+}
+
+func TestDrops(t *testing.T) {
+	var result Result
+	result.TransactionsSent = 10
+	result.ErrorsDropped = 1
+	result.TransactionsDropped = 2
+	result.SpansDropped = 3
+	result.MaxSpansDropped = 4
+	result.FailedEvents = 5
+	result.FlushTimeoutDropped = 6
+	assert.Equal(t, Drops{BufferFull: 6, MaxSpans: 4, SendFailure: 5, FlushTimeout: 6}, result.Drops())
+	assert.Equal(t, uint64(31), result.accounted())
+
+	tracer, err := apm.NewTracerOptions(apm.TracerOptions{Transport: apmtransport.Discard})
+	require.NoError(t, err)
+	defer tracer.Close()
+	tracer.SetMaxSpans(1)
+	tx := tracer.StartTransaction("tx", "test")
+	assert.Equal(t, 2, sendSpans(tx, 3, contextMinimal))
+	tx.End()
+}
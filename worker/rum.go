@@ -0,0 +1,198 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/hey-apm/server"
+)
+
+const (
+	// rumServiceVersion is the service version of RUM errors and sourcemaps
+	rumServiceVersion = "1.0.0"
+	// bundleURL is the format of the URL of the synthetic JavaScript bundles
+	bundleURL = "http://hey-apm.local/static/%s"
+	// unmappedBundle is the index of a bundle without sourcemap
+	unmappedBundle = -1
+)
+
+// bundleFile returns the file name of the i-th synthetic bundle.
+func bundleFile(i int) string {
+	if i == unmappedBundle {
+		return "bundle-unmapped.js"
+	}
+	return fmt.Sprintf("bundle-%d.js", i)
+}
+
+// uploadSourcemaps uploads n synthetic sourcemaps, each one for a bundle with the given number of lines.
+func uploadSourcemaps(client *server.Client, serviceName string, n, lines int) error {
+	sourcemap := newSourcemap(lines)
+	for i := 0; i < n; i++ {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		w.WriteField("service_name", serviceName)
+		w.WriteField("service_version", rumServiceVersion)
+		w.WriteField("bundle_filepath", fmt.Sprintf(bundleURL, bundleFile(i)))
+		part, err := w.CreateFormFile("sourcemap", bundleFile(i)+".map")
+		if err != nil {
+			return err
+		}
+		part.Write(sourcemap)
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(client.URL, "/")+"/assets/v1/sourcemaps", &body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		resp, err := client.Do(req)
+		if err != nil {
+			return errors.Wrap(err, "error uploading sourcemap")
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err := server.CheckResponse(resp, data); err != nil {
+			return errors.Wrap(err, "error uploading sourcemap")
+		}
+	}
+	return nil
+}
+
+// newSourcemap returns a sourcemap mapping every line of a minified bundle to a line of a single source file.
+func newSourcemap(lines int) []byte {
+	if lines < 1 {
+		lines = 1
+	}
+	// Each line has a single segment with relative fields: generated column 0, source 0,
+	// next original line, original column 0.
+	mappings := "AAAA" + strings.Repeat(";AACA", lines-1)
+	source := make([]string, lines)
+	for i := range source {
+		source[i] = fmt.Sprintf("function generated%d() { throw new TypeError('generated error') }", i)
+	}
+	sourcemap, _ := json.Marshal(map[string]interface{}{
+		"version":        3,
+		"file":           "bundle.js",
+		"sources":        []string{"webpack:///./src/generated.js"},
+		"sourcesContent": []string{strings.Join(source, "\n")},
+		"names":          []string{},
+		"mappings":       mappings,
+	})
+	return sourcemap
+}
+
+// rumSender sends errors as the RUM JavaScript agent would, with stack traces in the synthetic bundles.
+type rumSender struct {
+	client      *http.Client
+	logger      *apmLogger
+	serverURL   string
+	serviceName string
+	frequency   time.Duration
+	// number of bundles with sourcemaps, errors are in a bundle without sourcemap if 0
+	bundles   int
+	lines     int
+	minFrames int
+	maxFrames int
+}
+
+// run sends RUM errors up to once per frequency, each one in its own request, until the context is cancelled.
+func (s rumSender) run(ctx context.Context) {
+	if s.frequency <= 0 {
+		return
+	}
+	if s.minFrames < 1 {
+		s.minFrames = 1
+	}
+	if s.maxFrames < s.minFrames {
+		s.maxFrames = s.minFrames
+	}
+	go func() {
+		ticker := time.NewTicker(s.frequency)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := s.send(ctx); err != nil && ctx.Err() == nil {
+				s.logger.Debugf("RUM request failed: %s", err)
+			}
+		}
+	}()
+}
+
+func (s rumSender) send(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(s.serverURL, "/")+"/intake/v2/rum/events",
+		bytes.NewReader(s.payload()))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// payload returns the NDJSON body of a RUM intake request with metadata and one error.
+func (s rumSender) payload() []byte {
+	bundle := unmappedBundle
+	if s.bundles > 0 {
+		bundle = rand.Intn(s.bundles)
+	}
+	lines := s.lines
+	if lines < 1 {
+		lines = 1
+	}
+	frames := make([]map[string]interface{}, randRange(s.minFrames, s.maxFrames))
+	for i := range frames {
+		line := rand.Intn(lines) + 1
+		frames[i] = map[string]interface{}{
+			"abs_path": fmt.Sprintf(bundleURL, bundleFile(bundle)),
+			"filename": "static/" + bundleFile(bundle),
+			"function": fmt.Sprintf("generated%d", line-1),
+			"lineno":   line,
+			"colno":    1,
+		}
+	}
+
+	metadata, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"service": map[string]interface{}{
+				"name":     s.serviceName,
+				"version":  rumServiceVersion,
+				"agent":    map[string]interface{}{"name": "rum-js", "version": "5.5.0"},
+				"language": map[string]interface{}{"name": "javascript"},
+			},
+		},
+	})
+	event, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"id":        fmt.Sprintf("%016x", rand.Uint64()),
+			"timestamp": time.Now().UnixNano() / int64(time.Microsecond),
+			"culprit":   "static/" + bundleFile(bundle),
+			"exception": map[string]interface{}{
+				"message":    "Uncaught TypeError: generated error",
+				"type":       "TypeError",
+				"stacktrace": frames,
+			},
+		},
+	})
+	return append(append(append(metadata, '\n'), event...), '\n')
+}
@@ -5,14 +5,21 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"go.elastic.co/apm"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/elastic/hey-apm/es"
 	"github.com/elastic/hey-apm/models"
 	"github.com/elastic/hey-apm/server"
+	"github.com/elastic/hey-apm/storage"
+	"github.com/elastic/hey-apm/tlsconfig"
 )
 
 const quiesceTimeout = 5 * time.Minute
@@ -21,39 +28,130 @@ const quiesceTimeout = 5 * time.Minute
 // indexes a performance report, and returns it along any error.
 //
 // If the context is cancelled, the worker exits with the context's error.
-// If the stop channel is signalled, the worker exits gracefully with no error.
-func Run(ctx context.Context, input models.Input, testName string, stop <-chan struct{}) (models.Report, error) {
-	testNode, err := es.NewConnection(input.ApmElasticsearchUrl, input.ApmElasticsearchAuth)
+// If the control is stopped, the worker exits gracefully with no error.
+// The control may be nil.
+func Run(ctx context.Context, input models.Input, testName string, control *Control) (models.Report, error) {
+	report, _, err := RunWithResult(ctx, input, testName, control)
+	return report, err
+}
+
+// RunWithResult is like Run, but also returns the result of the work the report is made from.
+func RunWithResult(ctx context.Context, input models.Input, testName string, control *Control) (models.Report, Result, error) {
+	tlsConfig, err := tlsconfig.New(input)
+	if err != nil {
+		return models.Report{}, Result{}, err
+	}
+	testNode, err := es.NewConnection(es.APMConfig(input, tlsConfig))
 	if err != nil {
-		return models.Report{}, errors.Wrap(err, "Elasticsearch used by APM Server not known or reachable")
+		return models.Report{}, Result{}, errors.Wrap(err, "Elasticsearch used by APM Server not known or reachable")
 	}
 
-	worker, err := newWorker(input, stop)
+	apmClients := server.NewClients(input.ApmServerUrls(), input.ApmServerSecret, input.APIKey, tlsConfig)
+	apmClient := apmClients[0]
+	if _, err := apmClient.Info(); server.IsAuthError(err) {
+		return models.Report{}, Result{}, err
+	}
+
+	simulatedAgents, err := newSimulatedAgents(input.SimulatedAgents)
+	if err != nil {
+		return models.Report{}, Result{}, err
+	}
+	worker, err := newWorker(input, apmClient, control)
 	if err != nil {
-		return models.Report{}, err
+		return models.Report{}, Result{}, err
 	}
 	logger := worker.logger.Logger
-	initialStatus := server.GetStatus(logger, input.ApmServerSecret, input.ApmServerUrl, testNode)
+	// Requests sent by hey-apm itself go through the tracer transport, so that they are counted
+	client := apmClient.WithTransport(worker.tracer.roundTripper)
+	if input.RUMErrorFrequency > 0 && input.Sourcemaps > 0 {
+		if err := uploadSourcemaps(client, input.ServiceName, input.Sourcemaps, input.SourcemapLines); err != nil {
+			return models.Report{}, Result{}, err
+		}
+	}
+	var initialStatus server.Status
+	if !input.SkipStatus {
+		initialStatus = server.GetStatus(logger, apmClients, testNode)
+	}
 
+	backgroundCtx, stopBackground := context.WithCancel(ctx)
+	holdIdleConnections(backgroundCtx, worker.logger, input.ApmServerUrls(), tlsConfig, input.IdleConnections)
+	configPoller{
+		client:      client,
+		logger:      worker.logger,
+		serviceName: input.ServiceName,
+		agents:      input.ConfigPollers,
+		services:    input.ConfigServices,
+		interval:    input.ConfigPollInterval,
+	}.run(backgroundCtx)
+	rumSender{
+		// RUM agents don't send credentials
+		client:      &http.Client{Transport: worker.tracer.roundTripper},
+		logger:      worker.logger,
+		serverURL:   apmClient.URL,
+		serviceName: input.ServiceName,
+		frequency:   input.RUMErrorFrequency,
+		bundles:     input.Sourcemaps,
+		lines:       input.SourcemapLines,
+		minFrames:   input.ErrorFrameMinLimit,
+		maxFrames:   input.ErrorFrameMaxLimit,
+	}.run(backgroundCtx)
+	simulatedSender{
+		client:        &http.Client{Transport: worker.tracer.roundTripper},
+		authorization: apmClient.Authorization(),
+		logger:        worker.logger,
+		serverURL:     apmClient.URL,
+		serviceName:   input.ServiceName,
+		agents:        simulatedAgents,
+		frequency:     input.SimulatedFrequency,
+		minSpans:      input.SpanMinLimit,
+		maxSpans:      input.SpanMaxLimit,
+		errorRate:     input.SimulatedErrorRate,
+		minFrames:     input.ErrorFrameMinLimit,
+		maxFrames:     input.ErrorFrameMaxLimit,
+	}.run(backgroundCtx)
 	result, err := worker.work(ctx)
+	stopBackground()
 	if err != nil {
 		logger.Println(err.Error())
-		return models.Report{}, err
+		return models.Report{}, Result{}, err
 	}
 	logger.Printf("%s elapsed since event generation completed", result.Flushed.Sub(result.End))
-	fmt.Println(result)
+	if saturation := result.Saturation(); len(saturation) > 0 {
+		logger.Printf("warning: hey-apm was likely saturated, results may understate apm-server: %s",
+			strings.Join(saturation, ", "))
+	}
+	if textOutput(input) {
+		fmt.Println(result)
+	}
 
-	// Wait for apm-server to quiesce before proceeding.
 	var finalStatus server.Status
+	if !input.SkipStatus {
+		finalStatus = QuiescedStatus(logger, input, testNode)
+	}
+	report := NewReport(input, testName, result, initialStatus, finalStatus)
+
+	if input.SkipIndexReport {
+		return report, result, err
+	}
+	return report, result, StoreReport(logger, input, report, result.Telemetry)
+}
+
+// QuiescedStatus waits for all apm-servers to process their active events, for up to 5 minutes,
+// and returns their status.
+func QuiescedStatus(logger *log.Logger, input models.Input, testNode es.Connection) server.Status {
+	// TLS settings are validated before running
+	tlsConfig, _ := tlsconfig.New(input)
+	apmClients := server.NewClients(input.ApmServerUrls(), input.ApmServerSecret, input.APIKey, tlsConfig)
+	var status server.Status
 	deadline := time.Now().Add(quiesceTimeout)
 	for {
-		finalStatus = server.GetStatus(logger, input.ApmServerSecret, input.ApmServerUrl, testNode)
-		if finalStatus.Metrics == nil {
+		status = server.GetStatus(logger, apmClients, testNode)
+		if status.Metrics == nil {
 			logger.Print("expvar endpoint not available, returning")
 			break
 		}
-		outputActiveEvents := derefInt64(finalStatus.Metrics.LibbeatMetrics.OutputEventsActive, 0)
-		pipelineActiveEvents := derefInt64(finalStatus.Metrics.LibbeatMetrics.PipelineEventsActive, 0)
+		outputActiveEvents := derefInt64(status.Metrics.LibbeatMetrics.OutputEventsActive, 0)
+		pipelineActiveEvents := derefInt64(status.Metrics.LibbeatMetrics.PipelineEventsActive, 0)
 		if outputActiveEvents == 0 && pipelineActiveEvents == 0 {
 			break
 		}
@@ -70,23 +168,35 @@ func Run(ctx context.Context, input models.Input, testName string, stop <-chan s
 		)
 		time.Sleep(time.Second)
 	}
-	report := createReport(input, testName, result, initialStatus, finalStatus)
-
-	if input.SkipIndexReport {
-		return report, err
-	}
+	return status
+}
 
-	if input.ElasticsearchUrl == "" {
-		logger.Println("es-url unset: not indexing report")
+// StoreReport saves a report in the storage configured by the input, if any,
+// along with its telemetry samples.
+func StoreReport(logger *log.Logger, input models.Input, report models.Report, telemetry []models.Sample) error {
+	store, err := storage.New(input)
+	if err != nil {
+		logger.Println(err.Error())
+	} else if store == nil {
+		logger.Println("es-url and report-path unset: not indexing report")
+	} else if err = store.IndexReport(report); err != nil {
+		logger.Println(err.Error())
 	} else {
-		reportNode, _ := es.NewConnection(input.ElasticsearchUrl, input.ElasticsearchAuth)
-		if err = es.IndexReport(reportNode, report); err != nil {
-			logger.Println(err.Error())
-		} else {
-			logger.Println("report indexed with document Id " + report.ReportId)
+		logger.Println("report indexed with document Id " + report.ReportId)
+		if len(telemetry) > 0 {
+			samples := make([]models.Sample, len(telemetry))
+			for i, sample := range telemetry {
+				sample.ReportId = report.ReportId
+				samples[i] = sample
+			}
+			if err = store.IndexTelemetry(samples); err != nil {
+				logger.Println(err.Error())
+			} else {
+				logger.Printf("%d telemetry samples indexed", len(samples))
+			}
 		}
 	}
-	return report, err
+	return err
 }
 
 func derefInt64(v *int64, d int64) int64 {
@@ -96,24 +206,82 @@ func derefInt64(v *int64, d int64) int64 {
 	return d
 }
 
+// RunInstances runs input.Instances workers concurrently, each one starting after a random delay
+// of up to input.DelayMillis, and returns their reports and results.
+// All workers are cancelled as soon as one of them fails.
+func RunInstances(ctx context.Context, input models.Input, control *Control) ([]models.Report, []Result, error) {
+	if control == nil {
+		control = NewControl()
+	}
+	RegisterMetrics(input.TestName, control)
+	stopProgress := StartProgress(input, control)
+	defer stopProgress()
+
+	reports := make([]models.Report, input.Instances)
+	results := make([]Result, input.Instances)
+	g, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < input.Instances; i++ {
+		idx := i
+		g.Go(func() error {
+			var randomDelay time.Duration
+			if input.DelayMillis > 0 {
+				randomDelay = time.Duration(rand.Intn(input.DelayMillis)) * time.Millisecond
+			}
+			if textOutput(input) {
+				fmt.Println(fmt.Sprintf("--- Starting instance (%v) in %v milliseconds", idx, randomDelay))
+			}
+			time.Sleep(randomDelay)
+			report, result, err := RunWithResult(ctx, input, input.TestName, control)
+			reports[idx], results[idx] = report, result
+			return err
+		})
+	}
+	err := g.Wait()
+	return reports, results, err
+}
+
 // newWorker returns a new worker with with a workload defined by the input.
-func newWorker(input models.Input, stop <-chan struct{}) (*worker, error) {
+func newWorker(input models.Input, client *server.Client, control *Control) (*worker, error) {
 	logger := newApmLogger(log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lshortfile))
-	tracer, err := newTracer(logger, input.ApmServerUrl, input.ApmServerSecret, input.APIKey, input.ServiceName, input.SpanMaxLimit)
+	chaos, err := newChaos(input.ChaosRate, input.ChaosFaults)
+	if err != nil {
+		return nil, err
+	}
+	slow, err := newSlowClient(input.TrickleRate, input.HoldStream, input.DisconnectRate)
 	if err != nil {
 		return nil, err
 	}
+	balancer, err := newBalancer(input.ApmServerUrls(), input.ApmServerStrategy)
+	if err != nil {
+		return nil, err
+	}
+	level, err := newContextLevel(input.ContextLevel)
+	if err != nil {
+		return nil, err
+	}
+	tracer, err := newTracer(logger, client, balancer, input.ServiceName, newAgentTuning(input), chaos, slow)
+	if err != nil {
+		return nil, err
+	}
+	if level >= contextFull {
+		tracer.SetCaptureBody(apm.CaptureBodyTransactions)
+	}
 	return &worker{
-		stop:         stop,
+		stop:         control.stopped(),
+		control:      control,
+		rates:        make(chan Rates, 1),
 		logger:       logger,
 		tracer:       tracer,
 		RunTimeout:   input.RunTimeout,
 		FlushTimeout: input.FlushTimeout,
 
+		TelemetryInterval: input.TelemetryInterval,
+
 		TransactionFrequency: input.TransactionFrequency,
 		TransactionLimit:     input.TransactionLimit,
 		SpanMinLimit:         input.SpanMinLimit,
 		SpanMaxLimit:         input.SpanMaxLimit,
+		ContextLevel:         level,
 
 		ErrorFrequency:     input.ErrorFrequency,
 		ErrorLimit:         input.ErrorLimit,
@@ -122,15 +290,33 @@ func newWorker(input models.Input, stop <-chan struct{}) (*worker, error) {
 	}, nil
 }
 
-func createReport(input models.Input, testName string, result Result, initialStatus, finalStatus server.Status) models.Report {
+// newAgentTuning returns the Go agent settings defined by the input.
+func newAgentTuning(input models.Input) agentTuning {
+	maxSpans := input.AgentMaxSpans
+	if maxSpans == 0 {
+		maxSpans = input.SpanMaxLimit
+	}
+	return agentTuning{
+		bufferSize:       input.AgentBufferSize,
+		requestSize:      input.AgentRequestSize,
+		requestTime:      input.AgentRequestTime,
+		compressionLevel: input.AgentCompressionLevel,
+		maxSpans:         maxSpans,
+	}
+}
+
+// NewReport creates a performance report from the result of a work, and the status of apm-server
+// before and after it.
+func NewReport(input models.Input, testName string, result Result, initialStatus, finalStatus server.Status) models.Report {
 	this, _ := os.Hostname()
+	drops := result.Drops()
 	r := models.Report{
 		Input: input,
 
 		ReportId:     shortId(),
 		ReportDate:   time.Now().Format(models.GITRFC),
 		ReporterHost: this,
-		TestName:     testName,
+		Metadata:     input.Metadata,
 
 		Timestamp: time.Now(),
 		Elapsed:   result.Flushed.Sub(result.Start).Seconds(),
@@ -138,27 +324,92 @@ func createReport(input models.Input, testName string, result Result, initialSta
 		Requests:       result.NumRequests,
 		FailedRequests: result.Errors.SendStream,
 
-		ErrorsGenerated: result.ErrorsSent + result.ErrorsDropped,
+		ErrorsGenerated: result.GeneratedErrors,
 		ErrorsSent:      result.ErrorsSent,
 		ErrorsIndexed:   finalStatus.ErrorIndexCount - initialStatus.ErrorIndexCount,
 
-		TransactionsGenerated: result.TransactionsSent + result.TransactionsDropped,
+		TransactionsGenerated: result.GeneratedTransactions,
 		TransactionsSent:      result.TransactionsSent,
 		TransactionsIndexed:   finalStatus.TransactionIndexCount - initialStatus.TransactionIndexCount,
 
-		SpansGenerated: result.SpansSent + result.SpansDropped,
+		SpansGenerated: result.GeneratedSpans,
 		SpansSent:      result.SpansSent,
 		SpansIndexed:   finalStatus.SpanIndexCount - initialStatus.SpanIndexCount,
 
-		EventsAccepted: result.EventsAccepted,
+		DroppedBufferFull:   drops.BufferFull,
+		DroppedMaxSpans:     drops.MaxSpans,
+		DroppedSendFailure:  drops.SendFailure,
+		DroppedFlushTimeout: drops.FlushTimeout,
+
+		EventsAccepted:  result.EventsAccepted,
+		Rejections:      result.Rejections,
+		IntakeResponses: result.IntakeResponses,
+
+		ConfigResponses: result.ConfigResponses,
+
+		RUMErrorsSent:     result.RUMRequests,
+		RUMErrorsAccepted: result.RUMEventsAccepted,
+
+		GeneratorCPU:        result.Usage.CPUTime.Seconds(),
+		GeneratorCPUPct:     100 * result.CPUUtilization(),
+		GeneratorMaxRSS:     result.Usage.MaxRSS,
+		GeneratorHeapAlloc:  result.Usage.HeapAlloc,
+		GeneratorNumGC:      result.Usage.NumGC,
+		GeneratorGCPause:    result.Usage.GCPause.Seconds() * 1000,
+		GeneratorSaturation: result.Saturation(),
 	}
-	r.EventsGenerated = r.TransactionsGenerated + r.SpansGenerated + r.ErrorsGenerated
+	r.TestName = testName
+	// Credentials in URLs must not be stored in reports
+	urls := input.ApmServerUrls()
+	for i, u := range urls {
+		urls[i] = redactURL(u)
+	}
+	r.ApmServerUrl = strings.Join(urls, ",")
+	r.ApmElasticsearchUrl = redactURL(r.ApmElasticsearchUrl)
 	r.EventsSent = r.TransactionsSent + r.SpansSent + r.ErrorsSent
+	r.EventsGenerated = r.TransactionsGenerated + r.SpansGenerated + r.ErrorsGenerated
 	r.EventsIndexed = r.TransactionsIndexed + r.SpansIndexed + r.ErrorsIndexed
+	if configRequests := result.ConfigRequests(); configRequests > 0 {
+		r.ConfigLatencyAvg = (result.ConfigLatency / time.Duration(configRequests)).Seconds() * 1000
+		r.ConfigLatencyMax = result.ConfigMaxLatency.Seconds() * 1000
+	}
+	if result.TLSHandshakes > 0 {
+		r.TLSHandshakes = result.TLSHandshakes
+		r.TLSHandshakeAvg = (result.TLSHandshakeTime / time.Duration(result.TLSHandshakes)).Seconds() * 1000
+	}
+	if len(result.Targets) > 1 {
+		r.TargetRequests = make(map[string]uint64, len(result.Targets))
+		r.TargetFailedRequests = make(map[string]uint64, len(result.Targets))
+		r.TargetEventsAccepted = make(map[string]uint64, len(result.Targets))
+		for target, stats := range result.Targets {
+			r.TargetRequests[target] = stats.Requests
+			r.TargetFailedRequests[target] = stats.FailedRequests
+			r.TargetEventsAccepted[target] = stats.EventsAccepted
+		}
+	}
+	if len(result.SimulatedAgents) > 0 {
+		simulated := result.SimulatedTotal()
+		r.SimulatedRequests = simulated.Requests
+		r.SimulatedEventsSent = simulated.EventsSent
+		r.SimulatedEventsAccepted = simulated.EventsAccepted
+		r.SimulatedAgentsAccepted = make(map[string]uint64, len(result.SimulatedAgents))
+		for agent, stats := range result.SimulatedAgents {
+			r.SimulatedAgentsAccepted[agent] = stats.EventsAccepted
+		}
+	}
+	if result.RUMRequests > 0 {
+		r.RUMLatencyAvg = (result.RUMLatency / time.Duration(result.RUMRequests)).Seconds() * 1000
+		r.RUMLatencyMax = result.RUMMaxLatency.Seconds() * 1000
+	}
 
-	info, ierr := server.QueryInfo(input.ApmServerSecret, input.ApmServerUrl)
+	// TLS settings are validated before running
+	tlsConfig, _ := tlsconfig.New(input)
+	// Several apm-servers are expected to run the same version
+	info, ierr := server.NewClient(input.ApmServerUrls()[0], input.ApmServerSecret, input.APIKey, tlsConfig).Info()
 	if ierr == nil {
-		fmt.Println(info)
+		if textOutput(input) {
+			fmt.Println(info)
+		}
 
 		r.ApmBuild = info.BuildSha
 		r.ApmBuildDate = info.BuildDate
@@ -167,7 +418,9 @@ func createReport(input models.Input, testName string, result Result, initialSta
 
 	if initialStatus.Metrics != nil && finalStatus.Metrics != nil {
 		memstats := finalStatus.Metrics.Memstats.Sub(initialStatus.Metrics.Memstats)
-		fmt.Println(memstats)
+		if textOutput(input) {
+			fmt.Println(memstats)
+		}
 
 		r.TotalAlloc = &memstats.TotalAlloc
 		r.HeapAlloc = &memstats.HeapAlloc
@@ -180,6 +433,22 @@ func createReport(input models.Input, testName string, result Result, initialSta
 	return r
 }
 
+// redactURL returns the given URL without userinfo, or as is if it can't be parsed.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	u.User = nil
+	return u.String()
+}
+
+// textOutput returns whether results are printed as text on the standard output,
+// rather than in a machine-readable format.
+func textOutput(input models.Input) bool {
+	return input.Output == "" || input.Output == "text"
+}
+
 // shortId returns a short docId for elasticsearch documents. It is not an UUID
 func shortId() string {
 	b := make([]byte, 16)
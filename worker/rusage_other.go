@@ -0,0 +1,13 @@
+//go:build !darwin && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!freebsd,!linux,!netbsd,!openbsd
+
+package worker
+
+import (
+	"time"
+)
+
+// rusage is not supported on this platform, so CPU time and peak resident set size are unknown.
+func rusage() (time.Duration, uint64) {
+	return 0, 0
+}
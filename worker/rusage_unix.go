@@ -0,0 +1,25 @@
+//go:build darwin || freebsd || linux || netbsd || openbsd
+// +build darwin freebsd linux netbsd openbsd
+
+package worker
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// rusage returns the CPU time spent by the process and its peak resident set size in bytes.
+func rusage() (time.Duration, uint64) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, 0
+	}
+	cpuTime := time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+	maxRSS := uint64(ru.Maxrss)
+	if runtime.GOOS != "darwin" {
+		// kilobytes everywhere else
+		maxRSS *= 1024
+	}
+	return cpuTime, maxRSS
+}
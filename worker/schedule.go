@@ -0,0 +1,86 @@
+package worker
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// unthrottled is the frequency under which events are generated as fast as possible rather than
+// on a schedule (eg. the default of 1ns), so that they never fall behind.
+const unthrottled = time.Microsecond
+
+// schedule tracks how far event generation falls behind its target rate.
+// It is safe for concurrent use.
+type schedule struct {
+	mu        sync.Mutex
+	frequency time.Duration
+	since     time.Time
+	// events due before since, at previous frequencies
+	due       float64
+	generated uint64
+	// events generated before since
+	sinceGenerated uint64
+	stopped        bool
+}
+
+// start schedules an event every frequency from now on.
+func (s *schedule) start(now time.Time, frequency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frequency, s.since, s.sinceGenerated = frequency, now, s.generated
+}
+
+// setFrequency changes the frequency of events from now on.
+func (s *schedule) setFrequency(now time.Time, frequency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.frequency <= 0 || s.stopped {
+		return
+	}
+	s.due = s.dueBy(now)
+	s.frequency, s.since, s.sinceGenerated = frequency, now, s.generated
+}
+
+// dueBy returns the number of events due by now, which are those generated so far
+// while generation is unthrottled. It must be called with the lock held.
+func (s *schedule) dueBy(now time.Time) float64 {
+	if s.frequency < unthrottled {
+		return s.due + float64(s.generated-s.sinceGenerated)
+	}
+	return s.due + float64(now.Sub(s.since))/float64(s.frequency)
+}
+
+// done records that an event was generated.
+func (s *schedule) done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generated++
+}
+
+// stop stops scheduling events, eg. once a limit is reached.
+func (s *schedule) stop(now time.Time) {
+	s.setFrequency(now, s.frequency)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+}
+
+// lag returns how long it would take at the current frequency to generate the events due by now
+// and not generated yet.
+func (s *schedule) lag(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.frequency < unthrottled {
+		return 0
+	}
+	due := s.due
+	if !s.stopped {
+		due = s.dueBy(now)
+	}
+	behind := math.Floor(due) - float64(s.generated)
+	if behind <= 0 {
+		return 0
+	}
+	return time.Duration(behind) * s.frequency
+}
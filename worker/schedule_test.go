@@ -0,0 +1,34 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleLag(t *testing.T) {
+	var s schedule
+	start := time.Now()
+	assert.Zero(t, s.lag(start))
+
+	s.start(start, time.Second)
+	s.done()
+	assert.Zero(t, s.lag(start.Add(1500*time.Millisecond)))
+	assert.Equal(t, 2*time.Second, s.lag(start.Add(3*time.Second)))
+
+	s.setFrequency(start.Add(3*time.Second), 100*time.Millisecond)
+	assert.Equal(t, 1200*time.Millisecond, s.lag(start.Add(4*time.Second)))
+
+	s.stop(start.Add(4 * time.Second))
+	assert.Equal(t, 1200*time.Millisecond, s.lag(start.Add(time.Minute)))
+
+	// events generated as fast as possible are never behind, and are all due once throttled
+	var unthrottled schedule
+	unthrottled.start(start, time.Nanosecond)
+	unthrottled.done()
+	assert.Zero(t, unthrottled.lag(start.Add(time.Minute)))
+	unthrottled.setFrequency(start.Add(time.Minute), time.Second)
+	assert.Zero(t, unthrottled.lag(start.Add(time.Minute+500*time.Millisecond)))
+	assert.Equal(t, 2*time.Second, unthrottled.lag(start.Add(time.Minute+2*time.Second)))
+}
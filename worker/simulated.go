@@ -0,0 +1,536 @@
+package worker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// agentProfile describes the intake payloads of an agent, as far as apm-server tells agents apart.
+type agentProfile struct {
+	defaultVersion string
+	// whether the agent runs in browsers and sends to the RUM endpoint
+	rum bool
+	// agent versions from which events have an outcome
+	outcomeSince string
+
+	language, languageVersion   string
+	runtime, runtimeVersion     string
+	framework, frameworkVersion string
+
+	transactionName, transactionType string
+	spanName                         string
+	spanType, spanSubtype            string
+	errorType, errorMessage          string
+	// frame returns the i-th frame of a stacktrace, shaped as the agent sends them
+	frame func(i int) map[string]interface{}
+}
+
+// agentProfiles holds the agents that can be simulated, by the names they send in metadata.
+var agentProfiles = map[string]agentProfile{
+	"java": {
+		defaultVersion:   "1.30.0",
+		outcomeSince:     "1.20.0",
+		language:         "Java",
+		languageVersion:  "11.0.12",
+		runtime:          "Java",
+		runtimeVersion:   "11.0.12",
+		framework:        "Spring Web MVC",
+		frameworkVersion: "5.3.9",
+		transactionName:  "UserController#getUser",
+		transactionType:  "request",
+		spanName:         "SELECT FROM users",
+		spanType:         "db",
+		spanSubtype:      "postgresql",
+		errorType:        "java.lang.NullPointerException",
+		errorMessage:     "Cannot invoke \"User.getName()\" because \"user\" is null",
+		frame: func(i int) map[string]interface{} {
+			return map[string]interface{}{
+				"classname":     "co.elastic.hey.UserService",
+				"function":      fmt.Sprintf("method%d", i),
+				"filename":      "UserService.java",
+				"module":        "co.elastic.hey",
+				"lineno":        40 + i,
+				"library_frame": false,
+			}
+		},
+	},
+	"nodejs": {
+		defaultVersion:   "3.26.0",
+		outcomeSince:     "3.11.0",
+		language:         "javascript",
+		runtime:          "node",
+		runtimeVersion:   "14.17.5",
+		framework:        "express",
+		frameworkVersion: "4.17.1",
+		transactionName:  "GET /users/:id",
+		transactionType:  "request",
+		spanName:         "SELECT",
+		spanType:         "db",
+		spanSubtype:      "mysql",
+		errorType:        "TypeError",
+		errorMessage:     "Cannot read property 'name' of undefined",
+		frame: func(i int) map[string]interface{} {
+			return map[string]interface{}{
+				"filename":      "lib/users.js",
+				"abs_path":      "/app/lib/users.js",
+				"function":      fmt.Sprintf("handler%d", i),
+				"lineno":        20 + i,
+				"colno":         12,
+				"library_frame": false,
+				"pre_context":   []string{"", "async function handler() {"},
+				"context_line":  "  const user = await db.query(sql)",
+				"post_context":  []string{"  return user.name", "}"},
+			}
+		},
+	},
+	"python": {
+		defaultVersion:   "6.7.2",
+		outcomeSince:     "6.0.0",
+		language:         "python",
+		languageVersion:  "3.9.6",
+		runtime:          "CPython",
+		runtimeVersion:   "3.9.6",
+		framework:        "flask",
+		frameworkVersion: "2.0.1",
+		transactionName:  "GET /users/<int:user_id>",
+		transactionType:  "request",
+		spanName:         "SELECT FROM users",
+		spanType:         "db",
+		spanSubtype:      "postgresql",
+		errorType:        "AttributeError",
+		errorMessage:     "'NoneType' object has no attribute 'name'",
+		frame: func(i int) map[string]interface{} {
+			return map[string]interface{}{
+				"filename":      "app/views.py",
+				"abs_path":      "/app/app/views.py",
+				"module":        "app.views",
+				"function":      fmt.Sprintf("view_%d", i),
+				"lineno":        30 + i,
+				"library_frame": false,
+				"pre_context":   []string{"@app.route(\"/users/<int:user_id>\")", "def get_user(user_id):"},
+				"context_line":  "    user = User.query.get(user_id)",
+				"post_context":  []string{"    return user.name"},
+				"vars":          map[string]interface{}{"user_id": "42"},
+			}
+		},
+	},
+	"dotnet": {
+		defaultVersion:   "1.14.1",
+		outcomeSince:     "1.7.0",
+		language:         "C#",
+		runtime:          ".NET 5",
+		runtimeVersion:   "5.0.9",
+		framework:        "ASP.NET Core",
+		frameworkVersion: "5.0.0",
+		transactionName:  "GET Users/GetUser {id}",
+		transactionType:  "request",
+		spanName:         "SELECT FROM Users",
+		spanType:         "db",
+		spanSubtype:      "mssql",
+		errorType:        "System.NullReferenceException",
+		errorMessage:     "Object reference not set to an instance of an object.",
+		frame: func(i int) map[string]interface{} {
+			return map[string]interface{}{
+				"classname": "Hey.Controllers.UsersController",
+				"function":  fmt.Sprintf("Method%d", i),
+				"filename":  "UsersController.cs",
+				"abs_path":  "/src/Hey/Controllers/UsersController.cs",
+				"module":    "Hey, Version=1.0.0.0, Culture=neutral, PublicKeyToken=null",
+				"lineno":    25 + i,
+			}
+		},
+	},
+	"rum-js": {
+		defaultVersion:  "5.9.1",
+		rum:             true,
+		outcomeSince:    "5.6.0",
+		language:        "javascript",
+		transactionName: "/users/:id",
+		transactionType: "page-load",
+		spanName:        "GET /api/users",
+		spanType:        "external",
+		spanSubtype:     "http",
+		errorType:       "TypeError",
+		errorMessage:    "Uncaught TypeError: Cannot read property 'name' of undefined",
+		frame: func(i int) map[string]interface{} {
+			return map[string]interface{}{
+				"abs_path": fmt.Sprintf(bundleURL, bundleFile(unmappedBundle)),
+				"filename": "static/" + bundleFile(unmappedBundle),
+				"function": fmt.Sprintf("generated%d", i),
+				"lineno":   1,
+				"colno":    100 * (i + 1),
+			}
+		},
+	},
+}
+
+// agentAliases maps other common names of agents to those they send.
+var agentAliases = map[string]string{
+	"node":    "nodejs",
+	".net":    "dotnet",
+	"rum":     "rum-js",
+	"js-base": "rum-js",
+}
+
+// simulatedAgent is an agent of another language simulated with raw intake payloads.
+type simulatedAgent struct {
+	name    string
+	version string
+	// relative share of the payloads sent by this agent
+	weight int
+	agentProfile
+}
+
+// String returns the name and version of the agent.
+func (a simulatedAgent) String() string {
+	return a.name + "/" + a.version
+}
+
+// newSimulatedAgents parses agents given as name[/version][=weight], with the default version of the agent
+// and a weight of 1 if not set.
+func newSimulatedAgents(specs []string) ([]simulatedAgent, error) {
+	var agents []simulatedAgent
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		agent := simulatedAgent{weight: 1}
+		if sep := strings.IndexRune(spec, '='); sep >= 0 {
+			weight, err := strconv.Atoi(spec[sep+1:])
+			if err != nil || weight < 1 {
+				return nil, errors.Errorf("invalid weight of simulated agent %q, must be a positive integer", spec)
+			}
+			agent.weight, spec = weight, spec[:sep]
+		}
+		if sep := strings.IndexRune(spec, '/'); sep >= 0 {
+			agent.version, spec = spec[sep+1:], spec[:sep]
+		}
+		agent.name = strings.ToLower(spec)
+		if name, ok := agentAliases[agent.name]; ok {
+			agent.name = name
+		}
+		profile, ok := agentProfiles[agent.name]
+		if !ok {
+			return nil, errors.Errorf("unknown simulated agent %q, must be one of %s",
+				spec, strings.Join(SimulatedAgentNames(), ", "))
+		}
+		agent.agentProfile = profile
+		if agent.version == "" {
+			agent.version = profile.defaultVersion
+		}
+		agents = append(agents, agent)
+	}
+	return agents, nil
+}
+
+// SimulatedAgentNames returns the names of the agents that can be simulated.
+func SimulatedAgentNames() []string {
+	names := make([]string, 0, len(agentProfiles))
+	for name := range agentProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// versionAtLeast returns whether a dotted version is the same or above another one,
+// comparing numeric components and ignoring any suffix.
+func versionAtLeast(version, since string) bool {
+	v, s := strings.Split(version, "."), strings.Split(since, ".")
+	for i := range s {
+		var a, b int
+		if i < len(v) {
+			a, _ = strconv.Atoi(strings.TrimLeft(strings.SplitN(v[i], "-", 2)[0], "v"))
+		}
+		b, _ = strconv.Atoi(s[i])
+		if a != b {
+			return a > b
+		}
+	}
+	return true
+}
+
+// simulatedRequestKey is the context key of the simulated agent sending an intake request.
+type simulatedRequestKey struct{}
+
+// simulatedRequest describes an intake request sent by a simulated agent.
+type simulatedRequest struct {
+	agent string
+	// service is the name of the service of the agent, which requests are routed on
+	service string
+	events  uint64
+}
+
+// simulatedRequestFrom returns the simulated agent sending a request, if any.
+func simulatedRequestFrom(ctx context.Context) (simulatedRequest, bool) {
+	sim, ok := ctx.Value(simulatedRequestKey{}).(simulatedRequest)
+	return sim, ok
+}
+
+// simulatedSender sends intake requests with metadata and events shaped as agents of other languages would.
+type simulatedSender struct {
+	client *http.Client
+	// authorization is the Authorization header sent by backend agents, RUM agents don't send credentials
+	authorization string
+	logger        *apmLogger
+	serverURL     string
+	serviceName   string
+	agents        []simulatedAgent
+	frequency     time.Duration
+	minSpans      int
+	maxSpans      int
+	// fraction of transactions sent along an error
+	errorRate float64
+	minFrames int
+	maxFrames int
+}
+
+// run sends a payload of one of the agents, picked according to their weights, up to once per frequency,
+// until the context is cancelled.
+func (s simulatedSender) run(ctx context.Context) {
+	if s.frequency <= 0 || len(s.agents) == 0 {
+		return
+	}
+	if s.maxSpans < s.minSpans {
+		s.maxSpans = s.minSpans
+	}
+	if s.minFrames < 1 {
+		s.minFrames = 1
+	}
+	if s.maxFrames < s.minFrames {
+		s.maxFrames = s.minFrames
+	}
+	var total int
+	for _, agent := range s.agents {
+		total += agent.weight
+	}
+	go func() {
+		ticker := time.NewTicker(s.frequency)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			pick := rand.Intn(total)
+			agent := s.agents[0]
+			for _, agent = range s.agents {
+				if pick -= agent.weight; pick < 0 {
+					break
+				}
+			}
+			if err := s.send(ctx, agent); err != nil && ctx.Err() == nil {
+				s.logger.Debugf("simulated %s request failed: %s", agent, err)
+			}
+		}
+	}()
+}
+
+func (s simulatedSender) send(ctx context.Context, agent simulatedAgent) error {
+	body, events := s.payload(agent)
+	path, encoding := "/intake/v2/events", "gzip"
+	if agent.rum {
+		path, encoding = "/intake/v2/rum/events", ""
+	}
+	if encoding == "gzip" {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write(body)
+		gw.Close()
+		body = buf.Bytes()
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(s.serverURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(context.WithValue(ctx, simulatedRequestKey{}, simulatedRequest{
+		agent:   agent.String(),
+		service: s.service(agent),
+		events:  events,
+	}))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if agent.rum {
+		req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/92.0.4515.159 Safari/537.36")
+	} else {
+		req.Header.Set("User-Agent", fmt.Sprintf("elasticapm-%s/%s", agent.name, agent.version))
+		if s.authorization != "" {
+			req.Header.Set("Authorization", s.authorization)
+		}
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// payload returns the NDJSON body of an intake request with metadata, a transaction, its spans
+// and possibly an error, along with the number of events.
+func (s simulatedSender) payload(agent simulatedAgent) ([]byte, uint64) {
+	now := time.Now()
+	timestamp := func(offset time.Duration) int64 {
+		return now.Add(offset).UnixNano() / int64(time.Microsecond)
+	}
+	traceID := fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+	transactionID := fmt.Sprintf("%016x", rand.Uint64())
+	outcome := versionAtLeast(agent.version, agent.outcomeSince)
+
+	lines := [][]byte{s.metadata(agent)}
+	add := func(kind string, event map[string]interface{}) {
+		line, _ := json.Marshal(map[string]interface{}{kind: event})
+		lines = append(lines, line)
+	}
+
+	spans := randRange(s.minSpans, s.maxSpans)
+	transaction := map[string]interface{}{
+		"id":         transactionID,
+		"trace_id":   traceID,
+		"name":       agent.transactionName,
+		"type":       agent.transactionType,
+		"timestamp":  timestamp(-100 * time.Millisecond),
+		"duration":   100.0,
+		"sampled":    true,
+		"span_count": map[string]interface{}{"started": spans, "dropped": 0},
+	}
+	if agent.rum {
+		transaction["context"] = map[string]interface{}{
+			"page": map[string]interface{}{"url": "http://hey-apm.local/users/42", "referer": "http://hey-apm.local/"},
+		}
+		transaction["marks"] = map[string]interface{}{
+			"agent":            map[string]interface{}{"domComplete": 80.5, "timeToFirstByte": 12.3},
+			"navigationTiming": map[string]interface{}{"fetchStart": 0, "responseEnd": 15.2},
+		}
+	} else {
+		transaction["result"] = "HTTP 2xx"
+		transaction["context"] = map[string]interface{}{
+			"request": map[string]interface{}{
+				"method": "GET",
+				"url": map[string]interface{}{
+					"full": "http://hey-apm.local/users/42", "protocol": "http:", "hostname": "hey-apm.local", "pathname": "/users/42",
+				},
+				"headers": map[string]interface{}{"user-agent": "curl/7.68.0"},
+			},
+			"response": map[string]interface{}{"status_code": 200},
+		}
+	}
+	if outcome {
+		transaction["outcome"] = "success"
+	}
+	add("transaction", transaction)
+
+	for i := 0; i < spans; i++ {
+		span := map[string]interface{}{
+			"id":             fmt.Sprintf("%016x", rand.Uint64()),
+			"trace_id":       traceID,
+			"transaction_id": transactionID,
+			"parent_id":      transactionID,
+			"name":           agent.spanName,
+			"type":           agent.spanType,
+			"subtype":        agent.spanSubtype,
+			"timestamp":      timestamp(time.Duration(i-spans-1) * time.Millisecond),
+			"duration":       1.0,
+		}
+		if agent.rum {
+			span["context"] = map[string]interface{}{
+				"http": map[string]interface{}{"url": "http://hey-apm.local/api/users/42", "method": "GET", "status_code": 200},
+			}
+		} else if i%2 == 1 {
+			// Unlike the Go agent, agents of other languages send the message context of messaging spans
+			span["name"], span["type"], span["subtype"], span["action"] = "Kafka SEND to orders", "messaging", "kafka", "send"
+			span["context"] = map[string]interface{}{
+				"message": map[string]interface{}{"queue": map[string]interface{}{"name": "orders"}},
+				"destination": map[string]interface{}{
+					"address": "kafka.hey-apm.local",
+					"port":    9092,
+					"service": map[string]interface{}{"name": "kafka", "resource": "kafka/orders", "type": "messaging"},
+				},
+			}
+		} else {
+			span["action"] = "query"
+			span["context"] = map[string]interface{}{
+				"db": map[string]interface{}{"type": "sql", "instance": "users", "statement": "SELECT * FROM users WHERE id = ?"},
+			}
+		}
+		if !agent.rum {
+			// Backend agents capture where spans were started
+			frames := make([]map[string]interface{}, 3)
+			for j := range frames {
+				frames[j] = agent.frame(j)
+			}
+			span["stacktrace"] = frames
+		}
+		if outcome {
+			span["outcome"] = "success"
+		}
+		add("span", span)
+	}
+
+	events := uint64(1 + spans)
+	if s.errorRate > 0 && rand.Float64() < s.errorRate {
+		frames := make([]map[string]interface{}, randRange(s.minFrames, s.maxFrames))
+		for i := range frames {
+			frames[i] = agent.frame(i)
+		}
+		add("error", map[string]interface{}{
+			"id":             fmt.Sprintf("%016x", rand.Uint64()),
+			"trace_id":       traceID,
+			"transaction_id": transactionID,
+			"parent_id":      transactionID,
+			"timestamp":      timestamp(0),
+			"culprit":        frames[0]["filename"],
+			"exception": map[string]interface{}{
+				"type":       agent.errorType,
+				"message":    agent.errorMessage,
+				"stacktrace": frames,
+			},
+		})
+		events++
+	}
+	return append(bytes.Join(lines, []byte("\n")), '\n'), events
+}
+
+// service returns the name of the service of a simulated agent.
+func (s simulatedSender) service(agent simulatedAgent) string {
+	return s.serviceName + "-" + agent.name
+}
+
+// metadata returns the metadata line of a payload, with service, process and system for backend agents.
+func (s simulatedSender) metadata(agent simulatedAgent) []byte {
+	language := map[string]interface{}{"name": agent.language}
+	if agent.languageVersion != "" {
+		language["version"] = agent.languageVersion
+	}
+	service := map[string]interface{}{
+		"name":        s.service(agent),
+		"version":     "1.0.0",
+		"environment": "hey-apm",
+		"agent":       map[string]interface{}{"name": agent.name, "version": agent.version},
+		"language":    language,
+	}
+	metadata := map[string]interface{}{"service": service}
+	if !agent.rum {
+		service["runtime"] = map[string]interface{}{"name": agent.runtime, "version": agent.runtimeVersion}
+		service["framework"] = map[string]interface{}{"name": agent.framework, "version": agent.frameworkVersion}
+		metadata["process"] = map[string]interface{}{"pid": 1, "title": agent.runtime, "argv": []string{agent.runtime}}
+		metadata["system"] = map[string]interface{}{"hostname": "hey-apm-" + agent.name, "architecture": "amd64", "platform": "linux"}
+	}
+	line, _ := json.Marshal(map[string]interface{}{"metadata": metadata})
+	return line
+}
@@ -0,0 +1,53 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulatedPayload(t *testing.T) {
+	agents, err := newSimulatedAgents([]string{"java/1.10.0=3", " .NET/1.8.0", "rum-js"})
+	require.NoError(t, err)
+	require.Len(t, agents, 3)
+	assert.Equal(t, "java/1.10.0", agents[0].String())
+	assert.Equal(t, 3, agents[0].weight)
+	assert.Equal(t, "dotnet/1.8.0", agents[1].String())
+	assert.Equal(t, "rum-js/5.9.1", agents[2].String())
+	_, err = newSimulatedAgents([]string{"java=0"})
+	assert.Error(t, err)
+
+	assert.True(t, versionAtLeast("1.20.0", "1.20.0"))
+	assert.True(t, versionAtLeast("v14.2", "3.11.0"))
+	assert.False(t, versionAtLeast("1.9.10", "1.20.0"))
+
+	s := simulatedSender{serviceName: "svc", minSpans: 2, maxSpans: 2, errorRate: 1, minFrames: 1, maxFrames: 1}
+	for _, agent := range agents {
+		payload, events := s.payload(agent)
+		lines := bytes.Split(bytes.TrimSpace(payload), []byte("\n"))
+		require.Len(t, lines, 5, agent)
+		assert.Equal(t, uint64(4), events)
+
+		var metadata struct {
+			Metadata struct {
+				Service struct {
+					Name  string
+					Agent struct{ Name, Version string }
+				}
+				System map[string]interface{}
+			}
+		}
+		require.NoError(t, json.Unmarshal(lines[0], &metadata))
+		assert.Equal(t, "svc-"+agent.name, metadata.Metadata.Service.Name)
+		assert.Equal(t, agent.version, metadata.Metadata.Service.Agent.Version)
+		assert.Equal(t, agent.rum, metadata.Metadata.System == nil)
+		// Old Java agents don't send outcomes
+		assert.Equal(t, agent.name != "java", bytes.Contains(lines[1], []byte(`"outcome"`)), agent)
+		// Spans of backend agents are database and messaging spans in turn
+		assert.Equal(t, !agent.rum, bytes.Contains(lines[2], []byte(`"db":`)), agent)
+		assert.Equal(t, !agent.rum, bytes.Contains(lines[3], []byte(`"message":{"queue":{"name":"orders"}}`)), agent)
+	}
+}
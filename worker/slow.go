@@ -0,0 +1,200 @@
+package worker
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxDisconnectOffset is the maximum number of bytes sent before disconnecting mid-stream.
+const maxDisconnectOffset = 64 * 1024
+
+var errDisconnect = errors.New("disconnected mid-stream on purpose")
+
+// slowClient makes intake requests behave like slow or misbehaving agents.
+type slowClient struct {
+	// bytes uploaded per second, or 0 to upload at full speed
+	trickleRate int
+	// time to keep streams open after the agent finished writing them
+	hold time.Duration
+	// fraction of requests aborted mid-stream, between 0 and 1
+	disconnectRate float64
+}
+
+// newSlowClient returns a slowClient with the given behaviours, or nil if there are none.
+func newSlowClient(trickleRate int, hold time.Duration, disconnectRate float64) (*slowClient, error) {
+	if disconnectRate < 0 || disconnectRate > 1 {
+		return nil, errors.Errorf("disconnect rate must be between 0 and 1, got %v", disconnectRate)
+	}
+	if trickleRate <= 0 && hold <= 0 && disconnectRate == 0 {
+		return nil, nil
+	}
+	return &slowClient{trickleRate: trickleRate, hold: hold, disconnectRate: disconnectRate}, nil
+}
+
+// wrap returns a copy of an intake request whose body is uploaded slowly, held open or cut short.
+func (c *slowClient) wrap(req *http.Request) *http.Request {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req
+	}
+	body := &slowBody{ReadCloser: req.Body, ctx: req.Context(), client: c, disconnectAt: -1}
+	if rand.Float64() < c.disconnectRate {
+		body.disconnectAt = rand.Intn(maxDisconnectOffset)
+	}
+	req = req.Clone(req.Context())
+	req.Body = body
+	req.GetBody = nil
+	return req
+}
+
+type slowBody struct {
+	io.ReadCloser
+	ctx          context.Context
+	client       *slowClient
+	read         int
+	disconnectAt int // number of bytes to send before disconnecting, or -1
+	held         bool
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	if b.disconnectAt >= 0 {
+		if b.read >= b.disconnectAt {
+			return 0, errDisconnect
+		}
+		if remaining := b.disconnectAt - b.read; len(p) > remaining {
+			p = p[:remaining]
+		}
+	}
+	if rate := b.client.trickleRate; rate > 0 {
+		// send at most a tenth of a second worth of bytes at a time
+		if chunk := rate/10 + 1; len(p) > chunk {
+			p = p[:chunk]
+		}
+		if err := b.sleep(time.Duration(len(p)) * time.Second / time.Duration(rate)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += n
+	if err == io.EOF && b.disconnectAt >= 0 {
+		// the stream ended before reaching the disconnection point, cut it short anyway
+		return n, errDisconnect
+	}
+	if err == io.EOF && !b.held && b.client.hold > 0 {
+		b.held = true
+		if err := b.sleep(b.client.hold); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (b *slowBody) sleep(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-b.ctx.Done():
+		return b.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// holdIdleConnections keeps n keep-alive connections open to apm-servers without sending any events,
+// spread across them in turn, until the context is cancelled. Connections closed by apm-server are opened again.
+func holdIdleConnections(ctx context.Context, logger *apmLogger, serverURLs []string, tlsConfig *tls.Config, n int) {
+	targets := make([]*url.URL, len(serverURLs))
+	for i, serverURL := range serverURLs {
+		u, err := url.Parse(serverURL)
+		if err != nil {
+			logger.Errorf("invalid server URL: %s", err)
+			return
+		}
+		targets[i] = u
+	}
+	for i := 0; i < n; i++ {
+		u := targets[i%len(targets)]
+		go func() {
+			for {
+				if err := holdIdleConnection(ctx, u, tlsConfig); err != nil && ctx.Err() == nil {
+					logger.Debugf("idle connection closed: %s", err)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+			}
+		}()
+	}
+}
+
+// holdIdleConnection sends a single request over a new keep-alive connection, and waits for either
+// apm-server or the context to close it.
+func holdIdleConnection(ctx context.Context, u *url.URL, tlsConfig *tls.Config) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort(u))
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "https" {
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		conn = tls.Client(conn, config)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Connection", "keep-alive")
+	req.Header.Set("User-Agent", "hey-apm")
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	// idle until the connection is closed
+	_, err = r.ReadByte()
+	return err
+}
+
+// hostPort returns the host and port of a URL, with the default port of its scheme if none is set.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
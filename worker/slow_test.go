@@ -0,0 +1,92 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowClient(t *testing.T) {
+	_, err := newSlowClient(0, 0, 2)
+	assert.Error(t, err)
+	c, err := newSlowClient(0, 0, 0)
+	require.NoError(t, err)
+	assert.Nil(t, c)
+
+	newRequest := func(ctx context.Context, size int) *http.Request {
+		req, err := http.NewRequest(http.MethodPost, "http://apm-server/intake/v2/events", bytes.NewReader(make([]byte, size)))
+		require.NoError(t, err)
+		return req.WithContext(ctx)
+	}
+	ctx := context.Background()
+
+	// streams are cut short wherever the disconnection happens
+	c = &slowClient{disconnectRate: 1}
+	for _, size := range []int{10, 2 * maxDisconnectOffset} {
+		data, err := ioutil.ReadAll(c.wrap(newRequest(ctx, size)).Body)
+		assert.Equal(t, errDisconnect, err)
+		assert.True(t, len(data) < maxDisconnectOffset)
+	}
+
+	c = &slowClient{trickleRate: 10000}
+	req := newRequest(ctx, 1000)
+	start := time.Now()
+	data, err := ioutil.ReadAll(c.wrap(req).Body)
+	require.NoError(t, err)
+	assert.Len(t, data, 1000)
+	assert.True(t, time.Since(start) >= 90*time.Millisecond, time.Since(start))
+
+	c = &slowClient{hold: 50 * time.Millisecond}
+	start = time.Now()
+	_, err = ioutil.ReadAll(c.wrap(newRequest(ctx, 10)).Body)
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond, time.Since(start))
+
+	// slow requests give up once cancelled
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = ioutil.ReadAll(c.wrap(newRequest(cancelled, 10)).Body)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestHoldIdleConnections(t *testing.T) {
+	var open int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt64(&open, 1)
+		case http.StateClosed, http.StateHijacked:
+			atomic.AddInt64(&open, -1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	holdIdleConnections(ctx, newApmLogger(log.New(ioutil.Discard, "", 0)), []string{srv.URL}, nil, 3)
+	waitFor(t, func() bool { return atomic.LoadInt64(&open) == 3 })
+	cancel()
+	waitFor(t, func() bool { return atomic.LoadInt64(&open) == 0 })
+}
+
+// waitFor polls cond until it is true, and fails the test if it isn't within 5 seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 5s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
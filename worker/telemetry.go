@@ -0,0 +1,36 @@
+package worker
+
+import (
+	"github.com/elastic/hey-apm/models"
+)
+
+// telemetry computes samples from the difference between consecutive stats of a worker.
+type telemetry struct {
+	last    Result
+	samples []models.Sample
+}
+
+// sample appends the rates since the last stats, taken at last.End, to the stats taken at current.End.
+func (t *telemetry) sample(current Result) {
+	seconds := current.End.Sub(t.last.End).Seconds()
+	if seconds <= 0 {
+		return
+	}
+	rate := func(current, last uint64) float64 {
+		return float64(current-last) / seconds
+	}
+	dropped := current.ErrorsDropped + current.TransactionsDropped + current.SpansDropped
+	lastDropped := t.last.ErrorsDropped + t.last.TransactionsDropped + t.last.SpansDropped
+	t.samples = append(t.samples, models.Sample{
+		Timestamp:      current.End,
+		Elapsed:        current.End.Sub(current.Start).Seconds(),
+		Interval:       seconds,
+		Generated:      rate(current.Generated, t.last.Generated),
+		Sent:           rate(current.EventsSent(), t.last.EventsSent()),
+		Dropped:        rate(dropped, lastDropped),
+		Accepted:       rate(current.EventsAccepted, t.last.EventsAccepted),
+		Requests:       rate(current.NumRequests, t.last.NumRequests),
+		FailedRequests: rate(current.Errors.SendStream, t.last.Errors.SendStream),
+	})
+	t.last = current
+}
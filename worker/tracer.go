@@ -2,15 +2,21 @@ package worker
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
+	"net/http/httptrace"
+	"os"
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"go.elastic.co/apm"
 	apmtransport "go.elastic.co/apm/transport"
+
+	"github.com/elastic/hey-apm/server"
 )
 
 type tracer struct {
@@ -21,7 +27,29 @@ type tracer struct {
 func (t *tracer) TransportStats() TransportStats {
 	t.roundTripper.statsMu.RLock()
 	defer t.roundTripper.statsMu.RUnlock()
-	return t.roundTripper.stats
+	stats := t.roundTripper.stats
+	stats.Rejections = make(map[string]uint64, len(stats.Rejections))
+	for reason, n := range t.roundTripper.stats.Rejections {
+		stats.Rejections[reason] = n
+	}
+	stats.IntakeResponses = make(map[int]uint64, len(stats.IntakeResponses))
+	for code, n := range t.roundTripper.stats.IntakeResponses {
+		stats.IntakeResponses[code] = n
+	}
+	stats.IntakeLatency.Counts = append([]uint64(nil), stats.IntakeLatency.Counts...)
+	stats.ConfigResponses = make(map[int]uint64, len(stats.ConfigResponses))
+	for code, n := range t.roundTripper.stats.ConfigResponses {
+		stats.ConfigResponses[code] = n
+	}
+	stats.Targets = make(map[string]TargetStats, len(stats.Targets))
+	for target, s := range t.roundTripper.stats.Targets {
+		stats.Targets[target] = s
+	}
+	stats.SimulatedAgents = make(map[string]AgentStats, len(stats.SimulatedAgents))
+	for agent, s := range t.roundTripper.stats.SimulatedAgents {
+		stats.SimulatedAgents[agent] = s
+	}
+	return stats
 }
 
 // TransportStats are captured by reading apm-server responses.
@@ -29,14 +57,89 @@ type TransportStats struct {
 	EventsAccepted uint64
 	UniqueErrors   []string
 	NumRequests    uint64
+	// Rejections counts the errors returned by apm-server, by reason
+	Rejections map[string]uint64
+	// IntakeResponses counts intake responses by status code, with 0 for failed requests
+	IntakeResponses map[int]uint64
+	// IntakeLatency is the distribution of the time to get a response to intake requests
+	IntakeLatency Histogram
+	// FailedEvents counts the transactions, spans and errors in failed intake requests
+	FailedEvents uint64
+	// Targets breaks down intake requests by apm-server URL
+	Targets map[string]TargetStats
+
+	// ConfigResponses counts agent config responses by status code, with 0 for failed requests
+	ConfigResponses map[int]uint64
+	// ConfigLatency adds up the time to get a response to agent config requests
+	ConfigLatency time.Duration
+	// ConfigMaxLatency is the longest time to get a response to an agent config request
+	ConfigMaxLatency time.Duration
+
+	// SimulatedAgents breaks down the intake requests of agents of other languages by name and version
+	SimulatedAgents map[string]AgentStats
+
+	// RUMRequests counts the RUM intake requests sent, each one with a single error
+	RUMRequests uint64
+	// RUMEventsAccepted counts the RUM events accepted by apm-server
+	RUMEventsAccepted uint64
+	// RUMLatency adds up the time to get a response to RUM intake requests
+	RUMLatency time.Duration
+	// RUMMaxLatency is the longest time to get a response to a RUM intake request
+	RUMMaxLatency time.Duration
+
+	// TLSHandshakes counts the TLS handshakes made with apm-server, including failed ones
+	TLSHandshakes      uint64
+	TLSHandshakeErrors uint64
+	// TLSHandshakeTime adds up the time spent in TLS handshakes
+	TLSHandshakeTime time.Duration
+}
+
+// TargetStats are the transport stats of intake requests sent to a single apm-server.
+type TargetStats struct {
+	Requests uint64
+	// FailedRequests counts the requests that failed or got an error response
+	FailedRequests uint64
+	EventsAccepted uint64
+	// Latency adds up the time to get a response
+	Latency time.Duration
 }
 
+// AgentStats are the transport stats of intake requests sent by a simulated agent.
+type AgentStats struct {
+	Requests uint64
+	// FailedRequests counts the requests that failed or got an error response
+	FailedRequests uint64
+	// EventsSent counts the events in successful requests
+	EventsSent     uint64
+	EventsAccepted uint64
+}
+
+// agentTuning holds settings of the Go agent, which keep their default values if zero.
+type agentTuning struct {
+	bufferSize       int
+	requestSize      int
+	requestTime      time.Duration
+	compressionLevel int
+	// negative for no limit
+	maxSpans int
+}
+
+// tracerEnvMu serializes the creation of tracers, which read some settings from the environment.
+var tracerEnvMu sync.Mutex
+
 // newTracer returns a wrapper with a new Go agent instance and its transport stats.
 func newTracer(
 	logger apm.Logger,
-	serverURL, serverSecret, apiKey, serviceName string,
-	maxSpans int,
+	client *server.Client,
+	balancer *balancer,
+	serviceName string,
+	tuning agentTuning,
+	chaos *chaos,
+	slow *slowClient,
 ) (*tracer, error) {
+	if err := checkCompressionLevel(tuning.compressionLevel); err != nil {
+		return nil, err
+	}
 
 	// Ensure that each tracer uses an independent transport.
 	transport, err := apmtransport.NewHTTPTransport()
@@ -44,51 +147,142 @@ func newTracer(
 		return nil, err
 	}
 	transport.SetUserAgent("hey-apm")
-	if apiKey != "" {
-		transport.SetAPIKey(apiKey)
-	} else if serverSecret != "" {
-		transport.SetSecretToken(serverSecret)
-	}
-	if serverURL != "" {
-		u, err := url.Parse(serverURL)
-		if err != nil {
-			panic(err)
-		}
-		transport.SetServerURL(u)
-	}
-	roundTripper := &roundTripperWrapper{
-		roundTripper: transport.Client.Transport,
-		logger:       logger,
-		uniqueErrors: make(map[string]struct{}),
+	if err := client.ConfigureTransport(transport); err != nil {
+		return nil, err
 	}
+	roundTripper := newRoundTripper(transport.Client.Transport, logger, balancer, serviceName,
+		tuning.compressionLevel, chaos, slow)
 	transport.Client.Transport = roundTripper
 
-	goTracer, err := apm.NewTracerOptions(apm.TracerOptions{
+	goTracer, err := newGoTracer(apm.TracerOptions{
 		ServiceName: serviceName,
 		Transport:   transport,
-	})
+	}, tuning)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "invalid Go agent settings")
 	}
 	goTracer.SetLogger(logger)
 	goTracer.SetMetricsInterval(0) // disable metrics
 	goTracer.SetSpanFramesMinDuration(1 * time.Nanosecond)
-	goTracer.SetMaxSpans(maxSpans)
+	goTracer.SetMaxSpans(tuning.maxSpans)
+	if tuning.requestTime > 0 {
+		goTracer.SetRequestDuration(tuning.requestTime)
+	}
 	return &tracer{Tracer: goTracer, roundTripper: roundTripper}, nil
 }
 
+// newGoTracer returns a Go agent instance with the buffer and request sizes of tuning.
+// Go agent v1.8 only reads these from the environment, with no tracer option or setter for them,
+// and the environment is shared by the whole process: the variables are set while the tracer is created
+// and unset afterwards, so anything else reading them meanwhile sees them too.
+func newGoTracer(opts apm.TracerOptions, tuning agentTuning) (*apm.Tracer, error) {
+	tracerEnvMu.Lock()
+	defer tracerEnvMu.Unlock()
+	env, err := tuning.env(os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range env {
+		defer os.Unsetenv(k)
+		os.Setenv(k, v)
+	}
+	return apm.NewTracerOptions(opts)
+}
+
+// env returns the environment variables to set for the buffer and request sizes, unless already set
+// by the user with the same value. Variables set by the user with a different value are an error,
+// rather than being silently overridden.
+func (t agentTuning) env(lookupEnv func(string) (string, bool)) (map[string]string, error) {
+	sizes := map[string]int{
+		"ELASTIC_APM_API_BUFFER_SIZE":  t.bufferSize,
+		"ELASTIC_APM_API_REQUEST_SIZE": t.requestSize,
+	}
+	env := make(map[string]string)
+	for k, size := range sizes {
+		if size <= 0 {
+			continue
+		}
+		v := fmt.Sprintf("%dB", size)
+		if previous, ok := lookupEnv(k); ok {
+			if previous != v {
+				return nil, errors.Errorf("%s=%s is set in the environment, and conflicts with %s", k, previous, v)
+			}
+			continue
+		}
+		env[k] = v
+	}
+	return env, nil
+}
+
 type roundTripperWrapper struct {
 	roundTripper http.RoundTripper
 	logger       apm.Logger
+	// balancer routes requests to one of the apm-servers, for the service sending them
+	balancer    *balancer
+	serviceName string
+	chaos       *chaos
+	slow        *slowClient
+	// zlib level to compress intake requests again with, 0 to send them as compressed by the agent
+	compression int
 
 	statsMu      sync.RWMutex
 	stats        TransportStats
 	uniqueErrors map[string]struct{}
+	// counting is the number of failed requests whose events are yet to be counted, guarded by statsMu,
+	// and counted receives a value whenever the events of one of them are
+	counting int
+	counted  chan struct{}
+}
+
+// newRoundTripper returns a wrapper of roundTripper routing requests with balancer and counting them,
+// which recompresses intake requests of the Go agent with compression unless 0, and breaks them with chaos
+// and slow unless nil.
+func newRoundTripper(
+	roundTripper http.RoundTripper,
+	logger apm.Logger,
+	balancer *balancer,
+	serviceName string,
+	compression int,
+	chaos *chaos,
+	slow *slowClient,
+) *roundTripperWrapper {
+	return &roundTripperWrapper{
+		roundTripper: roundTripper,
+		logger:       logger,
+		balancer:     balancer,
+		serviceName:  serviceName,
+		chaos:        chaos,
+		slow:         slow,
+		compression:  compression,
+		uniqueErrors: make(map[string]struct{}),
+		counted:      make(chan struct{}, 1),
+		stats: TransportStats{
+			Rejections:      make(map[string]uint64),
+			IntakeResponses: make(map[int]uint64),
+			ConfigResponses: make(map[int]uint64),
+			Targets:         make(map[string]TargetStats),
+			SimulatedAgents: make(map[string]AgentStats),
+		},
+	}
 }
 
 func (rt *roundTripperWrapper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = rt.traceTLS(req)
+	service := rt.serviceName
+	if s := req.URL.Query().Get("service.name"); s != "" {
+		// Agent config requests are sent on behalf of other services
+		service = s
+	} else if sim, ok := simulatedRequestFrom(req.Context()); ok {
+		service = sim.service
+	}
+	req, target := rt.balancer.route(req, service)
 	switch req.URL.Path {
 	case "/intake/v2/events", "/intake/v2/rum/events":
+	case "/config/v1/agents":
+		if isConfigPoll(req.Context()) {
+			return rt.roundTripConfig(req)
+		}
+		return rt.roundTripper.RoundTrip(req)
 	default:
 		return rt.roundTripper.RoundTrip(req)
 	}
@@ -97,30 +291,85 @@ func (rt *roundTripperWrapper) RoundTrip(req *http.Request) (*http.Response, err
 	q.Set("verbose", "")
 	req.URL.RawQuery = q.Encode()
 
+	// RUM requests and those of simulated agents are sent by hey-apm rather than the Go agent,
+	// and counted separately.
+	rum := req.URL.Path == "/intake/v2/rum/events"
+	sim, simulated := simulatedRequestFrom(req.Context())
+	var body *bodyRecorder
+	if !rum && !simulated && req.Body != nil && req.Body != http.NoBody {
+		body = newBodyRecorder(req.Body, req.Header.Get("Content-Encoding"))
+		req.Body = body
+	}
+
+	if rt.compression != 0 && !rum && !simulated {
+		req = recompress(req, rt.compression)
+	}
+	if rt.chaos != nil {
+		var err error
+		if req, err = rt.chaos.mutate(req); err != nil {
+			return nil, err
+		}
+	}
+	if rt.slow != nil {
+		req = rt.slow.wrap(req)
+	}
+
+	start := time.Now()
 	resp, err := rt.roundTripper.RoundTrip(req)
+	if body != nil {
+		if err != nil || (resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted) {
+			rt.countFailedEvents(body)
+		} else {
+			body.succeeded()
+		}
+	}
 	if err != nil {
 		// Number of *failed* requests is tracked by the Go Agent.
 		rt.statsMu.Lock()
-		rt.stats.NumRequests++
+		if simulated {
+			rt.countSimulated(sim, 0, 0)
+		} else {
+			rt.countRequest(rum, target, 0, time.Since(start))
+		}
 		rt.statsMu.Unlock()
 		return resp, err
 	}
 	defer resp.Body.Close()
 
+	var data []byte
+	var rerr error
+	if resp.Body != http.NoBody {
+		data, rerr = ioutil.ReadAll(resp.Body)
+	}
+
 	rt.statsMu.Lock()
 	defer rt.statsMu.Unlock()
-	rt.stats.NumRequests++
+	var accepted uint64
+	if !simulated {
+		rt.countRequest(rum, target, resp.StatusCode, time.Since(start))
+	}
 
 	if resp.Body != http.NoBody {
-		if data, rerr := ioutil.ReadAll(resp.Body); rerr == nil {
+		if rerr == nil {
 			resp.Body = ioutil.NopCloser(bytes.NewReader(data))
 
 			var response intakeResponse
 			if err := json.Unmarshal(data, &response); err != nil {
 				rt.logger.Errorf("failed to decode response: %s", err)
 			} else {
-				rt.stats.EventsAccepted += response.Accepted
+				accepted = response.Accepted
+				switch {
+				case simulated:
+				case rum:
+					rt.stats.RUMEventsAccepted += response.Accepted
+				default:
+					rt.stats.EventsAccepted += response.Accepted
+					targetStats := rt.stats.Targets[target]
+					targetStats.EventsAccepted += response.Accepted
+					rt.stats.Targets[target] = targetStats
+				}
 				for _, e := range response.Errors {
+					rt.stats.Rejections[rejectionReason(e.Message)]++
 					if _, ok := rt.uniqueErrors[e.Message]; !ok {
 						rt.uniqueErrors[e.Message] = struct{}{}
 						rt.stats.UniqueErrors = append(rt.stats.UniqueErrors, e.Message)
@@ -129,6 +378,130 @@ func (rt *roundTripperWrapper) RoundTrip(req *http.Request) (*http.Response, err
 			}
 		}
 	}
+	if simulated {
+		rt.countSimulated(sim, resp.StatusCode, accepted)
+	}
+	return resp, err
+}
+
+// traceTLS returns a request that records the TLS handshakes made to send it, if any.
+func (rt *roundTripperWrapper) traceTLS(req *http.Request) *http.Request {
+	var start time.Time
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			start = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			duration := time.Since(start)
+			rt.statsMu.Lock()
+			defer rt.statsMu.Unlock()
+			rt.stats.TLSHandshakes++
+			rt.stats.TLSHandshakeTime += duration
+			if err != nil {
+				rt.stats.TLSHandshakeErrors++
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// countRequest records an intake request sent to a target and its response code, 0 if it failed.
+// It must be called with the lock held.
+func (rt *roundTripperWrapper) countRequest(rum bool, target string, code int, latency time.Duration) {
+	if !rum {
+		rt.stats.NumRequests++
+		rt.stats.IntakeResponses[code]++
+		rt.stats.IntakeLatency.Observe(latency)
+		targetStats := rt.stats.Targets[target]
+		targetStats.Requests++
+		if code != http.StatusOK && code != http.StatusAccepted {
+			targetStats.FailedRequests++
+		}
+		targetStats.Latency += latency
+		rt.stats.Targets[target] = targetStats
+		return
+	}
+	rt.stats.RUMRequests++
+	rt.stats.RUMLatency += latency
+	if latency > rt.stats.RUMMaxLatency {
+		rt.stats.RUMMaxLatency = latency
+	}
+}
+
+// countFailedEvents adds the events in the body of a failed request to the failed events,
+// once the body is closed or read to the end as it may still be being sent after the request returns.
+func (rt *roundTripperWrapper) countFailedEvents(body *bodyRecorder) {
+	rt.statsMu.Lock()
+	rt.counting++
+	rt.statsMu.Unlock()
+	body.fail(func(events uint64) {
+		rt.statsMu.Lock()
+		defer rt.statsMu.Unlock()
+		rt.stats.FailedEvents += events
+		rt.counting--
+		select {
+		case rt.counted <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// waitFailedEvents waits up to timeout, or without limit if 0, until the events in all the failed requests
+// are counted. It returns false if some weren't, because their bodies weren't closed in time.
+func (rt *roundTripperWrapper) waitFailedEvents(timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		rt.statsMu.RLock()
+		counting := rt.counting
+		rt.statsMu.RUnlock()
+		if counting == 0 {
+			return true
+		}
+		select {
+		case <-rt.counted:
+		case <-expired:
+			return false
+		}
+	}
+}
+
+// countSimulated records an intake request of a simulated agent, its response code, 0 if it failed,
+// and the number of events accepted. Events are only sent by successful requests, like those of the Go agent.
+// It must be called with the lock held.
+func (rt *roundTripperWrapper) countSimulated(sim simulatedRequest, code int, accepted uint64) {
+	agentStats := rt.stats.SimulatedAgents[sim.agent]
+	agentStats.Requests++
+	if code != http.StatusOK && code != http.StatusAccepted {
+		agentStats.FailedRequests++
+	} else {
+		agentStats.EventsSent += sim.events
+	}
+	agentStats.EventsAccepted += accepted
+	rt.stats.SimulatedAgents[sim.agent] = agentStats
+}
+
+// roundTripConfig sends an agent config request of a configPoller, and records its response code and latency.
+func (rt *roundTripperWrapper) roundTripConfig(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := rt.roundTripper.RoundTrip(req)
+	latency := time.Since(start)
+
+	var code int
+	if err == nil {
+		code = resp.StatusCode
+	}
+	rt.statsMu.Lock()
+	defer rt.statsMu.Unlock()
+	rt.stats.ConfigResponses[code]++
+	rt.stats.ConfigLatency += latency
+	if latency > rt.stats.ConfigMaxLatency {
+		rt.stats.ConfigMaxLatency = latency
+	}
 	return resp, err
 }
 
@@ -0,0 +1,95 @@
+package worker
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentTuningEnv(t *testing.T) {
+	tuning := agentTuning{bufferSize: 10 * 1024 * 1024, requestSize: 1024}
+	userEnv := map[string]string{}
+	lookupEnv := func(k string) (string, bool) {
+		v, ok := userEnv[k]
+		return v, ok
+	}
+
+	env, err := agentTuning{}.env(lookupEnv)
+	require.NoError(t, err)
+	assert.Empty(t, env)
+
+	env, err = tuning.env(lookupEnv)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"ELASTIC_APM_API_BUFFER_SIZE":  "10485760B",
+		"ELASTIC_APM_API_REQUEST_SIZE": "1024B",
+	}, env)
+
+	// settings of the user are kept when they agree, and aren't overridden otherwise
+	userEnv["ELASTIC_APM_API_REQUEST_SIZE"] = "1024B"
+	env, err = tuning.env(lookupEnv)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"ELASTIC_APM_API_BUFFER_SIZE": "10485760B"}, env)
+
+	userEnv["ELASTIC_APM_API_REQUEST_SIZE"] = "1KB"
+	_, err = tuning.env(lookupEnv)
+	assert.Error(t, err)
+}
+
+// testRoundTripper returns a round tripper sending requests to the given apm-servers in turn.
+func testRoundTripper(t *testing.T, serverURLs ...string) *roundTripperWrapper {
+	b, err := newBalancer(serverURLs, "")
+	require.NoError(t, err)
+	return newRoundTripper(http.DefaultTransport, newApmLogger(log.New(ioutil.Discard, "", 0)), b, "hey-worker-test",
+		0, nil, nil)
+}
+
+// Requests are routed on the service they are sent for, which sticks them to an apm-server.
+func TestRoundTripRouting(t *testing.T) {
+	var urls []string
+	hits := make([]int64, 3)
+	for i := range hits {
+		i := i
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&hits[i], 1)
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer srv.Close()
+		urls = append(urls, srv.URL)
+	}
+	rt := testRoundTripper(t, urls...)
+	rt.balancer.strategy = strategySticky
+
+	send := func(ctx context.Context, path string) {
+		req, err := http.NewRequest(http.MethodPost, urls[0]+path, strings.NewReader("{}\n"))
+		require.NoError(t, err)
+		resp, err := rt.RoundTrip(req.WithContext(ctx))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	for _, service := range []string{"hey-worker-test-java", "hey-worker-test-python"} {
+		for i := range hits {
+			atomic.StoreInt64(&hits[i], 0)
+		}
+		sim := context.WithValue(context.Background(), simulatedRequestKey{}, simulatedRequest{agent: "java", service: service})
+		for i := 0; i < 5; i++ {
+			send(sim, "/intake/v2/events")
+			send(context.Background(), "/config/v1/agents?service.name="+service)
+		}
+		for i := range hits {
+			if i == rt.balancer.pick(service) {
+				assert.Equal(t, int64(10), atomic.LoadInt64(&hits[i]), service)
+			} else {
+				assert.Zero(t, atomic.LoadInt64(&hits[i]), service)
+			}
+		}
+	}
+}
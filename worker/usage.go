@@ -0,0 +1,99 @@
+package worker
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+const (
+	// saturationCPU is the share of the available CPU above which hey-apm is likely saturated.
+	saturationCPU = 0.9
+	// saturationLag is the scheduler lag above which hey-apm is likely saturated.
+	saturationLag = time.Second
+)
+
+// Usage holds the resources used by the hey-apm process during a work.
+// Workers running concurrently in the same process report the same usage.
+type Usage struct {
+	// CPU time spent in user and system mode
+	CPUTime time.Duration
+	// Peak resident set size in bytes since the process started, 0 if not known
+	MaxRSS uint64
+	// Bytes of allocated heap objects at the end of the work
+	HeapAlloc uint64
+	// Number of completed GC cycles, and their total stop-the-world pause time
+	NumGC   uint32
+	GCPause time.Duration
+	// Number of CPUs the process can use at once
+	CPUs int
+}
+
+// readUsage returns the resources used by the process since it started.
+func readUsage() Usage {
+	var memstats runtime.MemStats
+	runtime.ReadMemStats(&memstats)
+	cpuTime, maxRSS := rusage()
+	return Usage{
+		CPUTime:   cpuTime,
+		MaxRSS:    maxRSS,
+		HeapAlloc: memstats.HeapAlloc,
+		NumGC:     memstats.NumGC,
+		GCPause:   time.Duration(memstats.PauseTotalNs),
+		CPUs:      runtime.GOMAXPROCS(0),
+	}
+}
+
+// since returns the resources used between an earlier usage and this one.
+// Peak RSS and heap are not cumulative, so they are kept as is.
+func (u Usage) since(earlier Usage) Usage {
+	u.CPUTime -= earlier.CPUTime
+	u.NumGC -= earlier.NumGC
+	u.GCPause -= earlier.GCPause
+	return u
+}
+
+// max returns the largest of each resource used in two usages.
+func (u Usage) max(other Usage) Usage {
+	if other.CPUTime > u.CPUTime {
+		u.CPUTime = other.CPUTime
+	}
+	if other.MaxRSS > u.MaxRSS {
+		u.MaxRSS = other.MaxRSS
+	}
+	if other.HeapAlloc > u.HeapAlloc {
+		u.HeapAlloc = other.HeapAlloc
+	}
+	if other.NumGC > u.NumGC {
+		u.NumGC = other.NumGC
+	}
+	if other.GCPause > u.GCPause {
+		u.GCPause = other.GCPause
+	}
+	if other.CPUs > u.CPUs {
+		u.CPUs = other.CPUs
+	}
+	return u
+}
+
+// CPUUtilization returns the share of the available CPU used by hey-apm during the work.
+func (r Result) CPUUtilization() float64 {
+	elapsed := r.Flushed.Sub(r.Start)
+	if elapsed <= 0 || r.Usage.CPUs <= 0 {
+		return 0
+	}
+	return float64(r.Usage.CPUTime) / float64(elapsed) / float64(r.Usage.CPUs)
+}
+
+// Saturation returns the reasons why hey-apm itself was likely the bottleneck of the work, if any,
+// in which case apm-server might have handled more load than it was given.
+func (r Result) Saturation() []string {
+	var reasons []string
+	if r.SchedulerLag > saturationLag {
+		reasons = append(reasons, fmt.Sprintf("event generation fell %v behind schedule", r.SchedulerLag.Truncate(time.Millisecond)))
+	}
+	if cpu := r.CPUUtilization(); cpu > saturationCPU {
+		reasons = append(reasons, fmt.Sprintf("CPU usage at %.0f%% of %d cores", 100*cpu, r.Usage.CPUs))
+	}
+	return reasons
+}
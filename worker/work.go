@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math/rand"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"go.elastic.co/apm"
@@ -12,9 +13,17 @@ import (
 )
 
 type worker struct {
-	stop   <-chan struct{} // graceful shutdown
-	logger *apmLogger
-	tracer *tracer
+	// events of each type created so far, accessed atomically
+	generatedTransactions, generatedSpans, generatedErrors uint64
+	maxSpansDropped uint64 // spans dropped by the Go agent over the max spans limit, accessed atomically
+
+	stop    <-chan struct{} // graceful shutdown
+	control *Control        // may be nil
+	rates   chan Rates      // rate changes sent by control
+	logger  *apmLogger
+	tracer  *tracer
+
+	errorSchedule, transactionSchedule schedule
 
 	ErrorFrequency     time.Duration
 	ErrorLimit         int
@@ -25,9 +34,14 @@ type worker struct {
 	TransactionLimit     int
 	SpanMinLimit         int
 	SpanMaxLimit         int
+	// ContextLevel is how detailed the context of transactions and spans is
+	ContextLevel contextLevel
 
 	RunTimeout   time.Duration
 	FlushTimeout time.Duration
+
+	// TelemetryInterval is how often rates are sampled into the result telemetry, 0 to disable it
+	TelemetryInterval time.Duration
 }
 
 // work uses the Go agent API to generate events and send them to apm-server.
@@ -39,63 +53,172 @@ func (w *worker) work(ctx context.Context) (Result, error) {
 		runTimerC = runTimer.C
 	}
 
+	// Generators disabled with a zero frequency start once control sets one
 	var errorTicker, transactionTicker maybeTicker
+	defer errorTicker.Stop()
+	defer transactionTicker.Stop()
 	if w.ErrorFrequency > 0 && w.ErrorLimit > 0 {
 		errorTicker.Start(w.ErrorFrequency)
-		defer errorTicker.Stop()
+		w.errorSchedule.start(time.Now(), w.ErrorFrequency)
 	}
 	if w.TransactionFrequency > 0 && w.TransactionLimit > 0 {
 		transactionTicker.Start(w.TransactionFrequency)
-		defer transactionTicker.Stop()
+		w.transactionSchedule.start(time.Now(), w.TransactionFrequency)
 	}
 
+	usage := readUsage()
 	result := Result{Start: time.Now()}
+	handle := &controlled{rates: w.rates, stats: func() Result { return w.stats(result.Start) }}
+	handle.exhausted(w.TransactionLimit <= 0, w.ErrorLimit <= 0)
+	w.control.attach(handle)
+
+	var telemetryTicker maybeTicker
+	var telemetry telemetry
+	if w.TelemetryInterval > 0 {
+		telemetryTicker.Start(w.TelemetryInterval)
+		telemetry.last = Result{Start: result.Start, End: result.Start}
+		defer telemetryTicker.Stop()
+	}
+
 	var done bool
 	for !done {
 		select {
 		case <-ctx.Done():
+			w.control.finish(handle, w.stats(result.Start))
 			return Result{}, ctx.Err()
 		case <-w.stop:
 			done = true
 		case <-runTimerC:
 			done = true
+		case rates := <-w.rates:
+			if rates.ErrorFrequency > 0 && w.ErrorLimit > 0 {
+				w.ErrorFrequency = rates.ErrorFrequency
+				if errorTicker.C != nil {
+					errorTicker.Stop()
+					errorTicker.Start(w.ErrorFrequency)
+					w.errorSchedule.setFrequency(time.Now(), w.ErrorFrequency)
+				} else {
+					errorTicker.Start(w.ErrorFrequency)
+					w.errorSchedule.start(time.Now(), w.ErrorFrequency)
+				}
+			}
+			if rates.TransactionFrequency > 0 && w.TransactionLimit > 0 {
+				w.TransactionFrequency = rates.TransactionFrequency
+				if transactionTicker.C != nil {
+					transactionTicker.Stop()
+					transactionTicker.Start(w.TransactionFrequency)
+					w.transactionSchedule.setFrequency(time.Now(), w.TransactionFrequency)
+				} else {
+					transactionTicker.Start(w.TransactionFrequency)
+					w.transactionSchedule.start(time.Now(), w.TransactionFrequency)
+				}
+			}
 		case <-errorTicker.C:
 			w.sendError()
+			w.errorSchedule.done()
 			w.ErrorLimit--
 			if w.ErrorLimit == 0 {
 				errorTicker.Stop()
+				w.errorSchedule.stop(time.Now())
+				handle.exhausted(false, true)
 			}
+		case now := <-telemetryTicker.C:
+			stats := w.stats(result.Start)
+			stats.End = now
+			telemetry.sample(stats)
 		case <-transactionTicker.C:
 			w.sendTransaction()
+			w.transactionSchedule.done()
 			w.TransactionLimit--
 			if w.TransactionLimit == 0 {
 				transactionTicker.Stop()
+				w.transactionSchedule.stop(time.Now())
+				handle.exhausted(true, false)
 			}
 		}
 	}
 
 	result.End = time.Now()
-	w.flush()
+	w.errorSchedule.stop(result.End)
+	w.transactionSchedule.stop(result.End)
+	flushTimedOut := !w.flush()
+	if !w.tracer.roundTripper.waitFailedEvents(w.FlushTimeout) {
+		w.logger.Errorf("timed out counting the events of failed requests")
+	}
 	result.Flushed = time.Now()
 	result.TracerStats = w.tracer.Stats()
 	result.TransportStats = w.tracer.TransportStats()
+	w.countGenerated(&result)
+	result.MaxSpansDropped = atomic.LoadUint64(&w.maxSpansDropped)
+	if accounted := result.accounted(); flushTimedOut && result.Generated > accounted {
+		// Events not accounted for otherwise were still buffered when flushing timed out
+		result.FlushTimeoutDropped = result.Generated - accounted
+	}
+	result.SchedulerLag = w.schedulerLag(result.End)
+	result.Usage = readUsage().since(usage)
+	if w.TelemetryInterval > 0 {
+		// Events sent while flushing are sampled too
+		final := result
+		final.End = result.Flushed
+		telemetry.sample(final)
+		result.Telemetry = telemetry.samples
+	}
+	w.control.finish(handle, result)
 	return result, nil
 }
 
+// stats returns the stats captured so far by a worker started at the given time.
+func (w *worker) stats(start time.Time) Result {
+	result := Result{
+		TracerStats:     w.tracer.Stats(),
+		TransportStats:  w.tracer.TransportStats(),
+		MaxSpansDropped: atomic.LoadUint64(&w.maxSpansDropped),
+		SchedulerLag:    w.schedulerLag(time.Now()),
+		Start:           start,
+	}
+	w.countGenerated(&result)
+	return result
+}
+
+// countGenerated sets the numbers of events created so far in a result.
+func (w *worker) countGenerated(result *Result) {
+	result.GeneratedTransactions = atomic.LoadUint64(&w.generatedTransactions)
+	result.GeneratedSpans = atomic.LoadUint64(&w.generatedSpans)
+	result.GeneratedErrors = atomic.LoadUint64(&w.generatedErrors)
+	result.Generated = result.GeneratedTransactions + result.GeneratedSpans + result.GeneratedErrors
+}
+
+// schedulerLag returns how far the generation of errors or transactions, whichever is furthest,
+// falls behind its target rate.
+func (w *worker) schedulerLag(now time.Time) time.Duration {
+	lag := w.errorSchedule.lag(now)
+	if transactionLag := w.transactionSchedule.lag(now); transactionLag > lag {
+		lag = transactionLag
+	}
+	return lag
+}
+
 func (w *worker) sendError() {
 	err := &generatedErr{frames: randRange(w.ErrorFrameMinLimit, w.ErrorFrameMaxLimit)}
 	w.tracer.NewError(err).Send()
+	atomic.AddUint64(&w.generatedErrors, 1)
 }
 
 func (w *worker) sendTransaction() {
 	tx := w.tracer.StartTransaction("generated", "gen")
 	defer tx.End()
 	spanCount := randRange(w.SpanMinLimit, w.SpanMaxLimit)
-	sendSpans(tx, spanCount)
+	dropped := sendSpans(tx, spanCount, w.ContextLevel)
+	atomic.AddUint64(&w.maxSpansDropped, uint64(dropped))
 	tx.Context.SetTag("spans", strconv.Itoa(spanCount))
+	w.ContextLevel.setTransactionContext(w.tracer.Tracer, tx)
+	atomic.AddUint64(&w.generatedSpans, uint64(spanCount))
+	atomic.AddUint64(&w.generatedTransactions, 1)
 }
 
-func sendSpans(tx *apm.Transaction, n int) {
+// sendSpans sends n spans of the transaction with context of the given level, and returns
+// how many of them were dropped for exceeding the max spans per transaction.
+func sendSpans(tx *apm.Transaction, n int, level contextLevel) (dropped int) {
 	// Send spans in a separate goroutine, to ensure we keep
 	// the number of stack frames stable despite changes to
 	// hey-apm.
@@ -104,6 +227,9 @@ func sendSpans(tx *apm.Transaction, n int) {
 		defer close(done)
 		for i := 0; i < n; i++ {
 			span := tx.StartSpan("I'm a span", "gen.era.ted", nil)
+			if span.Dropped() {
+				dropped++
+			}
 			resource := "service-1"
 			if n % 2 == 0 {
 				resource = "service-2"
@@ -112,11 +238,13 @@ func sendSpans(tx *apm.Transaction, n int) {
 				Name: resource,
 				Resource: resource,
 			})
+			level.setSpanContext(span, i)
 			span.Duration = time.Duration(rand.Intn(int(10 * time.Millisecond)))
-			span.End()
+			level.endSpan(span)
 		}
 	}()
 	<-done
+	return dropped
 }
 
 func randRange(min, max int) int {
@@ -124,7 +252,8 @@ func randRange(min, max int) int {
 }
 
 // flush ensures that the entire workload defined is pushed to the apm-server, within the worker timeout limit.
-func (w *worker) flush() {
+// It returns false if the timeout was reached first.
+func (w *worker) flush() bool {
 	defer w.tracer.Close()
 
 	ctx := context.Background()
@@ -136,7 +265,9 @@ func (w *worker) flush() {
 	w.tracer.Flush(ctx.Done())
 	if ctx.Err() != nil {
 		w.logger.Errorf("timed out waiting for flush to complete")
+		return false
 	}
+	return true
 }
 
 type generatedErr struct {
@@ -175,6 +306,8 @@ func (t *maybeTicker) Start(d time.Duration) {
 }
 
 func (t *maybeTicker) Stop() {
-	t.ticker.Stop()
+	if t.ticker != nil {
+		t.ticker.Stop()
+	}
 	t.C = nil
 }